@@ -0,0 +1,149 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLog writes a line for each request served, in the combined log
+// format or as JSON.
+type accessLog struct {
+	mux  sync.Mutex
+	out  io.Writer
+	json bool
+	now  func() time.Time
+}
+
+func newAccessLog(out io.Writer, format string) (*accessLog, error) {
+	switch format {
+	case "combined", "json":
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+	return &accessLog{out: out, json: format == "json", now: time.Now}, nil
+}
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streamed pages reach the client while they are fetched.
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheOutcome returns how the cache answered a request from the headers of its response.
+func cacheOutcome(h http.Header) string {
+	if s := h.Get("X-Cache-Status"); s != "" {
+		return s
+	}
+	if h.Get("X-From-Cache") == "1" {
+		return "HIT"
+	}
+	if h.Get("X-Cached-Until") != "" {
+		return "MISS"
+	}
+	return "-"
+}
+
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	Cache    string    `json:"cache"`
+	Request  string    `json:"request_id,omitempty"`
+	Referer  string    `json:"referer,omitempty"`
+	Agent    string    `json:"user_agent,omitempty"`
+}
+
+// wrap logs the requests served by h.
+func (a *accessLog) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := a.now()
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			if aw.code == 0 {
+				aw.code = http.StatusOK
+			}
+			remote, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				remote = r.RemoteAddr
+			}
+			a.write(&accessEntry{
+				Time:     start,
+				Remote:   remote,
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Query:    r.URL.RawQuery,
+				Status:   aw.code,
+				Bytes:    aw.bytes,
+				Duration: float64(a.now().Sub(start)) / float64(time.Millisecond),
+				Cache:    cacheOutcome(aw.Header()),
+				Request:  aw.Header().Get(requestIDHeader),
+				Referer:  r.Referer(),
+				Agent:    r.UserAgent(),
+			}, r.Proto)
+		}()
+		h.ServeHTTP(aw, r)
+	})
+}
+
+func (a *accessLog) write(e *accessEntry, proto string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.json {
+		json.NewEncoder(a.out).Encode(e)
+		return
+	}
+	uri := e.Path
+	if e.Query != "" {
+		uri += "?" + e.Query
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	fmt.Fprintf(a.out, "%s - - [%s] %q %d %d %q %q %.3f %s\n", e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+uri+" "+proto, e.Status, e.Bytes, orDash(e.Referer), orDash(e.Agent), e.Duration, e.Cache)
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, nil)
+	var buf bytes.Buffer
+	al, err := newAccessLog(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = al.wrap(h)
+	serve(h, "/test/search/cranes?lang=de")
+	serve(h, "/test/search/cranes?lang=de")
+	serve(h, "/test/search/cranes/x")
+	var es []accessEntry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e accessEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	if len(es) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(es))
+	}
+	for i, exp := range []struct {
+		status int
+		bytes  int64
+		cache  string
+	}{{200, 13, "MISS"}, {200, 13, "HIT"}, {400, 0, "-"}} {
+		e := es[i]
+		if e.Status != exp.status || e.Cache != exp.cache || (exp.bytes > 0 && e.Bytes != exp.bytes) {
+			t.Errorf("line %d: unexpected %+v", i, e)
+		}
+		if e.Method != "GET" || !strings.HasPrefix(e.Path, "/test/search/cranes") || e.Request == "" {
+			t.Errorf("line %d: unexpected request %+v", i, e)
+		}
+	}
+	if es[0].Query != "lang=de" {
+		t.Errorf("unexpected query %q", es[0].Query)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	var buf bytes.Buffer
+	al, err := newAccessLog(&buf, "combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.now = func() time.Time { return time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC) }
+	h := al.wrap(http.HandlerFunc(healthz))
+	serve(h, "/healthz?x=1", "User-Agent", "probe")
+	exp := `192.0.2.1 - - [01/Mar/2017:10:00:00 +0000] "GET /healthz?x=1 HTTP/1.1" 200 3 "-" "probe" 0.000 -` + "\n"
+	if buf.String() != exp {
+		t.Errorf("unexpected line %q, expected %q", buf.String(), exp)
+	}
+	if _, err := newAccessLog(&buf, "xml"); err == nil {
+		t.Error("expected an invalid format to fail")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authenticator only lets through requests carrying one of its API keys as
+// a bearer token or the credentials of one of its users, except for the
+// exempt paths.
+type authenticator struct {
+	keys   []string
+	users  map[string]string
+	exempt map[string]bool
+}
+
+// loadAuth reads the credentials in file path, one for each line: either
+// an API key or a user and password separated by a colon. Empty lines and
+// lines starting with # are skipped.
+func loadAuth(path string, exempt []string) (*authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credentials: %s", err)
+	}
+	a := &authenticator{
+		users:  make(map[string]string),
+		exempt: make(map[string]bool),
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if user, pass, ok := strings.Cut(line, ":"); ok {
+			a.users[user] = pass
+			continue
+		}
+		a.keys = append(a.keys, line)
+	}
+	if len(a.keys) == 0 && len(a.users) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", path)
+	}
+	for _, p := range exempt {
+		if p = strings.TrimSpace(p); p != "" {
+			a.exempt[p] = true
+		}
+	}
+	return a, nil
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// allowed reports whether r carries valid credentials.
+func (a *authenticator) allowed(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		want, ok := a.users[user]
+		return ok && equal(pass, want)
+	}
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	var found bool
+	for _, k := range a.keys {
+		// Compare with all keys to not leak which one matched
+		if equal(strings.TrimSpace(key), k) {
+			found = true
+		}
+	}
+	return found
+}
+
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.exempt[r.URL.Path] && !a.allowed(r) {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="interproxy"`)
+			if len(a.users) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="interproxy"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth")
+	creds := "# keys\nsecret-key\n\nalice:wonderland\n"
+	if err := os.WriteFile(path, []byte(creds), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadAuth(path, []string{"/healthz", " /metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.wrap(http.HandlerFunc(healthz))
+	for _, tt := range []struct {
+		path string
+		set  func(r *http.Request)
+		code int
+	}{
+		{"/test/search/cranes", func(r *http.Request) {}, 401},
+		{"/test/search/cranes", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret-key") }, 200},
+		{"/test/search/cranes", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, 401},
+		{"/test/search/cranes", func(r *http.Request) { r.SetBasicAuth("alice", "wonderland") }, 200},
+		{"/test/search/cranes", func(r *http.Request) { r.SetBasicAuth("alice", "secret-key") }, 401},
+		{"/test/search/cranes", func(r *http.Request) { r.SetBasicAuth("bob", "wonderland") }, 401},
+		{"/healthz", func(r *http.Request) {}, 200},
+		{"/metrics", func(r *http.Request) {}, 200},
+		{"/readyz", func(r *http.Request) {}, 401},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		tt.set(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %v: got %d, expected %d", tt.path, r.Header, w.Code, tt.code)
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", tt.path)
+		}
+	}
+	os.WriteFile(path, []byte("# nothing\n"), 0600)
+	if _, err := loadAuth(path, nil); err == nil {
+		t.Error("expected an error without credentials")
+	}
+}
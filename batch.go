@@ -0,0 +1,176 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// batchItem is a page requested in a batch.
+type batchItem struct {
+	Query  string     `json:"q"`
+	Offset int        `json:"offset"`
+	Params url.Values `json:"params,omitempty"`
+}
+
+// splitJSON splits the body of a batch response made of a JSON array with
+// one string for each requested page.
+func splitJSON(body []byte, n int) ([][]byte, error) {
+	var bodies []string
+	if err := json.Unmarshal(body, &bodies); err != nil {
+		return nil, fmt.Errorf("cannot decode batch response: %s", err)
+	}
+	if len(bodies) != n {
+		return nil, fmt.Errorf("batch response has %d pages, expected %d", len(bodies), n)
+	}
+	bs := make([][]byte, n)
+	for i := range bodies {
+		bs[i] = []byte(bodies[i])
+	}
+	return bs, nil
+}
+
+// batcher collects fetches for the cache to send them to the upstream in a
+// single request, either when max are waiting or after wait.
+type batcher struct {
+	url   string
+	max   int
+	wait  time.Duration
+	split func(body []byte, n int) ([][]byte, error)
+	mux   sync.Mutex
+	jobs  []*job
+	timer *time.Timer
+}
+
+func newBatcher(url string, max int, wait time.Duration) *batcher {
+	return &batcher{url: url, max: max, wait: wait, split: splitJSON}
+}
+
+// add queues j for the next batch.
+func (b *batcher) add(j *job) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.jobs = append(b.jobs, j)
+	if len(b.jobs) >= b.max {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.wait, b.flush)
+	}
+}
+
+func (b *batcher) flush() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.jobs) == 0 {
+		return
+	}
+	go b.run(b.jobs)
+	b.jobs = nil
+}
+
+// run fetches the pages of jobs in one request and caches each of them.
+// The request is retried, gated and counted by the breaker like single
+// fetches.
+func (b *batcher) run(jobs []*job) {
+	var bodies [][]byte
+	c := jobs[0].cache
+	what := fmt.Sprintf("batch of %d pages", len(jobs))
+	err := c.retry(c.debug, what, nil, func() error {
+		var err error
+		bodies, err = b.get(jobs)
+		return err
+	})
+	for i, j := range jobs {
+		var p *page
+		if err != nil {
+			p = newPage(j.res.n, nil)
+		} else {
+			p = newPage(j.res.n, bodies[i])
+			p.fetched = time.Now()
+		}
+		j.finish(p, err)
+	}
+}
+
+func (b *batcher) get(jobs []*job) ([][]byte, error) {
+	c := jobs[0].cache
+	items := make([]batchItem, len(jobs))
+	for i, j := range jobs {
+		items[i] = batchItem{Query: j.res.q, Offset: int(j.res.n), Params: j.res.params}
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if d := c.config.fetchTimeout; d > 0 {
+		var tcancel context.CancelFunc
+		ctx, tcancel = context.WithTimeout(ctx, d)
+		defer tcancel()
+	}
+	stop := context.AfterFunc(c.parent.stopped, cancel)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, "POST", b.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create batch request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.config.setUserAgent(req)
+	if s := c.config.signer; s != nil {
+		if err := s.sign(req); err != nil {
+			return nil, fmt.Errorf("cannot sign batch request: %s", err)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, transient(ctx, fmt.Errorf("cannot POST batch of %d pages: %s", len(jobs), err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "") {
+		return nil, &rateLimitError{parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), time.Second)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, upstreamErrorBody))
+		err := &upstreamError{url: b.url, status: resp.Status, code: resp.StatusCode, body: body}
+		if resp.StatusCode >= 500 {
+			return nil, &transientError{err}
+		}
+		return nil, err
+	}
+	// Each page of the batch can be as large as a single one
+	max := c.config.maxBody * int64(len(jobs))
+	r, err := limitBody(b.url, resp, max)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, transient(ctx, fmt.Errorf("cannot read batch of %d pages: %s", len(jobs), err))
+	}
+	if err := checkBody(b.url, resp, body, max); err != nil {
+		return nil, err
+	}
+	return b.split(body, len(jobs))
+}
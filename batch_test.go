@@ -0,0 +1,167 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func batchHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var items []batchItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			t.Error(err)
+			return
+		}
+		bodies := make([]string, len(items))
+		for i, it := range items {
+			bodies[i] = fmt.Sprintf("%s/%d", it.Query, it.Offset)
+		}
+		json.NewEncoder(w).Encode(bodies)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	single := newUpstream(t, nil)
+	batch := newUpstream(t, batchHandler(t))
+	o, _ := newTestOrigin(t, single, func(cf *config) {
+		cf.batchURL = batch.URL
+		cf.batchMax = 5
+		cf.batchWait = time.Second
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(q string) {
+			defer wg.Done()
+			p, err := o.cache.get(newQuery(q, nil, nil), 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := q + "/10"; string(p.body) != want {
+				t.Errorf("got %q, expected %q", p.body, want)
+			}
+		}(fmt.Sprintf("cold%d", i))
+	}
+	wg.Wait()
+	if n := batch.total(); n != 1 {
+		t.Errorf("expected a single batch request, got %d", n)
+	}
+	if n := single.total(); n != 0 {
+		t.Errorf("expected no single page requests, got %d", n)
+	}
+}
+
+func TestBatchWait(t *testing.T) {
+	batch := newUpstream(t, batchHandler(t))
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.batchURL = batch.URL
+		cf.batchMax = 5
+		cf.batchWait = 20 * time.Millisecond
+	})
+	p, err := o.cache.get(newQuery("alone", nil, nil), 0)
+	if err != nil || string(p.body) != "alone/0" {
+		t.Errorf("expected the page after the batch wait, got %v", err)
+	}
+}
+
+func TestBatchUpstreamErrors(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		fails = 1
+	)
+	ok := batchHandler(t)
+	batch := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if fails > 0 {
+			fails--
+			http.Error(w, "down", 500)
+			return
+		}
+		ok(w, r)
+	})
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.batchURL = batch.URL
+		cf.batchMax = 1
+		cf.retries = 1
+		cf.retryBase = time.Millisecond
+	})
+	// Failed batches are retried like single fetches
+	p, err := o.cache.get(newQuery("a", nil, nil), 0)
+	if err != nil || string(p.body) != "a/0" {
+		t.Errorf("expected the page after a retry, got %v", err)
+	}
+	if n := batch.total(); n != 2 {
+		t.Errorf("expected 2 batch requests, got %d", n)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		h     http.HandlerFunc
+		setup func(*config)
+	}{
+		{"status", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "gone", 404) }, nil},
+		{"size", ok, func(cf *config) { cf.maxBody = 2 }},
+	} {
+		batch := newUpstream(t, tt.h)
+		o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+			cf.batchURL = batch.URL
+			cf.batchMax = 1
+			cf.retries = 0
+			if tt.setup != nil {
+				tt.setup(cf)
+			}
+		})
+		if _, err := o.cache.get(newQuery("a", nil, nil), 0); err == nil {
+			t.Errorf("%s: expected an error from the batch", tt.name)
+		}
+	}
+}
+
+func TestBatchSigned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyset(t, path, []signKey{{ID: "k", Secret: "s"}}, time.Now())
+	s, err := newSigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := batchHandler(t)
+	batch := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature-Key") != "k" {
+			http.Error(w, "unsigned", 403)
+			return
+		}
+		ok(w, r)
+	})
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.batchURL = batch.URL
+		cf.batchMax = 1
+		cf.signer = s
+	})
+	if _, err := o.cache.get(newQuery("a", nil, nil), 0); err != nil {
+		t.Errorf("expected a signed batch request: %s", err)
+	}
+}
+
+func TestSplitJSON(t *testing.T) {
+	if _, err := splitJSON([]byte(`["a"]`), 2); err == nil {
+		t.Error("expected an error for a short batch")
+	}
+	if _, err := splitJSON([]byte(`{}`), 1); err == nil {
+		t.Error("expected an error for an invalid batch")
+	}
+	bs, err := splitJSON([]byte(`["a","b"]`), 2)
+	if err != nil || string(bs[0]) != "a" || string(bs[1]) != "b" {
+		t.Errorf("unexpected split %q: %v", bs, err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("upstream is down, not fetching")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breaker stops the fetches of an origin after some failed in a row, so that
+// requests fail fast instead of piling up while the upstream is down. After a
+// cooldown a single fetch is let through to probe whether the upstream is
+// back: it closes the breaker if it succeeds, or keeps it open for another
+// cooldown.
+type breaker struct {
+	mux      sync.Mutex
+	fails    int
+	window   time.Duration
+	cooldown time.Duration
+	// failed counts the failures in a row, the last one at last
+	failed int
+	last   time.Time
+	open   bool
+	// probe is when the next fetch can go through while open
+	probe time.Time
+	// probing is set while the probe fetch runs
+	probing bool
+}
+
+// newBreaker opens after fails failures, each less than window after the
+// previous one, and probes the upstream every cooldown.
+func newBreaker(fails int, window, cooldown time.Duration) *breaker {
+	return &breaker{fails: fails, window: window, cooldown: cooldown}
+}
+
+// rejects reports whether a fetch at t would not be let through.
+func (b *breaker) rejects(t time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.open && (b.probing || t.Before(b.probe))
+}
+
+// allow reports whether a fetch can start at t. While the breaker is open,
+// it lets through the fetch probing the upstream.
+func (b *breaker) allow(t time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || t.Before(b.probe) {
+		return false
+	}
+	b.probing = true
+	b.probe = t.Add(b.cooldown)
+	return true
+}
+
+// record tells the result of a fetch ended at t.
+func (b *breaker) record(ok bool, t time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.probing = false
+	if ok {
+		b.failed = 0
+		b.open = false
+		return
+	}
+	if b.failed > 0 && t.Sub(b.last) > b.window {
+		b.failed = 0
+	}
+	b.failed++
+	b.last = t
+	if b.open || b.failed >= b.fails {
+		b.open = true
+		b.probe = t.Add(b.cooldown)
+	}
+}
+
+func (b *breaker) state(t time.Time) string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch {
+	case !b.open:
+		return breakerClosed
+	case b.probing || !t.Before(b.probe):
+		return breakerHalfOpen
+	}
+	return breakerOpen
+}
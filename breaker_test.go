@@ -0,0 +1,104 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerStates(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(2, time.Second, time.Minute)
+	b.record(false, now)
+	b.record(false, now.Add(2*time.Second))
+	if s := b.state(now.Add(2 * time.Second)); s != breakerClosed {
+		t.Errorf("expected failures apart more than the window not to open the breaker, got %s", s)
+	}
+	b.record(false, now.Add(2500*time.Millisecond))
+	now = now.Add(2500 * time.Millisecond)
+	if s := b.state(now); s != breakerOpen || !b.rejects(now) || b.allow(now) {
+		t.Fatalf("expected the breaker open, got %s", s)
+	}
+	now = now.Add(time.Minute)
+	if !b.allow(now) {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if s := b.state(now); s != breakerHalfOpen || b.allow(now) {
+		t.Errorf("expected a single probe while half-open, got %s", s)
+	}
+	b.record(false, now)
+	if s := b.state(now); s != breakerOpen {
+		t.Errorf("expected the breaker open again after a failed probe, got %s", s)
+	}
+	now = now.Add(time.Minute)
+	b.allow(now)
+	b.record(true, now)
+	if s := b.state(now); s != breakerClosed || !b.allow(now) {
+		t.Errorf("expected the breaker closed after a successful probe, got %s", s)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var down int32
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+		cf.negativeTTL = 0
+		cf.lifetime = 20 * time.Millisecond
+		cf.stale = 0
+		cf.breakerFails = 2
+		cf.breakerRetry = 100 * time.Millisecond
+	})
+	serve(h, "/test/search/cached")
+	atomic.StoreInt32(&down, 1)
+	for _, q := range []string{"a", "b"} {
+		if w := serve(h, "/test/search/"+q); w.Code != http.StatusBadGateway {
+			t.Fatalf("expected 502, got %d", w.Code)
+		}
+	}
+	if w := serve(h, "/test/search/c"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with the breaker open, got %d", w.Code)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if w := serve(h, "/test/search/cached"); w.Code != http.StatusOK || w.Header().Get("X-Cache-Status") != "STALE-BREAKER" {
+		t.Errorf("expected the expired page with the breaker open, got %d %q", w.Code, w.Header().Get("X-Cache-Status"))
+	}
+	if n := u.total(); n != 3 {
+		t.Errorf("expected no fetch with the breaker open, got %d", n-1)
+	}
+	var st stats
+	if err := json.Unmarshal(serve(h, "/_/test/stats").Body.Bytes(), &st); err != nil || st.Breaker != breakerOpen {
+		t.Errorf("expected the breaker open in the stats, got %q (%v)", st.Breaker, err)
+	}
+	body := serve(h, "/metrics").Body.String()
+	for _, line := range []string{
+		`interproxy_upstream_breaker_open{origin="test"} 1`,
+		`interproxy_upstream_breaker_rejects_total{origin="test"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in metrics", line)
+		}
+	}
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(100 * time.Millisecond)
+	if w := serve(h, "/test/search/c"); w.Code != http.StatusOK {
+		t.Errorf("expected the probe to succeed, got %d", w.Code)
+	}
+	if s := o.cache.breaker.state(time.Now()); s != breakerClosed {
+		t.Errorf("expected the breaker closed, got %s", s)
+	}
+}
@@ -2,59 +2,430 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"runtime/debug"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type page struct {
-	n      offset
-	body   []byte
-	expire time.Time
-	cached bool
+	n       offset
+	body    []byte
+	size    int
+	gzipped bool
+	// normalized holds the results extracted from body as JSON
+	normalized []byte
+	expire     time.Time
+	fetched    time.Time
+	// age reported by the upstream when the page was fetched
+	originAge time.Duration
+	cached    bool
+	// etag is the strong validator of the uncompressed body
+	etag string
+	// lastModified is the Last-Modified time sent by the upstream
+	lastModified time.Time
+	// originTag is the ETag sent by the upstream
+	originTag string
+	// notModified is set if the upstream answered 304 Not Modified to a
+	// revalidation: the page has no body and the cached one is still valid
+	notModified bool
+	// ctype is the Content-Type sent by the upstream
+	ctype string
+	// code is the status code sent by the upstream, 200 if zero
+	code int
+	// ttl is the lifetime requested by the upstream, if any
+	ttl time.Duration
+	// noStore is set if the upstream does not allow to cache the page
+	noStore bool
+	// tenant owns the page, if not empty
+	tenant string
+	// file holds the body instead of body, if not empty
+	file string
+	// status is reported as X-Cache-Status when not empty
+	status string
+	// pages is the number of pages of results reported by the upstream,
+	// zero if unknown
+	pages int
+	// stream is the body being fetched, instead of body, if not nil
+	stream *stream
 }
 
 func newPage(n offset, body []byte) *page {
 	return &page{
 		n:    n,
 		body: body,
+		size: len(body),
 	}
 }
 
+var _ io.WriterTo = (*page)(nil)
+
+// WriteTo writes the uncompressed body of p to w.
 func (p *page) WriteTo(w io.Writer) (int64, error) {
+	if p.gzipped {
+		zr, err := gzip.NewReader(bytes.NewReader(p.body))
+		if err != nil {
+			return 0, err
+		}
+		return io.Copy(w, zr)
+	}
 	n, err := w.Write(p.body)
 	return int64(n), err
 }
 
+// uncompressed returns the body of p, decompressing it if needed.
+func (p *page) uncompressed() ([]byte, error) {
+	if !p.gzipped {
+		return p.body, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, p.size))
+	if _, err := p.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contentType returns the content type sent by the upstream or, if there
+// was none, the one detected from the uncompressed body of p.
+func (p *page) contentType() string {
+	if p.ctype != "" {
+		return p.ctype
+	}
+	if !p.gzipped {
+		return http.DetectContentType(p.body)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p.body))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(zr, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// etag returns a strong entity tag for body.
+func etag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// gzipBody returns body gzip compressed.
+func gzipBody(body []byte) ([]byte, error) {
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	var buf bytes.Buffer
+	zw.Reset(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compress replaces the body of p with its gzip compressed form.
+func (p *page) compress() error {
+	if p.gzipped {
+		return nil
+	}
+	body, err := gzipBody(p.body)
+	if err != nil {
+		return err
+	}
+	p.body = body
+	p.gzipped = true
+	return nil
+}
+
+// age returns the age of p at t as a shared cache would report it.
+func (p *page) age(t time.Time) time.Duration {
+	if p.fetched.IsZero() {
+		return p.originAge
+	}
+	return t.Sub(p.fetched) + p.originAge
+}
+
 type group string
 
-type entry struct {
+// query is what gets requested from the upstream for a cache group.
+type query struct {
+	cg     group
+	q      string
+	header http.Header
+	// base is the query as cached, after normalizing it
+	base string
+	// hash is the hash of the values of the key headers in header, if any
+	hash string
+	// deadline is when the client stops waiting, zero if it waits forever
 	deadline time.Time
-	data     []byte
+	// cutoff is the deadline set by the client, which also ends its fetches
+	cutoff time.Time
+	// ctx ends when the client goes away, nil if no client is waiting
+	ctx context.Context
+	// tenant owns the pages of the query, if not empty
+	tenant string
+	// params are added to the query string of the upstream URL
+	params url.Values
+	// refresh fetches the page again even if it is cached
+	refresh bool
+	// peek only looks the page up, failing with errUncached instead of fetching it
+	peek bool
+	// id is the ID of the client request, if any
+	id string
+	// single fetches only the requested page, without prefetching around it
+	single bool
+	// mode selects the URL template of the upstream, the primary one if empty
+	mode string
+}
+
+// setTenant makes the pages of q belong to tenant t, separate from the pages of other tenants.
+func (q *query) setTenant(t string) {
+	if t == "" {
+		return
+	}
+	q.tenant = t
+	q.cg = q.key()
+}
+
+// setParams forwards the values of keys in vals to the upstream and makes
+// them part of the cache group, if any is set.
+func (q *query) setParams(vals url.Values, keys []string) {
+	params := make(url.Values)
+	for _, k := range keys {
+		if v, ok := vals[k]; ok {
+			params[k] = v
+		}
+	}
+	if len(params) == 0 {
+		return
+	}
+	q.params = params
+	q.cg = q.key()
+}
+
+// setHits asks the upstream for n results per page with parameter param,
+// after the ones added by setParams. Pages of different sizes are cached apart.
+func (q *query) setHits(param string, n int) {
+	if n <= 0 {
+		return
+	}
+	if q.params == nil {
+		q.params = make(url.Values)
+	}
+	q.params.Set(param, strconv.Itoa(n))
+	q.cg = q.key()
 }
 
-func newEntry(data []byte, d time.Duration) *entry {
+// setMode fetches q with the template of mode. Pages of each mode are cached apart.
+func (q *query) setMode(mode string) {
+	if mode == "" {
+		return
+	}
+	q.mode = mode
+	q.cg = q.key()
+}
+
+// keyEscaper escapes the separators of the parts of a cache group in the
+// query and the tenant, so that no query reads as the parts of another.
+var keyEscaper = strings.NewReplacer("%", "%25", "@", "%40", "#", "%23", "?", "%3F", "!", "%21")
+
+// key returns the cache group of q: its tenant, the query as cached, the
+// hash of its key headers, its parameters and its mode.
+func (q *query) key() group {
+	k := keyEscaper.Replace(q.base)
+	if q.tenant != "" {
+		k = keyEscaper.Replace(q.tenant) + "@" + k
+	}
+	if q.hash != "" {
+		k += "#" + q.hash
+	}
+	if len(q.params) > 0 {
+		k += "?" + q.params.Encode()
+	}
+	if q.mode != "" {
+		k += "!" + q.mode
+	}
+	return group(k)
+}
+
+// background returns q for fetches no client is waiting for.
+func (q *query) background() *query {
+	bq := *q
+	bq.deadline = time.Time{}
+	bq.cutoff = time.Time{}
+	bq.ctx = nil
+	return &bq
+}
+
+// normalizers are the rules that can make equivalent queries share a cache group.
+var normalizers = map[string]func(string) string{
+	"trim":  strings.TrimSpace,
+	"lower": strings.ToLower,
+	"space": func(s string) string { return strings.Join(strings.Fields(s), " ") },
+}
+
+// normalize applies rules to the query, unescaped, in the cache group of q.
+// The upstream still gets the query as it is.
+func (q *query) normalize(rules []string) {
+	if len(rules) == 0 {
+		return
+	}
+	for _, r := range rules {
+		q.base = normalizers[r](q.base)
+	}
+	q.cg = q.key()
+}
+
+// newQuery returns the query for q. The values of keys in h are forwarded to
+// the upstream; if any is set, their hash becomes part of the cache group.
+func newQuery(q string, h http.Header, keys []string) *query {
+	qr := &query{
+		q:      q,
+		base:   q,
+		header: make(http.Header),
+	}
+	hash := fnv.New64a()
+	for _, k := range keys {
+		k = http.CanonicalHeaderKey(k)
+		vals, ok := h[k]
+		if !ok {
+			continue
+		}
+		qr.header[k] = vals
+		fmt.Fprintf(hash, "%s:%q\n", k, vals)
+	}
+	if len(qr.header) > 0 {
+		qr.hash = fmt.Sprintf("%016x", hash.Sum64())
+	}
+	qr.cg = qr.key()
+	return qr
+}
+
+type entry struct {
+	deadline     time.Time
+	fetched      time.Time
+	originAge    time.Duration
+	data         []byte
+	size         int
+	gzipped      bool
+	normalized   []byte
+	etag         string
+	lastModified time.Time
+	originTag    string
+	ctype        string
+	code         int
+	tenant       string
+	file         string
+	// err is the error of the fetch, for a failed fetch cached for a while
+	err error
+	// accessed is when the entry was last cached or served
+	accessed time.Time
+	// ttl is the lifetime the entry was cached with
+	ttl time.Duration
+	// variants are the representations computed from data when requested
+	variants map[string]*variant
+	// shared is the body data belongs to, if deduplicated
+	shared *body
+}
+
+// newEntry returns the entry for page p, valid for d after it was fetched.
+func newEntry(p *page, d time.Duration) *entry {
+	now := time.Now()
+	fetched := p.fetched
+	if fetched.IsZero() {
+		fetched = now
+	}
 	return &entry{
-		deadline: time.Now().Add(d),
-		data:     data,
+		accessed:     now,
+		deadline:     fetched.Add(d),
+		ttl:          d,
+		fetched:      p.fetched,
+		originAge:    p.originAge,
+		data:         p.body,
+		size:         p.size,
+		gzipped:      p.gzipped,
+		normalized:   p.normalized,
+		etag:         p.etag,
+		lastModified: p.lastModified,
+		originTag:    p.originTag,
+		ctype:        p.ctype,
+		code:         p.code,
+		tenant:       p.tenant,
+		file:         p.file,
 	}
 }
 
+// unmodified reports whether p was last modified when the page of ce was.
+func (ce *entry) unmodified(p *page) bool {
+	return !p.lastModified.IsZero() && p.lastModified.Equal(ce.lastModified)
+}
+
 func (ce *entry) invalid(t time.Time) bool {
 	return !ce.deadline.After(t)
 }
 
+// slide extends the deadline of ce to its lifetime after t, but not past
+// max after it was fetched.
+func (ce *entry) slide(t time.Time, max time.Duration) {
+	d := t.Add(ce.ttl)
+	if limit := ce.fetched.Add(max); d.After(limit) {
+		d = limit
+	}
+	if d.After(ce.deadline) {
+		ce.deadline = d
+	}
+}
+
+// memSize is the memory used by the bodies of ce, without its variants.
+func (ce *entry) memSize() int64 {
+	return int64(len(ce.data) + len(ce.normalized))
+}
+
 func (ce *entry) asPage(n offset) *page {
 	p := newPage(n, ce.data)
 	p.expire = ce.deadline
+	p.fetched = ce.fetched
+	p.originAge = ce.originAge
+	p.size = ce.size
+	p.gzipped = ce.gzipped
+	p.normalized = ce.normalized
+	p.etag = ce.etag
+	p.lastModified = ce.lastModified
+	p.originTag = ce.originTag
+	p.ctype = ce.ctype
+	p.code = ce.code
+	p.tenant = ce.tenant
+	p.file = ce.file
 	return p
 }
 
+// entries are changed only by the event loop, holding mux, so that other
+// goroutines can read them holding it for reading.
 type entries struct {
+	mux  sync.RWMutex
 	ents map[group]map[offset]*entry
 }
 
@@ -82,6 +453,8 @@ func (e *entries) get(cg group, n offset) (*entry, bool) {
 }
 
 func (e *entries) put(cg group, n offset, ce *entry) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
 	_, ok := e.ents[cg]
 	if !ok {
 		e.ents[cg] = make(map[offset]*entry)
@@ -103,6 +476,8 @@ func (e *entries) has(cg group, n offset, t time.Time) bool {
 
 // remove assumes the entry exists
 func (e *entries) remove(cg group, n offset) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
 	delete(e.ents[cg], n)
 	if len(e.ents[cg]) == 0 {
 		delete(e.ents, cg)
@@ -110,16 +485,42 @@ func (e *entries) remove(cg group, n offset) {
 }
 
 func (e *entries) purge(cg group, st *stats) {
-	st.mem(-e.sizeof(cg))
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for n := range e.ents[cg] {
+		st.drop(e.ents[cg][n])
+		e.ents[cg][n].release()
+	}
 	delete(e.ents, cg)
 }
 
-func (e *entries) sizeof(cg group) int {
-	var s int
-	for n := range e.ents[cg] {
-		s += len(e.ents[cg][n].data)
+// update changes an entry that other goroutines might be reading.
+func (e *entries) update(f func()) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	f()
+}
+
+// lookup returns the page at n if valid at t, without the event loop.
+func (e *entries) lookup(cg group, n offset, t time.Time) (*page, bool) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	ce, ok := e.get(cg, n)
+	if !ok || ce.err != nil || ce.invalid(t) {
+		return nil, false
 	}
-	return s
+	return ce.asPage(n), true
+}
+
+// lastAccess returns when a page of cg was last cached or served.
+func (e *entries) lastAccess(cg group) time.Time {
+	var t time.Time
+	for _, ce := range e.ents[cg] {
+		if ce.accessed.After(t) {
+			t = ce.accessed
+		}
+	}
+	return t
 }
 
 func (e *entries) oldestDeadline(cg group) time.Time {
@@ -133,64 +534,427 @@ func (e *entries) oldestDeadline(cg group) time.Time {
 	return t
 }
 
-func (e *entries) gc(t time.Time, st *stats) {
+// groupDeadline returns the earliest deadline of the pages of cg valid at t,
+// if there are any.
+func (e *entries) groupDeadline(cg group, t time.Time) (time.Time, bool) {
+	var (
+		d  time.Time
+		ok bool
+	)
+	for _, ce := range e.ents[cg] {
+		if ce.err != nil || ce.invalid(t) {
+			continue
+		}
+		if !ok || ce.deadline.Before(d) {
+			d, ok = ce.deadline, true
+		}
+	}
+	return d, ok
+}
+
+// gc removes the entries invalid at t and returns the groups left empty.
+func (e *entries) gc(t time.Time, st *stats) []group {
+	var gone []group
 	for cg, ents := range e.ents {
 		for n := range ents {
 			if ents[n].invalid(t) {
-				st.mem(-len(ents[n].data))
+				st.drop(ents[n])
+				ents[n].release()
 				e.remove(cg, n)
 			}
 		}
+		if _, ok := e.ents[cg]; !ok {
+			gone = append(gone, cg)
+		}
 	}
+	return gone
 }
 
 type cacheFunc func() error
 
+// Reasons passed to the eviction hook.
+const (
+	evictExpired  = "expiry"
+	evictCapacity = "capacity"
+	evictManual   = "manual"
+)
+
+var (
+	errClosed   = errors.New("cache is closed")
+	errReadOnly = errors.New("page not cached and cache is read-only")
+	errUncached = errors.New("page not cached")
+	errTimeout  = errors.New("timeout waiting for the page")
+	errPanic    = errors.New("cache operation failed unexpectedly")
+	errUnstable = errors.New("page not cached after repeated fetches")
+	errGone     = errors.New("the client went away")
+	errOrphaned = errors.New("the fetch of the page did not end")
+	// errFetchRate is returned when the rate limit of fetches of the origin
+	// would delay the fetch of a page past the deadline of its client.
+	errFetchRate = errors.New("upstream rate limit exceeded")
+)
+
+// refused reports whether err is a fetch refused because of a rate limit.
+// It is returned to the clients as it is and never cached.
+func refused(err error) bool {
+	_, ok := err.(*rateLimitError)
+	return ok || err == errFetchRate || err == errBreakerOpen
+}
+
+// fetchError is returned to the clients waiting for a page whose fetch failed.
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
 type cache struct {
 	entries *entries
 	waits   *waiters
 	fetcher *fetcher
-	config  *config
-	stat    *stats
-	events  chan cacheFunc
-	debug   func(string, ...interface{})
+	// client sends all the requests of the cache to the upstream
+	client  doer
+	gate    *retryGate
+	batcher *batcher
+	// prefetchRate limits how often prefetches start, if not nil
+	prefetchRate *rateLimiter
+	config       *config
+	stat         *stats
+	metrics      *metrics
+	events       chan cacheFunc
+	done         chan struct{}
+	once         sync.Once
+	debug        func(string, ...interface{})
+	// refreshes holds until when no other background refresh can start for a group
+	refreshes map[group]time.Time
+	// fetched holds until when a group cannot be fetched again for a missing page
+	fetched map[group]time.Time
+	// reached is the furthest page requested for each group
+	reached map[group]int
+	// fetchRate limits how often upstream requests are sent, if not nil
+	fetchRate *rateLimiter
+	// forced holds until when no other forced refresh can start for a group
+	forced map[group]time.Time
+	// lastPages is the last page of results of each group, -1 if the
+	// upstream did not report it
+	lastPages map[group]int
+	// endpoints tracks the health of the upstreams, if there are fallbacks
+	endpoints *endpoints
+	// breaker stops fetching while the upstream is down, if not nil
+	breaker *breaker
+	// closing is held to close done and read to queue events, so that no
+	// event is queued after the queue is drained on Close
+	closing *sync.RWMutex
+	// shards split the groups among caches with their own goroutine; the
+	// cache is its own only shard unless configured otherwise
+	shards []*cache
+	// parent is the cache the shard belongs to
+	parent *cache
+	// bodies are the bodies shared by identical pages, if deduplicated
+	bodies *bodies
+	// fetching counts the fetches submitted and not finished, waited for
+	// on Close until drainWait; stopped then ends the ones left.
+	fetching    int64
+	stopped     context.Context
+	stopFetches context.CancelFunc
 }
 
 func newCache(f *fetcher, logs *logbuf, cf *config) *cache {
 	c := &cache{
-		fetcher: f,
-		config:  cf,
-		events:  make(chan cacheFunc),
-		entries: newEntries(),
-		waits:   newWaiters(),
-		stat:    newStats(),
-		debug:   logs.debug,
-	}
-	go c.gc(cf.gcpause)
-	go c.run()
+		fetcher:   f,
+		client:    cf.client,
+		gate:      newRetryGate(cf.retryJitter),
+		config:    cf,
+		events:    make(chan cacheFunc, cf.eventQueue),
+		done:      make(chan struct{}),
+		closing:   &sync.RWMutex{},
+		entries:   newEntries(),
+		waits:     newWaiters(),
+		stat:      newStats(),
+		metrics:   newMetrics(),
+		debug:     logs.debug,
+		refreshes: make(map[group]time.Time),
+		fetched:   make(map[group]time.Time),
+		reached:   make(map[group]int),
+		forced:    make(map[group]time.Time),
+		lastPages: make(map[group]int),
+	}
+	if c.client == nil {
+		c.client = newUpstreamClient(cf)
+	}
+	if len(cf.fallbacks) > 0 {
+		c.endpoints = newEndpoints(len(cf.fallbacks) + 1)
+	}
+	if cf.breakerFails > 0 {
+		c.breaker = newBreaker(cf.breakerFails, cf.breakerWindow, cf.breakerRetry)
+	}
+	if cf.prefetchRate > 0 {
+		c.prefetchRate = newRateLimiter(cf.prefetchRate, 1)
+	}
+	if cf.fetchRate > 0 {
+		c.fetchRate = newRateLimiter(cf.fetchRate, cf.fetchBurst)
+	}
+	if cf.batchURL != "" {
+		c.batcher = newBatcher(cf.batchURL, cf.batchMax, cf.batchWait)
+	}
+	if cf.dedup {
+		c.bodies = newBodies()
+	}
+	c.stopped, c.stopFetches = context.WithCancel(context.Background())
+	c.stat.gauge = &c.metrics.memory
+	c.parent = c
+	c.shards = []*cache{c}
+	if n := cf.shards; n > 1 {
+		c.shards = make([]*cache, n)
+		scf := cf.shard(n)
+		for i := range c.shards {
+			c.shards[i] = c.newShard(scf)
+		}
+	}
+	for _, s := range c.shards {
+		go s.gc(cf.gcpause)
+		go s.run()
+	}
+	if cf.cacheFile != "" {
+		c.restore(cf.cacheFile)
+	}
 	return c
 }
 
+// newShard returns a cache for part of the groups of c, sharing everything
+// else with it. It stops when c is closed.
+func (c *cache) newShard(cf *config) *cache {
+	s := &cache{
+		fetcher:      c.fetcher,
+		client:       c.client,
+		gate:         c.gate,
+		batcher:      c.batcher,
+		prefetchRate: c.prefetchRate,
+		fetchRate:    c.fetchRate,
+		endpoints:    c.endpoints,
+		breaker:      c.breaker,
+		config:       cf,
+		metrics:      c.metrics,
+		debug:        c.debug,
+		events:       make(chan cacheFunc, cf.eventQueue),
+		done:         c.done,
+		closing:      c.closing,
+		entries:      newEntries(),
+		waits:        newWaiters(),
+		stat:         newStats(),
+		refreshes:    make(map[group]time.Time),
+		fetched:      make(map[group]time.Time),
+		reached:      make(map[group]int),
+		forced:       make(map[group]time.Time),
+		lastPages:    make(map[group]int),
+		parent:       c,
+		bodies:       c.bodies,
+	}
+	s.stat.gauge = &c.metrics.memory
+	s.shards = []*cache{s}
+	return s
+}
+
+// shard returns the shard holding group cg.
+func (c *cache) shard(cg group) *cache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(cg))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
 func (c *cache) run() {
-	for f := range c.events {
-		if err := f(); err != nil {
-			log.Print("cache: ", err)
+	var groups int
+	for {
+		select {
+		case f := <-c.events:
+			if err := c.exec(f); err != nil {
+				slog.Error("cache event failed", "err", err)
+			}
+			n := len(c.entries.ents)
+			c.metrics.addGroups(n - groups)
+			groups = n
+		case <-c.done:
+			c.drain()
+			return
+		}
+	}
+}
+
+// drain runs the events queued before the cache was closed, whose senders
+// may wait for them.
+func (c *cache) drain() {
+	for {
+		select {
+		case f := <-c.events:
+			if err := c.exec(f); err != nil {
+				slog.Error("cache event failed", "err", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// exec runs f, returning errPanic if it panics instead of stopping the
+// cache goroutine.
+func (c *cache) exec(f cacheFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("cache event panicked", "panic", r, "stack", string(debug.Stack()))
+			atomic.AddUint64(&c.metrics.eventsPanicked, 1)
+			err = errPanic
+		}
+	}()
+	return f()
+}
+
+// call runs f in the cache goroutine and waits for it, returning its error.
+func (c *cache) call(f cacheFunc) error {
+	res := make(chan error, 1)
+	err := c.send(func() error {
+		// The error goes to the caller, not to the log
+		res <- c.exec(f)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return <-res
+}
+
+// send submits f to the cache goroutine. It returns errClosed instead
+// of blocking forever if the cache has been closed. If the queue of
+// events is full, it waits for the goroutine to catch up.
+func (c *cache) send(f cacheFunc) error {
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+	if cap(c.events) > 0 && len(c.events) == cap(c.events) {
+		atomic.AddUint64(&c.metrics.eventsBlocked, 1)
+	}
+	select {
+	case c.events <- f:
+		return nil
+	case <-c.done:
+		return errClosed
+	}
+}
+
+// Close stops the cache goroutines. Pending and future operations fail with errClosed.
+func (c *cache) Close() error {
+	var err error
+	c.once.Do(func() {
+		// The pages being fetched are still cached and saved
+		c.finishFetches(c.config.drainWait)
+		if c.config.cacheFile != "" {
+			err = c.save(c.config.cacheFile)
+		}
+		if c.config.diskDir != "" {
+			for _, s := range c.shards {
+				s.call(func() error {
+					s.entries.removeFiles()
+					return nil
+				})
+			}
+		}
+		c.closing.Lock()
+		close(c.done)
+		c.closing.Unlock()
+		if c.config.onClose != nil {
+			c.config.onClose()
+		}
+		if cl, ok := c.client.(interface{ CloseIdleConnections() }); ok {
+			cl.CloseIdleConnections()
 		}
+	})
+	return err
+}
+
+// finishFetches waits up to d for the fetches in flight to finish, then cancels the
+// ones left.
+func (c *cache) finishFetches(d time.Duration) {
+	deadline := time.Now().Add(d)
+	for atomic.LoadInt64(&c.fetching) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&c.fetching); n > 0 {
+		slog.Warn("canceling fetches in flight", "fetches", n)
+	}
+	c.stopFetches()
+}
+
+// evicted notifies the eviction hook, if any, that group cg was removed.
+// The hook runs in its own goroutine to not block the cache.
+func (c *cache) evicted(cg group, reason string) {
+	c.debug("evicted %s: %s", cg, reason)
+	c.stat.Evictions++
+	c.metrics.evicted(reason)
+	if c.config.onEvict != nil {
+		go c.config.onEvict(cg, reason)
 	}
 }
 
 func (c *cache) gc(d time.Duration) {
 	done := make(chan struct{})
 	for {
-		time.Sleep(d)
-		c.events <- func() error {
-			if c.stat.Mem > 0 {
+		select {
+		case <-time.After(d):
+		case <-c.done:
+			return
+		}
+		err := c.send(func() error {
+			now := time.Now()
+			// Failed fetches are cached without using memory
+			if len(c.entries.ents) > 0 {
 				c.debug("running garbage collector cycle, memory is %d", c.stat.Mem)
-				c.entries.gc(time.Now(), c.stat)
+				// Expired entries are kept while they can still be served stale
+				for _, cg := range c.entries.gc(now.Add(-c.config.retention()), c.stat) {
+					c.evicted(cg, evictExpired)
+				}
 				c.debug("garbage collection done, memory is %d", c.stat.Mem)
 			}
+			for cg, t := range c.refreshes {
+				if !t.After(now) {
+					delete(c.refreshes, cg)
+				}
+			}
+			for cg, t := range c.fetched {
+				if !t.After(now) {
+					delete(c.fetched, cg)
+				}
+			}
+			for cg, t := range c.forced {
+				if !t.After(now) {
+					delete(c.forced, cg)
+				}
+			}
+			for cg := range c.reached {
+				if _, ok := c.entries.ents[cg]; !ok {
+					delete(c.reached, cg)
+				}
+			}
+			for cg := range c.lastPages {
+				if _, ok := c.entries.ents[cg]; !ok {
+					delete(c.lastPages, cg)
+				}
+			}
 			done <- struct{}{}
 			return nil
+		})
+		if err != nil {
+			return
 		}
 		<-done
 	}
@@ -211,15 +975,27 @@ func (a byTime) Len() int           { return len(a) }
 func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byTime) Less(i, j int) bool { return a[i].t.After(a[j].t) }
 
-func makeTimeGroups(e *entries) timeGroups {
-	var i int
-	tg := make([]timeGroup, len(e.ents))
+// makeTimeGroups sorts the groups of e for which keep is true, or all if keep is nil.
+func makeTimeGroups(e *entries, keep func(group) bool) timeGroups {
+	tg := make([]timeGroup, 0, len(e.ents))
 	for cg := range e.ents {
-		tg[i] = timeGroup{
+		if keep != nil && !keep(cg) {
+			continue
+		}
+		tg = append(tg, timeGroup{
 			t:  e.oldestDeadline(cg),
 			cg: cg,
-		}
-		i++
+		})
+	}
+	sort.Sort(byTime(tg))
+	return timeGroups{tg}
+}
+
+// makeAccessGroups sorts the groups of e by their last access.
+func makeAccessGroups(e *entries) timeGroups {
+	tg := make([]timeGroup, 0, len(e.ents))
+	for cg := range e.ents {
+		tg = append(tg, timeGroup{t: e.lastAccess(cg), cg: cg})
 	}
 	sort.Sort(byTime(tg))
 	return timeGroups{tg}
@@ -228,6 +1004,7 @@ func makeTimeGroups(e *entries) timeGroups {
 func (tg *timeGroups) purgeOldest(c *cache) {
 	entry, ts := tg.entries[len(tg.entries)-1], tg.entries[0:len(tg.entries)-1]
 	c.entries.purge(entry.cg, c.stat)
+	c.evicted(entry.cg, evictCapacity)
 	tg.entries = ts
 }
 
@@ -235,9 +1012,73 @@ func (tg *timeGroups) empty() bool {
 	return len(tg.entries) == 0
 }
 
+// purge removes all the pages of group cg and wakes up the clients waiting
+// for them, which fetch them again. It reports whether the group was cached.
+func (c *cache) purge(cg group) (bool, error) {
+	if s := c.shard(cg); s != c {
+		return s.purge(cg)
+	}
+	var found bool
+	err := c.call(func() error {
+		if _, found = c.entries.ents[cg]; found {
+			c.entries.purge(cg, c.stat)
+			c.evicted(cg, evictManual)
+		}
+		c.waits.clear(cg)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// variantOf reports whether cg is the group of query group base or of one
+// of its variants, by tenant, forwarded headers, parameters or mode.
+func variantOf(cg, base group) bool {
+	k := string(cg)
+	if i := strings.IndexByte(k, '@'); i >= 0 {
+		k = k[i+1:]
+	}
+	if i := strings.IndexAny(k, "#?!"); i >= 0 {
+		k = k[:i]
+	}
+	return k == string(base)
+}
+
+// purgeVariants is like purge for group base and all its variants. It
+// returns how many groups were cached.
+func (c *cache) purgeVariants(base group) (int, error) {
+	var found int
+	for _, s := range c.shards {
+		err := s.call(func() error {
+			for cg := range s.entries.ents {
+				if variantOf(cg, base) {
+					s.entries.purge(cg, s.stat)
+					s.evicted(cg, evictManual)
+					found++
+				}
+			}
+			for cg := range s.waits.waits {
+				if variantOf(cg, base) {
+					s.waits.clear(cg)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
 func (c *cache) oom(target int64) {
+	if target <= 0 {
+		return
+	}
 	c.debug("OOM called: using %d, limit is %d", c.stat.Mem, target)
-	tg := makeTimeGroups(c.entries)
+	tg := makeTimeGroups(c.entries, nil)
 	for {
 		tg.purgeOldest(c)
 		// Repeat unless we have no more entries or we are using less memory than target
@@ -248,117 +1089,692 @@ func (c *cache) oom(target int64) {
 	c.debug("OOM: mem now %d", c.stat.Mem)
 }
 
+// makeRoom evicts the least recently used groups until size more bytes
+// fit in max, if positive.
+func (c *cache) makeRoom(size, max int64) {
+	if max <= 0 || c.stat.Mem+size <= max {
+		return
+	}
+	tg := makeAccessGroups(c.entries)
+	for !tg.empty() && c.stat.Mem+size > max {
+		tg.purgeOldest(c)
+	}
+	c.debug("made room for %d bytes: mem now %d", size, c.stat.Mem)
+}
+
+// add caches ce as page n of cg, replacing the page cached before if any,
+// and evicts other pages to keep the cache within its limits.
+func (c *cache) add(cg group, n offset, ce *entry) {
+	if ent, ok := c.entries.get(cg, n); ok {
+		c.stat.drop(ent)
+		ent.release()
+		c.entries.remove(cg, n)
+	}
+	c.makeRoom(ce.memSize(), c.config.maxMemory)
+	ce.share(c.bodies)
+	c.entries.put(cg, n, ce)
+	c.stat.store(ce)
+	if ce.tenant != "" && c.stat.tenantAbove(ce.tenant, c.config.tenantEntries, c.config.tenantMemory) {
+		c.tenantOOM(ce.tenant, cg)
+	}
+	if max := c.config.maxGroups; max > 0 && len(c.entries.ents) > max {
+		tg := makeAccessGroups(c.entries)
+		for len(c.entries.ents) > max {
+			tg.purgeOldest(c)
+		}
+	}
+}
+
+// abandon wakes up the waiters of page n of cg without caching anything:
+// its fetch stopped because the client that requested it went away. The
+// waiters still there fetch it again.
+func (c *cache) abandon(cg group, n offset) {
+	c.send(func() error {
+		c.waits.done(cg, n, nil)
+		return nil
+	})
+}
+
 // put inserts a page into the cache (after it was fetched).
 func (c *cache) put(cg group, p *page, err error) {
-	c.events <- func() error {
-		ce := newEntry(p.body, c.config.lifetime)
-		// If an entry exists, it will be overwritten
-		if ent, ok := c.entries.get(cg, p.n); ok {
-			c.stat.mem(-len(ent.data))
-		}
-		c.entries.put(cg, p.n, ce)
-		c.stat.mem(len(p.body))
-		c.debug("added page %s/%d", cg, p.n)
-		if c.stat.above(c.config.maxMemory) {
-			go func() {
-				c.events <- func() error {
-					c.oom(c.config.maxMemory)
-					return nil
+	serr := c.send(func() error {
+		if err != nil {
+			// A stale entry is kept, otherwise the error is cached for a while
+			if ent, ok := c.entries.get(cg, p.n); (!ok || ent.err != nil) && c.config.negativeTTL > 0 && !refused(err) {
+				c.entries.put(cg, p.n, &entry{deadline: time.Now().Add(c.config.negativeTTL), err: err})
+			}
+			c.waits.done(cg, p.n, err)
+			return err
+		}
+		if p.notModified {
+			// Without the entry, the clients waiting fetch the page again
+			if ent, ok := c.entries.get(cg, p.n); ok && ent.err == nil {
+				c.entries.update(func() {
+					ent.ttl = c.config.pageTTL(p)
+					ent.deadline, ent.fetched, ent.originAge = p.fetched.Add(ent.ttl), p.fetched, p.originAge
+				})
+				c.debug("revalidated page %s/%d", cg, p.n)
+			}
+			c.waits.done(cg, p.n, nil)
+			return nil
+		}
+		if p.pages > 0 {
+			c.lastPages[cg] = p.pages - 1
+		} else if c.config.totals != nil {
+			c.lastPages[cg] = -1
+		}
+		if p.noStore {
+			c.debug("not caching page %s/%d", cg, p.n)
+			c.waits.pass(cg, p.n, p)
+			return nil
+		}
+		ce := newEntry(p, c.config.pageTTL(p))
+		if ce.invalid(ce.accessed.Add(-c.config.retention())) {
+			// Expired while waiting to be added, maybe after the garbage
+			// collector purged its group: it would come back to life
+			c.debug("page %s/%d expired before being cached", cg, p.n)
+			if p.file != "" {
+				lp, err := p.load()
+				if err != nil {
+					c.waits.done(cg, p.n, err)
+					return err
 				}
-			}()
+				p = lp
+			}
+			c.waits.pass(cg, p.n, p)
+			return nil
+		}
+		if c.config.groupExpiry {
+			// The page expires with the ones already cached for the group
+			if d, ok := c.entries.groupDeadline(cg, ce.accessed); ok && d.Before(ce.deadline) {
+				ce.deadline = d
+			}
+		}
+		if max := c.config.maxMemory; max > 0 && ce.memSize() > max {
+			// Not even an empty cache could hold it: the page cached
+			// before, if any, is outdated
+			c.debug("page %s/%d too large to cache: %d bytes", cg, p.n, ce.memSize())
+			atomic.AddUint64(&c.metrics.tooLarge, 1)
+			if ent, ok := c.entries.get(cg, p.n); ok {
+				c.stat.drop(ent)
+				ent.release()
+				c.entries.remove(cg, p.n)
+			}
+			c.waits.pass(cg, p.n, p)
+			return nil
+		}
+		if ent, ok := c.entries.get(cg, p.n); ok && c.config.reuseModified && ent.unmodified(p) {
+			// Keep the stored body, only the validity changes
+			c.entries.update(func() {
+				ent.deadline, ent.fetched, ent.originAge = ce.deadline, ce.fetched, ce.originAge
+			})
+			ce.release()
+			c.debug("revalidated page %s/%d", cg, p.n)
+			c.waits.done(cg, p.n, nil)
+			return nil
+		}
+		c.add(cg, p.n, ce)
+		c.debug("added page %s/%d", cg, p.n)
+		if c.config.onFill != nil {
+			c.config.onFill(cg, p.n)
 		}
 		// If there were waiters, signal that the wait is over
-		c.waits.done(cg, p.n)
-		return err
+		c.waits.done(cg, p.n, nil)
+		return nil
+	})
+	if serr != nil {
+		c.debug("dropped page %s/%d: %s", cg, p.n, serr)
+	}
+}
+
+// pages returns the pages to fetch when page n is requested: n itself followed
+// by the prefetch window [n-depth, n+depth) without n and, if max is positive,
+// without pages past max.
+func pages(n, depth, max int) []int {
+	return around(n, depth, depth-1, max)
+}
+
+// around is like pages for the window of behind pages before n and ahead
+// pages after it.
+func around(n, behind, ahead, max int) []int {
+	ps := []int{n}
+	lo, hi := n-behind, n+ahead+1
+	if lo < 0 {
+		lo = 0
+	}
+	if max > 0 && hi > max+1 {
+		hi = max + 1
+	}
+	for i := lo; i < hi; i++ {
+		if i != n {
+			ps = append(ps, i)
+		}
 	}
+	return ps
 }
 
-// prefetch requests pages (n-m, n) and (n, n+m) if not already fetched
-func (c *cache) prefetch(cg group, n, m int, t time.Time) {
-	i := n - m
-	if i < 0 {
-		i = 0
+// fetch requests the page at off from the upstream, unless it is already
+// being fetched. The returned waiter is closed when the fetch ends.
+func (c *cache) fetch(q *query, off offset) *waiter {
+	if c.waits.has(q.cg, off) {
+		return c.waits.wait(q.cg, off)
+	}
+	wait := c.wait(q.cg, off)
+	if q.ctx != nil {
+		// Canceled when all the clients waiting for the page went away
+		ctx, cancel := context.WithCancel(context.Background())
+		wait.cancel = cancel
+		fq := *q
+		fq.ctx = ctx
+		q = &fq
+	}
+	res := newResource(c.config.template(q.mode), q, off)
+	if ce, ok := c.entries.get(q.cg, off); ok && ce.err == nil && c.config.revalidate {
+		res.etag, res.modified = ce.originTag, ce.lastModified
 	}
-	for ; i < n+m; i++ {
-		if i == n {
-			// just fetched
+	c.submit(newJob(res, c))
+	return wait
+}
+
+// wait registers a new waiter for page off of cg. If its fetch does not
+// end within waitTimeout, the waiter is woken up with an error anyway.
+func (c *cache) wait(cg group, off offset) *waiter {
+	wt := c.waits.wait(cg, off)
+	if d := c.config.waitTimeout; d > 0 {
+		time.AfterFunc(d, func() {
+			c.send(func() error {
+				if c.waits.expire(cg, off, wt, errOrphaned) {
+					c.debug("%s/%d: fetch did not end in %s", cg, off, d)
+				}
+				return nil
+			})
+		})
+	}
+	return wt
+}
+
+// fetchLater is like fetch, but the fetch starts when allowed by the prefetch rate.
+func (c *cache) fetchLater(q *query, off offset) {
+	if c.prefetchRate == nil {
+		c.fetch(q, off)
+		return
+	}
+	if c.waits.has(q.cg, off) {
+		return
+	}
+	c.wait(q.cg, off)
+	j := newJob(newResource(c.config.template(q.mode), q, off), c)
+	if d := c.prefetchRate.reserve(); d > 0 {
+		time.AfterFunc(d, func() { c.submit(j) })
+		return
+	}
+	c.submit(j)
+}
+
+func (c *cache) submit(j *job) {
+	atomic.AddInt64(&c.parent.fetching, 1)
+	if c.batcher != nil && len(j.res.header) == 0 && j.res.mode == "" {
+		// Forwarded headers could differ inside a batch, and the batch
+		// endpoint only serves the primary mode
+		c.batcher.add(j)
+		return
+	}
+	c.fetcher.request(j)
+}
+
+// prefetch requests the pages around n if not already fetched
+func (c *cache) prefetch(q *query, n int, t time.Time) {
+	if c.config.readOnly || q.single || !c.config.prefetches(q.q) {
+		return
+	}
+	depth := c.config.prefetchDepth(c.config.clock())
+	q = q.background()
+	behind, ahead := c.config.prefetchWindow(depth)
+	for _, i := range around(n, behind, ahead, c.config.maxPage)[1:] {
+		if c.beyondLast(q.cg, i) {
 			continue
 		}
 		off := offset(i * c.config.incr)
-		if c.entries.has(cg, off, t) || c.waits.has(cg, off) {
-			// already fetched or requested
+		if c.entries.has(q.cg, off, t) {
+			// already fetched
 			continue
 		}
-		c.waits.wait(cg, off)
-		res := newResource(c.config.tmpl, cg, off)
-		c.fetcher.request(newJob(res, c))
+		c.fetchLater(q, off)
 	}
 }
 
-func (c *cache) request(cg group, n int, t time.Time) chan struct{} {
-	off := offset(n * c.config.incr)
-	wait := c.waits.wait(cg, off)
-	res := newResource(c.config.tmpl, cg, off)
-	c.fetcher.request(newJob(res, c))
-	c.prefetch(cg, n, c.config.npref, t)
+// beyondLast reports whether page i is past the last page of results of cg
+// reported by the upstream.
+func (c *cache) beyondLast(cg group, i int) bool {
+	last, ok := c.lastPages[cg]
+	return ok && last >= 0 && i > last
+}
+
+// lookahead fetches the pages following n when n is the furthest page
+// requested so far for its group.
+func (c *cache) lookahead(q *query, n int, t time.Time) {
+	if c.config.lookahead <= 0 || c.config.readOnly || q.peek || q.single || !c.config.prefetches(q.q) {
+		return
+	}
+	if max, ok := c.reached[q.cg]; ok && n <= max {
+		return
+	}
+	c.reached[q.cg] = n
+	q = q.background()
+	for i := n + 1; i <= n+c.config.lookahead; i++ {
+		if (c.config.maxPage > 0 && i > c.config.maxPage) || c.beyondLast(q.cg, i) {
+			break
+		}
+		off := offset(i * c.config.incr)
+		if !c.entries.has(q.cg, off, t) {
+			c.fetchLater(q, off)
+		}
+	}
+}
+
+// revalidate refreshes page n in the background, at most once per stale window
+// for each group and only for the configured fraction of calls.
+func (c *cache) revalidate(q *query, n int, t time.Time) {
+	if c.config.readOnly {
+		// Refreshed pages can only come from an import
+		return
+	}
+	if until, ok := c.refreshes[q.cg]; ok && t.Before(until) {
+		return
+	}
+	if p := c.config.refreshProb; p < 1 && rand.Float64() >= p {
+		return
+	}
+	c.debug("%s/%d: stale, refreshing in background", q.cg, n)
+	c.refreshes[q.cg] = t.Add(c.config.stale)
+	// Served stale, the client does not wait for the refresh
+	c.request(q.background(), n, t)
+}
+
+// throttle returns how long until group cg can be fetched again for the
+// missing page off, or zero if it can be fetched now. Waiting for a page
+// already being fetched is never throttled.
+func (c *cache) throttle(cg group, off offset, t time.Time) time.Duration {
+	d := c.config.minFetchInterval
+	if d <= 0 || c.waits.has(cg, off) {
+		return 0
+	}
+	if until, ok := c.fetched[cg]; ok && t.Before(until) {
+		return until.Sub(t)
+	}
+	c.fetched[cg] = t.Add(d)
+	return 0
+}
+
+// forceRefresh reports whether a cached page of group cg can be fetched
+// again for a client asking for it, at most once each refreshEvery.
+func (c *cache) forceRefresh(cg group, t time.Time) bool {
+	d := c.config.refreshEvery
+	if d <= 0 || c.config.readOnly {
+		return false
+	}
+	if until, ok := c.forced[cg]; ok && t.Before(until) {
+		return false
+	}
+	c.forced[cg] = t.Add(d)
+	return true
+}
+
+// request fetches page n and prefetches the pages around it.
+func (c *cache) request(q *query, n int, t time.Time) *waiter {
+	if c.config.readOnly {
+		// Wait for the page to be imported from the instance that fetches it
+		return c.wait(q.cg, offset(n*c.config.incr))
+	}
+	wait := c.fetch(q, offset(n*c.config.incr))
+	if _, ok := c.lastPages[q.cg]; ok || c.config.totals == nil {
+		// Otherwise prefetched when the page tells how many there are
+		c.prefetch(q, n, t)
+	}
 	return wait
 }
 
-func (c *cache) stats() *stats {
+// groupContents describes the pages cached for a group.
+type groupContents struct {
+	Origin   string    `json:"origin"`
+	Group    string    `json:"group"`
+	Deadline time.Time `json:"deadline"`
+	Pages    []int     `json:"pages"`
+	Bytes    int       `json:"bytes"`
+}
+
+// contents returns up to limit cached groups sorted by name, starting after
+// group after, and whether there are more.
+func (c *cache) contents(after group, limit int) ([]*groupContents, bool, error) {
+	var (
+		list []*groupContents
+		more bool
+	)
+	for _, s := range c.shards {
+		l, m, err := s.listGroups(after, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		list = append(list, l...)
+		more = more || m
+	}
+	if len(c.shards) > 1 {
+		sort.Slice(list, func(i, j int) bool { return list[i].Group < list[j].Group })
+		if len(list) > limit {
+			list, more = list[:limit], true
+		}
+	}
+	return list, more, nil
+}
+
+// listGroups is like contents for the groups of shard c.
+func (c *cache) listGroups(after group, limit int) ([]*groupContents, bool, error) {
+	var (
+		list []*groupContents
+		more bool
+	)
+	err := c.call(func() error {
+		var cgs []group
+		for cg := range c.entries.ents {
+			if cg > after {
+				cgs = append(cgs, cg)
+			}
+		}
+		sort.Slice(cgs, func(i, j int) bool { return cgs[i] < cgs[j] })
+		if len(cgs) > limit {
+			cgs, more = cgs[:limit], true
+		}
+		for _, cg := range cgs {
+			gc := &groupContents{Group: string(cg), Pages: []int{}}
+			for off, ce := range c.entries.ents[cg] {
+				if ce.err != nil {
+					continue
+				}
+				if ce.deadline.After(gc.Deadline) {
+					gc.Deadline = ce.deadline
+				}
+				gc.Pages = append(gc.Pages, int(off)/c.config.incr)
+				gc.Bytes += ce.size
+			}
+			sort.Ints(gc.Pages)
+			list = append(list, gc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return list, more, nil
+}
+
+func (c *cache) stats() (*stats, error) {
+	st := newStats()
+	for _, s := range c.shards {
+		sst, err := s.shardStats()
+		if err != nil {
+			return nil, err
+		}
+		st.add(sst)
+	}
+	st.Fetching = c.fetcher.groups(c)
+	st.Hits, st.Misses, st.HitRatio = c.metrics.ratio()
+	st.MaxMem = c.config.maxMemory
+	if c.bodies != nil {
+		st.SharedBodies, st.Deduped = c.bodies.savings()
+	}
+	if c.breaker != nil {
+		st.Breaker = c.breaker.state(time.Now())
+	}
+	return st, nil
+}
+
+func (c *cache) shardStats() (*stats, error) {
 	var st *stats
-	wait := make(chan struct{})
-	c.events <- func() error {
+	err := c.call(func() error {
 		c.stat.Entries = c.entries.count()
 		c.stat.Waiters = c.waits.count()
 		st = c.stat.clone()
-		wait <- struct{}{}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	<-wait
-	return st
+	return st, nil
 }
 
-func (c *cache) get(cg group, n int) *page {
+// getAttempts is how many times get looks up a page, waiting for it to be
+// fetched between lookups, before giving up.
+const getAttempts = 5
+
+func (c *cache) get(q *query, n int) (*page, error) {
+	if s := c.shard(q.cg); s != c {
+		return s.get(q, n)
+	}
 	var (
-		page *page
-		wait chan struct{}
+		stale *page
+		page  *page
+		wait  *waiter
+		ferr  error
 	)
+	cg := q.cg
+	debug := tagged(c.debug, q.id)
+	start := time.Now()
 	cached := true
-	requested := make(chan struct{})
+	coalesced := false
+	refresh := q.refresh
 	off := offset(n * c.config.incr)
-	c.debug("%s/%d: requesting from cache", cg, off)
-	for {
+	debug("%s/%d: requesting from cache", cg, off)
+	if c.config.synthetic != nil && !c.config.syntheticCache {
+		return c.config.synthesize(q.q, off)
+	}
+	if !refresh && !c.config.sliding {
+		// Hits don't wait for the event loop, which only takes note of them
+		if page, ok := c.entries.lookup(cg, off, start); ok {
+			debug("%s/%d: found", cg, off)
+			c.send(func() error {
+				if ce, ok := c.entries.get(cg, off); ok && start.After(ce.accessed) {
+					ce.accessed = start
+				}
+				c.prefetch(q, n, start)
+				c.lookahead(q, n, start)
+				c.stat.hit(cached)
+				return nil
+			})
+			page.cached = cached
+			c.metrics.hit(cached)
+			return page, nil
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt == getAttempts {
+			// Fetched each time, but never found cached
+			debug("%s/%d: not cached after %d fetches", cg, off, attempt)
+			return nil, errUnstable
+		}
 		wait = nil
-		c.events <- func() error {
-			defer func() { requested <- struct{}{} }()
-			if c.waits.has(cg, off) {
-				c.waits.wait(cg, off)
-			}
+		err := c.call(func() error {
+			defer func() {
+				if wait != nil {
+					wait.clients++
+				}
+			}()
+			defer c.lookahead(q, n, time.Now())
 			var now time.Time
 			ce, ok := c.entries.get(cg, off)
 			if ok {
 				now = time.Now()
 			}
+			if ok && refresh {
+				// Only the first lookup, the next ones find the fetched page
+				refresh = false
+				if c.forceRefresh(cg, now) {
+					if d := c.throttle(cg, off, now); d > 0 {
+						debug("%s/%d: refresh throttled for %s", cg, off, d)
+					} else {
+						debug("%s/%d: refresh requested", cg, off)
+						wait = c.request(q, n, now)
+						return nil
+					}
+				}
+			}
+			if ok && ce.err != nil && !ce.invalid(now) {
+				debug("%s/%d: found failed fetch", cg, off)
+				c.stat.hit(cached)
+				ferr = &fetchError{ce.err}
+				return nil
+			}
+			if ok && ce.err == nil && ce.invalid(now) && !ce.invalid(now.Add(-c.config.stale)) {
+				debug("%s/%d: found stale", cg, off)
+				ce.accessed = now
+				c.revalidate(q, n, now)
+				c.stat.hit(cached)
+				page = ce.asPage(off)
+				page.status = "STALE"
+				return nil
+			}
 			if !ok || ce.invalid(now) {
-				c.debug("%s/%d: not cached, requested", cg, off)
-				wait = c.request(cg, n, now)
+				if ok && ce.err == nil {
+					stale = ce.asPage(off)
+				}
+				if q.peek {
+					ferr = errUncached
+					return nil
+				}
+				if c.config.readOnly && c.config.replicaWait <= 0 {
+					ferr = errReadOnly
+					return nil
+				}
+				if c.config.coalesce && c.waits.has(cg, off) {
+					// Already fetched with the pages of an earlier request
+					debug("%s/%d: not cached, coalesced", cg, off)
+					coalesced = true
+					wait = c.waits.wait(cg, off)
+					return nil
+				}
+				if d := c.throttle(cg, off, time.Now()); d > 0 {
+					if stale != nil {
+						debug("%s/%d: fetch throttled, serving stale", cg, off)
+						c.stat.hit(cached)
+						page = stale
+						page.status = "STALE-THROTTLED"
+						return nil
+					}
+					ferr = &rateLimitError{d}
+					return nil
+				}
+				if c.breaker != nil && c.breaker.rejects(time.Now()) {
+					if stale != nil {
+						debug("%s/%d: upstream down, serving stale", cg, off)
+						c.stat.hit(cached)
+						page = stale
+						page.status = "STALE-BREAKER"
+						return nil
+					}
+					atomic.AddUint64(&c.metrics.breakerRejects, 1)
+					ferr = errBreakerOpen
+					return nil
+				}
+				debug("%s/%d: not cached, requested", cg, off)
+				wait = c.request(q, n, now)
 				return nil
 			}
-			c.debug("%s/%d: found", cg, off)
-			c.prefetch(cg, n, c.config.npref, now)
+			debug("%s/%d: found", cg, off)
+			ce.accessed = now
+			if c.config.sliding {
+				c.entries.update(func() {
+					ce.slide(now, c.config.slidingMax)
+				})
+			}
+			if !coalesced {
+				c.prefetch(q, n, now)
+			}
 			c.stat.hit(cached)
 			page = ce.asPage(off)
 			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ferr != nil {
+			return nil, ferr
 		}
-		<-requested
 		// content was already in cache, return it
 		if wait == nil {
 			page.cached = cached
-			return page
+			c.metrics.hit(cached)
+			return page, nil
 		}
 		// We needed to request the object, it was not cached
 		cached = false
 		// content is being fetched, wait and try to get again
-		<-wait
+		var sla <-chan time.Time
+		if stale != nil && c.config.sla > 0 {
+			sla = time.After(c.config.sla - time.Since(start))
+		}
+		var replica <-chan time.Time
+		if c.config.readOnly {
+			replica = time.After(c.config.replicaWait - time.Since(start))
+		}
+		var timeout <-chan time.Time
+		if !q.deadline.IsZero() {
+			timeout = time.After(time.Until(q.deadline))
+		}
+		var gone <-chan struct{}
+		if q.ctx != nil {
+			gone = q.ctx.Done()
+		}
+		select {
+		case <-gone:
+			// The fetch is abandoned if no other client waits for it
+			c.send(func() error {
+				c.waits.leave(cg, off, wait)
+				return nil
+			})
+			return nil, q.ctx.Err()
+		case <-wait.ch:
+			if wait.err == errBreakerOpen && stale != nil {
+				stale.status = "STALE-BREAKER"
+				return stale, nil
+			}
+			if refused(wait.err) {
+				return nil, wait.err
+			}
+			if wait.err != nil && stale != nil && time.Now().Before(stale.expire.Add(c.config.staleIfError)) {
+				slog.Warn("fetch failed, serving stale", "group", string(cg), "offset", off, "request", q.id, "err", wait.err)
+				stale.status = "STALE-ERROR"
+				return stale, nil
+			}
+			if wait.err != nil {
+				return nil, &fetchError{wait.err}
+			}
+			if wait.page != nil {
+				// Not cached, served only to the clients waiting for it
+				p := *wait.page
+				return &p, nil
+			}
+		case <-wait.streamed:
+			// Sent to the client while it is fetched
+			c.metrics.hit(false)
+			p := newPage(off, nil)
+			p.stream = wait.stream
+			return p, nil
+		case <-timeout:
+			// The fetch continues for the other waiters, if any
+			return nil, errTimeout
+		case <-sla:
+			// The fetch continues in the background and will populate the cache
+			debug("%s/%d: fetch exceeds SLA, serving stale", cg, off)
+			stale.status = "STALE-SLA"
+			return stale, nil
+		case <-replica:
+			// Wake up the other readers of the page, they will wait again if they have time left
+			c.send(func() error {
+				c.waits.done(cg, off, nil)
+				return nil
+			})
+			return nil, errReadOnly
+		case <-c.done:
+			return nil, errClosed
+		}
 	}
 }
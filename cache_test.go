@@ -0,0 +1,1459 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseConcurrentEvents(t *testing.T) {
+	block := make(chan struct{})
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	defer close(block)
+	o, _ := newTestOrigin(t, u, nil)
+	c := o.cache
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.get(newQuery(fmt.Sprintf("q%d", i), nil, nil), i)
+			errs <- err
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := c.stats()
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cache operations blocked after Close")
+	}
+	close(errs)
+	for err := range errs {
+		if err != errClosed {
+			t.Errorf("expected errClosed, got %v", err)
+		}
+	}
+	if _, err := c.get(newQuery("after", nil, nil), 0); err != errClosed {
+		t.Errorf("get after Close: expected errClosed, got %v", err)
+	}
+	c.put("after", newPage(0, nil), nil)
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	f := newFetcher(1, 1)
+	before := runtime.NumGoroutine()
+	cf := newConfig("", 10)
+	cf.gcpause = time.Hour
+	c := newCache(f, newLogbuf(10, false), cf)
+	if n := runtime.NumGoroutine(); n < before+2 {
+		t.Fatalf("expected the gc and event goroutines to run, got %d more goroutines", n-before)
+	}
+	c.Close()
+	// Without waiting for the next gc run
+	eventually(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestPageAge(t *testing.T) {
+	now := time.Now()
+	p := newPage(0, nil)
+	p.fetched = now.Add(-30 * time.Second)
+	p.originAge = 100 * time.Second
+	if a := p.age(now); a != 130*time.Second {
+		t.Errorf("expected an age of 130s, got %s", a)
+	}
+	p.fetched = time.Time{}
+	if a := p.age(now); a != 100*time.Second {
+		t.Errorf("without fetch time expected the upstream age, got %s", a)
+	}
+}
+
+func TestPages(t *testing.T) {
+	tests := []struct {
+		n, depth, max int
+		pages         []int
+	}{
+		{0, 0, 0, []int{0}},
+		{3, 0, 0, []int{3}},
+		{0, 2, 0, []int{0, 1}},
+		{3, 2, 0, []int{3, 1, 2, 4}},
+		{1, 3, 0, []int{1, 0, 2, 3}},
+		{3, 2, 3, []int{3, 1, 2}},
+		{5, 2, 3, []int{5, 3}},
+	}
+	for _, tt := range tests {
+		if ps := pages(tt.n, tt.depth, tt.max); !reflect.DeepEqual(ps, tt.pages) {
+			t.Errorf("pages(%d, %d, %d) = %v, expected %v", tt.n, tt.depth, tt.max, ps, tt.pages)
+		}
+	}
+}
+
+func TestPagesExhaustive(t *testing.T) {
+	for n := 0; n < 12; n++ {
+		for depth := 0; depth < 6; depth++ {
+			for max := 0; max < 12; max++ {
+				ps := pages(n, depth, max)
+				if ps[0] != n {
+					t.Fatalf("pages(%d, %d, %d) = %v: requested page not first", n, depth, max, ps)
+				}
+				seen := make(map[int]bool)
+				for _, p := range ps {
+					if seen[p] {
+						t.Fatalf("pages(%d, %d, %d) = %v: duplicate %d", n, depth, max, ps, p)
+					}
+					if p != n && (p < n-depth || p >= n+depth) {
+						t.Fatalf("pages(%d, %d, %d) = %v: %d out of the window", n, depth, max, ps, p)
+					}
+					seen[p] = true
+				}
+				for i := n - depth; i < n+depth; i++ {
+					want := i >= 0 && (max == 0 || i <= max)
+					if i != n && seen[i] != want {
+						t.Fatalf("pages(%d, %d, %d) = %v: page %d included is %v", n, depth, max, ps, i, seen[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestStaleRefreshOncePerWindow(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 20 * time.Millisecond
+		cf.stale = 10 * time.Second
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	if _, err := c.get(q, 0); err != nil {
+		t.Fatal(err)
+	}
+	burst := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.get(q, 0); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	time.Sleep(30 * time.Millisecond)
+	burst()
+	eventually(t, func() bool { return u.total() == 2 })
+	// The refreshed page goes stale again within the same window
+	time.Sleep(30 * time.Millisecond)
+	burst()
+	time.Sleep(50 * time.Millisecond)
+	if n := u.total(); n != 2 {
+		t.Errorf("expected a single refresh in the stale window, got %d upstream requests", n)
+	}
+}
+
+func TestStaleSLA(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	var mux sync.Mutex
+	body := "old"
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		b := body
+		mux.Unlock()
+		if b != "old" {
+			<-block
+		}
+		io.WriteString(w, b)
+	})
+	t.Cleanup(release)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 200 * time.Millisecond
+		cf.gcpause = 10 * time.Millisecond
+		cf.sla = 50 * time.Millisecond
+		cf.slaRetain = 10 * time.Second
+	})
+	serve(h, "/test/search/cranes")
+	mux.Lock()
+	body = "new"
+	mux.Unlock()
+	// Let the entry expire and the collector run a few times
+	time.Sleep(250 * time.Millisecond)
+	w := serve(h, "/test/search/cranes")
+	if w.Body.String() != "old" || w.Header().Get("X-Cache-Status") != "STALE-SLA" {
+		t.Fatalf("expected the expired entry, got %q with status %q", w.Body, w.Header().Get("X-Cache-Status"))
+	}
+	release()
+	eventually(t, func() bool {
+		w = serve(h, "/test/search/cranes")
+		return w.Header().Get("X-From-Cache") == "1"
+	})
+	if w.Body.String() != "new" || u.total() != 2 {
+		t.Errorf("expected the SLA fetch to populate the cache, got %q after %d upstream requests", w.Body, u.total())
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var (
+		mux sync.Mutex
+		n   int
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		n++
+		fmt.Fprint(w, n)
+		mux.Unlock()
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 50 * time.Millisecond
+		cf.stale = 300 * time.Millisecond
+	})
+	serve(h, "/test/search/cranes")
+	time.Sleep(80 * time.Millisecond)
+	w := serve(h, "/test/search/cranes")
+	if w.Body.String() != "1" || w.Header().Get("X-Cache-Status") != "STALE" {
+		t.Errorf("expected the expired page within the grace window, got %q with status %q", w.Body, w.Header().Get("X-Cache-Status"))
+	}
+	eventually(t, func() bool {
+		w := serve(h, "/test/search/cranes")
+		return w.Body.String() == "2" && w.Header().Get("X-Cache-Status") == ""
+	})
+	// Past the grace window the client waits for the refresh
+	time.Sleep(400 * time.Millisecond)
+	w = serve(h, "/test/search/cranes")
+	if w.Body.String() != "3" || w.Header().Get("X-From-Cache") != "" {
+		t.Errorf("expected a fresh fetch past the grace window, got %q", w.Body)
+	}
+}
+
+func TestOrphanedWaiter(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	t.Cleanup(release)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.requestTimeout = 0
+		cf.fetchTimeout = 0
+		cf.waitTimeout = 50 * time.Millisecond
+	})
+	_, err := o.cache.get(newQuery("cranes", nil, nil), 0)
+	if ferr, ok := err.(*fetchError); !ok || ferr.err != errOrphaned {
+		t.Errorf("expected the waiter of a fetch that never ends to fail, got %v", err)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Waiters != 0 {
+		t.Errorf("expected the waiter to be removed, got %d", st.Waiters)
+	}
+}
+
+// cached reports whether page n of q is in the cache of c and still valid.
+func cached(c *cache, q *query, n int) bool {
+	c = c.shard(q.cg)
+	res := make(chan bool)
+	if err := c.send(func() error {
+		res <- c.entries.has(q.cg, offset(n*c.config.incr), time.Now())
+		return nil
+	}); err != nil {
+		return false
+	}
+	return <-res
+}
+
+func TestLookahead(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lookahead = 2
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	for n := 0; n < 5; n++ {
+		p, err := c.get(q, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 && !p.cached {
+			t.Errorf("page %d was not kept warm", n)
+		}
+		eventually(t, func() bool { return cached(c, q, n+1) && cached(c, q, n+2) })
+	}
+	// Paging back does not move the look-ahead
+	if _, err := c.get(q, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for n := 0; n < 10; n++ {
+		want := 0
+		if n <= 6 {
+			want = 1
+		}
+		if got := u.count(fmt.Sprintf("q=cranes&of=%d", n*10)); got != want {
+			t.Errorf("page %d fetched %d times, expected %d", n, got, want)
+		}
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	o, _ := newTestOrigin(t, u, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, err := o.cache.get(newQuery("cranes", nil, nil), 0); err != nil || string(p.body) != "q=cranes&of=0" {
+				t.Errorf("unexpected page: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := u.total(); n != 1 {
+		t.Errorf("expected concurrent requests to share a fetch, got %d upstream requests", n)
+	}
+}
+
+func TestPrefetchSingleFlight(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	t.Cleanup(release)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 3
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	var wg sync.WaitGroup
+	get := func(n int) {
+		defer wg.Done()
+		p, err := c.get(q, n)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if want := fmt.Sprintf("q=cranes&of=%d", n*10); string(p.body) != want {
+			t.Errorf("page %d: got %q, expected %q", n, p.body, want)
+		}
+	}
+	wg.Add(1)
+	go get(4)
+	// Wait for page 4 and the prefetch of pages 1-3 and 5-6 to be requested
+	eventually(t, func() bool {
+		st, err := c.stats()
+		return err == nil && st.Waiters == 6
+	})
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go get(5)
+		go get(4)
+	}
+	time.Sleep(20 * time.Millisecond)
+	release()
+	wg.Wait()
+	for n := 1; n <= 6; n++ {
+		if got := u.count(fmt.Sprintf("q=cranes&of=%d", n*10)); got != 1 {
+			t.Errorf("page %d fetched %d times, expected once", n, got)
+		}
+	}
+}
+
+func TestPrefetchSkipsCached(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 2
+	})
+	q := newQuery("cranes", nil, nil)
+	if _, err := o.cache.get(q, 1); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return cached(o.cache, q, 0) && cached(o.cache, q, 2) })
+	// Pages 1 and 2 around page 3 are cached already
+	if _, err := o.cache.get(q, 3); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return cached(o.cache, q, 4) })
+	for n := 0; n <= 4; n++ {
+		if got := u.count(fmt.Sprintf("q=cranes&of=%d", n*10)); got != 1 {
+			t.Errorf("page %d fetched %d times, expected once", n, got)
+		}
+	}
+}
+
+func TestPrefetchTotal(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 4
+		cf.totals = func(body []byte) (int, bool) {
+			// 25 results are 3 pages of 10
+			return 25, strings.HasPrefix(string(body), "q=cranes&")
+		}
+	})
+	for _, s := range []string{"cranes", "herons"} {
+		if _, err := o.cache.get(newQuery(s, nil, nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Without a total, the prefetch depth is used
+	eventually(t, func() bool { return cached(o.cache, newQuery("herons", nil, nil), 3) })
+	eventually(t, func() bool { return cached(o.cache, newQuery("cranes", nil, nil), 2) })
+	time.Sleep(50 * time.Millisecond)
+	if n := u.count("q=cranes&of=30"); n != 0 {
+		t.Errorf("expected no fetch past the last page, got %d", n)
+	}
+	if _, err := o.cache.get(newQuery("cranes", nil, nil), 2); err != nil {
+		t.Fatal(err)
+	}
+	o.cache.get(newQuery("herons", nil, nil), 3)
+	time.Sleep(50 * time.Millisecond)
+	if n := u.count("q=cranes&of=30") + u.count("q=cranes&of=40"); n != 0 {
+		t.Errorf("expected no fetch past the last page, got %d", n)
+	}
+	if n := u.count("q=herons&of=40"); n != 1 {
+		t.Errorf("expected the pages after the last requested one to be prefetched without a total, got %d", n)
+	}
+}
+
+func TestNoPrefetch(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 2
+		cf.lookahead = 2
+		cf.noPrefetch = regexp.MustCompile(`^.{20,}$`)
+	})
+	c := o.cache
+	for _, q := range []string{"averyspecificlongtailquery", "cranes"} {
+		if _, err := c.get(newQuery(q, nil, nil), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Page 0 and 2 are prefetched and 2 and 3 looked ahead
+	eventually(t, func() bool { return u.prefixed("q=cranes&") == 4 })
+	time.Sleep(20 * time.Millisecond)
+	if n := u.prefixed("q=avery"); n != 1 {
+		t.Errorf("expected only the requested page for a matching query, got %d requests", n)
+	}
+	if n := u.prefixed("q=cranes&"); n != 4 {
+		t.Errorf("expected the prefetch for other queries, got %d requests", n)
+	}
+}
+
+func TestPageLifetimes(t *testing.T) {
+	ds, err := parseLifetimes("20ms, 1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"", "1m,", "1m,x", "0s"} {
+		if _, err := parseLifetimes(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.pageLifetimes = ds
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	for n := 0; n < 3; n++ {
+		if _, err := c.get(q, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if cached(c, q, 0) {
+		t.Error("page 0 should have expired")
+	}
+	if !cached(c, q, 1) || !cached(c, q, 2) {
+		t.Error("deeper pages should still be cached")
+	}
+}
+
+func TestGroupExpiry(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 100 * time.Millisecond
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	c.get(q, 0)
+	time.Sleep(60 * time.Millisecond)
+	c.get(q, 1)
+	time.Sleep(50 * time.Millisecond)
+	if cached(c, q, 0) || !cached(c, q, 1) {
+		t.Error("expected each page to expire after its own lifetime")
+	}
+
+	u = newUpstream(t, nil)
+	o, _ = newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 100 * time.Millisecond
+		cf.groupExpiry = true
+	})
+	c = o.cache
+	c.get(q, 0)
+	time.Sleep(60 * time.Millisecond)
+	c.get(q, 1)
+	time.Sleep(50 * time.Millisecond)
+	if cached(c, q, 0) || cached(c, q, 1) {
+		t.Error("expected the pages of the group to expire together")
+	}
+}
+
+func TestCoalesceColdGroup(t *testing.T) {
+	for _, tt := range []struct {
+		coalesce bool
+		fetches  int
+	}{{true, 3}, {false, 5}} {
+		block := make(chan struct{})
+		release := sync.OnceFunc(func() { close(block) })
+		u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			<-block
+			io.WriteString(w, r.URL.RawQuery)
+		})
+		t.Cleanup(release)
+		o, _ := newTestOrigin(t, u, func(cf *config) {
+			cf.npref = 3
+			cf.coalesce = tt.coalesce
+		})
+		c := o.cache
+		q := newQuery("cold", nil, nil)
+		var wg sync.WaitGroup
+		get := func(n int) {
+			defer wg.Done()
+			if _, err := c.get(q, n); err != nil {
+				t.Error(err)
+			}
+		}
+		wg.Add(3)
+		go get(0)
+		// Pages 0 to 2 are in flight for the first request
+		eventually(t, func() bool {
+			st, err := c.stats()
+			return err == nil && st.Waiters == 3
+		})
+		go get(1)
+		go get(2)
+		time.Sleep(20 * time.Millisecond)
+		release()
+		wg.Wait()
+		eventually(t, func() bool {
+			st, err := c.stats()
+			return err == nil && st.Waiters == 0
+		})
+		if n := u.total(); n != tt.fetches {
+			t.Errorf("coalesce %v: expected %d fetches, got %d", tt.coalesce, tt.fetches, n)
+		}
+	}
+}
+
+func TestReuseModified(t *testing.T) {
+	var (
+		mux      sync.Mutex
+		modified = "Mon, 12 Oct 2026 10:00:00 GMT"
+		fetches  int
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		fetches++
+		w.Header().Set("Last-Modified", modified)
+		fmt.Fprintf(w, "fetch %d", fetches)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 20 * time.Millisecond
+		cf.reuseModified = true
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	entry := func() *entry {
+		res := make(chan *entry)
+		c.send(func() error {
+			ce, _ := c.entries.get(q.cg, 0)
+			res <- ce
+			return nil
+		})
+		return <-res
+	}
+	get := func() string {
+		time.Sleep(30 * time.Millisecond)
+		p, err := c.get(q, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(p.body)
+	}
+	if b := get(); b != "fetch 1" {
+		t.Fatalf("unexpected body %q", b)
+	}
+	first := entry()
+	data, deadline := &first.data[0], first.deadline
+	st, _ := c.stats()
+	if b := get(); b != "fetch 1" {
+		t.Errorf("expected the stored body of an unmodified page, got %q", b)
+	}
+	ce := entry()
+	if &ce.data[0] != data || !ce.deadline.After(deadline) {
+		t.Error("expected the same body with a later deadline")
+	}
+	if st2, _ := c.stats(); st2.Mem != st.Mem {
+		t.Errorf("memory changed from %d to %d", st.Mem, st2.Mem)
+	}
+	mux.Lock()
+	modified = "Tue, 13 Oct 2026 10:00:00 GMT"
+	mux.Unlock()
+	if b := get(); b != "fetch 3" {
+		t.Errorf("expected the body of a modified page, got %q", b)
+	}
+}
+
+func TestTTLHeader(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Result-TTL", r.URL.Query().Get("q"))
+		io.WriteString(w, "body")
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.ttlHeader = "X-Result-TTL"
+		cf.ttlMin = time.Minute
+		cf.ttlMax = time.Hour
+	})
+	for _, tt := range []struct {
+		header string
+		ttl    time.Duration
+	}{
+		{"600", 10 * time.Minute},
+		{"1", time.Minute},
+		{"86400", time.Hour},
+		{"none", 5 * time.Minute},
+		{"-5", 5 * time.Minute},
+	} {
+		start := time.Now()
+		p, err := o.cache.get(newQuery(tt.header, nil, nil), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := p.expire.Sub(start); d < tt.ttl || d > tt.ttl+time.Second {
+			t.Errorf("TTL header %q: cached for %s, expected %s", tt.header, d, tt.ttl)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("q"))
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.cacheControl = true
+	})
+	start := time.Now()
+	p, err := o.cache.get(newQuery("max-age=600", nil, nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := p.expire.Sub(start); d < 10*time.Minute || d > 10*time.Minute+time.Second {
+		t.Errorf("expected the page cached for max-age, got %s", d)
+	}
+	for i := 0; i < 2; i++ {
+		if w := serve(h, "/test/search/no-store"); w.Code != 200 || w.Body.String() != "q=no-store&of=0" || w.Header().Get("X-From-Cache") != "" {
+			t.Errorf("expected the page served without caching it, got %d %q", w.Code, w.Body)
+		}
+	}
+	if n := u.count("q=no-store&of=0"); n != 2 {
+		t.Errorf("expected a page not to be stored to be fetched each time, got %d fetches", n)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		header  http.Header
+		ttl     time.Duration
+		noStore bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, false},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, false},
+		{http.Header{"Cache-Control": {"max-age=0"}}, 0, true},
+		{http.Header{"Cache-Control": {"No-Store"}}, 0, true},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 0, true},
+		{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour, false},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}, "Cache-Control": {"max-age=60"}}, time.Minute, false},
+	} {
+		ttl, noStore := freshness(tt.header, now)
+		if noStore != tt.noStore || ttl < tt.ttl-time.Second || ttl > tt.ttl {
+			t.Errorf("%v: got %s, %v, expected %s, %v", tt.header, ttl, noStore, tt.ttl, tt.noStore)
+		}
+	}
+}
+
+func TestPrefetchRate(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		times = make(map[string]time.Time)
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		times[r.URL.Query().Get("of")] = time.Now()
+		mux.Unlock()
+		io.WriteString(w, "body")
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 6
+		cf.prefetchRate = 20
+	})
+	start := time.Now()
+	if _, err := o.cache.get(newQuery("cranes", nil, nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return u.total() == 6 })
+	mux.Lock()
+	defer mux.Unlock()
+	if d := times["0"].Sub(start); d > 40*time.Millisecond {
+		t.Errorf("the requested page should not wait for the prefetch rate, took %s", d)
+	}
+	// The first prefetch starts at once, the next ones every 50ms
+	for i := 2; i <= 5; i++ {
+		if d := times[fmt.Sprint(i*10)].Sub(times[fmt.Sprint((i-1)*10)]); d < 40*time.Millisecond {
+			t.Errorf("prefetches of pages %d and %d only %s apart", i-1, i, d)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.tenantHeader = "X-Tenant"
+		cf.tenantEntries = 2
+	})
+	c := o.cache
+	for _, q := range []string{"cranes", "storks"} {
+		if w := serve(h, "/test/search/"+q, "X-Tenant", "b"); w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+	}
+	if w := serve(h, "/test/search/cranes", "X-Tenant", "a"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if n := u.total(); n != 3 {
+		t.Errorf("expected a fetch for each tenant, got %d fetches", n)
+	}
+	for _, q := range []string{"herons", "ibises"} {
+		serve(h, "/test/search/"+q, "X-Tenant", "a")
+	}
+	query := func(tenant, q string) *query {
+		qr := newQuery(q, nil, nil)
+		qr.setTenant(tenant)
+		return qr
+	}
+	for _, q := range []string{"cranes", "storks"} {
+		if !cached(c, query("b", q), 0) {
+			t.Errorf("page %s of tenant b evicted by tenant a", q)
+		}
+	}
+	if cached(c, query("a", "cranes"), 0) {
+		t.Error("expected the oldest page of tenant a to be evicted")
+	}
+	st, _ := c.stats()
+	if ts := st.Tenants["a"]; ts == nil || ts.Entries != 2 {
+		t.Errorf("unexpected stats for tenant a: %+v", ts)
+	}
+	if ts := st.Tenants["b"]; ts == nil || ts.Entries != 2 {
+		t.Errorf("unexpected stats for tenant b: %+v", ts)
+	}
+}
+
+func TestTenantKeyCollision(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.tenantHeader = "X-Tenant"
+	})
+	serve(h, "/test/search/secret", "X-Tenant", "acme")
+	for _, tt := range []struct{ path, tenant string }{
+		{"/test/search/acme%40secret", ""},
+		{"/test/search/b%40secret", "acme%40"},
+		{"/test/search/secret", "acme%40"},
+	} {
+		w := serve(h, tt.path, "X-Tenant", tt.tenant)
+		if w.Header().Get("X-From-Cache") != "" {
+			t.Errorf("%s for tenant %q: served the page of tenant acme", tt.path, tt.tenant)
+		}
+	}
+	if n := u.total(); n != 4 {
+		t.Errorf("expected a fetch for each request, got %d", n)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.compress = true
+		cf.variants = 2
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	p, err := c.get(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	computed := make(map[string]int)
+	variant := func(name string) string {
+		data, err := c.variant(q.cg, p, name, func() ([]byte, error) {
+			computed[name]++
+			return []byte(name), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	st, _ := c.stats()
+	for i := 0; i < 3; i++ {
+		if v := variant("a"); v != "a" {
+			t.Errorf("unexpected variant %q", v)
+		}
+		variant("b")
+	}
+	if computed["a"] != 1 || computed["b"] != 1 {
+		t.Errorf("expected each variant to be computed once, got %v", computed)
+	}
+	if st2, _ := c.stats(); st2.Mem != st.Mem+2 {
+		t.Errorf("expected the variants to use 2 bytes, got %d", st2.Mem-st.Mem)
+	}
+	// The least used variant makes room for a new one
+	variant("a")
+	variant("c")
+	variant("a")
+	variant("b")
+	if computed["a"] != 1 || computed["b"] != 2 || computed["c"] != 1 {
+		t.Errorf("expected the least used variant to be evicted, got %v", computed)
+	}
+	if w := serve(h, "/test/search/cranes"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body)
+	}
+	if w := serve(h, "/test/search/cranes"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body)
+	}
+	if st2, _ := c.stats(); st2.Mem == st.Mem {
+		t.Error("expected the uncompressed body to be kept")
+	}
+}
+
+func TestMinFetchInterval(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = time.Millisecond
+		cf.minFetchInterval = 200 * time.Millisecond
+	})
+	start := time.Now()
+	var throttled int
+	for time.Since(start) < 500*time.Millisecond {
+		w := serve(h, "/test/search/cranes")
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+		if w.Header().Get("X-Cache-Status") == "STALE-THROTTLED" {
+			throttled++
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := u.count("q=cranes&of=0"); n < 2 || n > 3 {
+		t.Errorf("expected a fetch every 200ms, got %d in 500ms", n)
+	}
+	if throttled == 0 {
+		t.Error("expected throttled requests to be served stale")
+	}
+	// Without a stale page to serve, the client is asked to retry
+	w := serve(h, "/test/search/cranes/1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a throttled miss to get 429 with Retry-After, got %d", w.Code)
+	}
+}
+
+func TestNoPrefetchDepth(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 0
+		cf.maxPage = 3
+	})
+	for _, path := range []string{"/test/search/cranes/3", "/test/search/cranes/0"} {
+		if w := serve(h, path); w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := u.total(); n != 2 {
+		t.Errorf("expected only the requested pages to be fetched, got %d fetches", n)
+	}
+	if st, _ := o.cache.stats(); st.Entries != 2 {
+		t.Errorf("expected 2 cached pages, got %d", st.Entries)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+		cf.negativeTTL = 100 * time.Millisecond
+		cf.gcpause = 10 * time.Millisecond
+	})
+	for i := 0; i < 3; i++ {
+		if w := serve(h, "/test/search/cranes"); w.Code != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", w.Code)
+		}
+	}
+	if n := u.total(); n != 1 {
+		t.Errorf("expected the failure to be cached, got %d fetches", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	serve(h, "/test/search/cranes")
+	serve(h, "/test/search/cranes")
+	if n := u.total(); n != 2 {
+		t.Errorf("expected a fetch after the negative TTL, got %d fetches", n)
+	}
+	eventually(t, func() bool {
+		st, _ := o.cache.stats()
+		return st.Entries == 0
+	})
+}
+
+func TestMaxGroups(t *testing.T) {
+	ev := newEvictions()
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.maxGroups = 2
+		cf.onEvict = ev.hook
+	})
+	for _, q := range []string{"a", "b", "a", "c"} {
+		serve(h, "/test/search/"+q)
+		time.Sleep(2 * time.Millisecond)
+	}
+	ev.expect(t, map[string]int{"b capacity": 1})
+	for q, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := cached(o.cache, newQuery(q, nil, nil), 0); got != want {
+			t.Errorf("%s: cached %v, expected %v", q, got, want)
+		}
+	}
+	if st, _ := o.cache.stats(); st.Evictions != 1 {
+		t.Errorf("expected 1 eviction, got %d", st.Evictions)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 200 * time.Millisecond
+		cf.sliding = true
+		cf.slidingMax = time.Minute
+	})
+	for i := 0; i < 5; i++ {
+		serve(h, "/test/search/cranes")
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := u.count("q=cranes&of=0"); n != 1 {
+		t.Errorf("expected a page served often to stay cached, got %d fetches", n)
+	}
+}
+
+func TestEntrySlide(t *testing.T) {
+	now := time.Now()
+	ce := &entry{fetched: now, deadline: now.Add(time.Minute), ttl: time.Minute}
+	ce.slide(now.Add(30*time.Second), 2*time.Minute)
+	if want := now.Add(90 * time.Second); !ce.deadline.Equal(want) {
+		t.Errorf("expected the deadline to move a lifetime after the access, got %s", ce.deadline.Sub(now))
+	}
+	ce.slide(now.Add(90*time.Second), 2*time.Minute)
+	if want := now.Add(2 * time.Minute); !ce.deadline.Equal(want) {
+		t.Errorf("expected the deadline to stop at the max lifetime, got %s", ce.deadline.Sub(now))
+	}
+}
+
+func TestShards(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.shards = 4
+	})
+	used := make(map[*cache]bool)
+	for i := 0; i < 16; i++ {
+		q := newQuery(fmt.Sprintf("q%d", i), nil, nil)
+		if _, err := o.cache.get(q, 0); err != nil {
+			t.Fatal(err)
+		}
+		used[o.cache.shard(q.cg)] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("expected the groups to be spread among the shards, got %d", len(used))
+	}
+	if p, err := o.cache.get(newQuery("q3", nil, nil), 0); err != nil || !p.cached {
+		t.Errorf("expected the page to be cached, got %v", err)
+	}
+	if found, err := o.cache.purge(group("q3")); err != nil || !found {
+		t.Errorf("expected the group to be purged, got %v", err)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != 15 || st.Requests != 17 || st.Cached != 1 {
+		t.Errorf("expected the stats of all shards, got %d entries, %d requests, %d cached", st.Entries, st.Requests, st.Cached)
+	}
+	var buf bytes.Buffer
+	if n, err := o.cache.export(&buf); err != nil || n != 15 {
+		t.Fatalf("expected 15 pages exported, got %d: %v", n, err)
+	}
+	o2, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.shards = 3
+	})
+	if n, err := o2.cache.load(&buf); err != nil || n != 15 {
+		t.Fatalf("expected 15 pages loaded, got %d: %v", n, err)
+	}
+	if !cached(o2.cache, newQuery("q7", nil, nil), 0) {
+		t.Error("expected the loaded page to be in its shard")
+	}
+}
+
+// BenchmarkParallelHits measures serving cached pages of many groups from
+// parallel clients.
+func BenchmarkParallelHits(b *testing.B) {
+	for _, shards := range []int{1, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			u := newUpstream(b, nil)
+			o, _ := newTestOrigin(b, u, func(cf *config) {
+				cf.shards = shards
+			})
+			qs := make([]*query, 64)
+			for i := range qs {
+				qs[i] = newQuery(fmt.Sprintf("q%d", i), nil, nil)
+				if _, err := o.cache.get(qs[i], 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					q := qs[atomic.AddUint64(&next, 1)%uint64(len(qs))]
+					if _, err := o.cache.get(q, 0); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.eventQueue = 2
+	})
+	c := o.cache
+	release := make(chan struct{})
+	started := make(chan struct{})
+	c.send(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	var ran int32
+	inc := func() error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	// Queued without blocking
+	c.send(inc)
+	c.send(inc)
+	sent := make(chan error)
+	go func() { sent <- c.send(inc) }()
+	eventually(t, func() bool { return atomic.LoadUint64(&c.metrics.eventsBlocked) == 1 })
+	body := serve(h, "/metrics").Body.String()
+	for _, line := range []string{
+		`interproxy_cache_events_queued{origin="test"} 2`,
+		`interproxy_cache_events_blocked_total{origin="test"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in metrics", line)
+		}
+	}
+	close(release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// Queued events run even if the cache is closed right after
+	eventually(t, func() bool { return atomic.LoadInt32(&ran) == 3 })
+	if err := c.send(inc); err != errClosed {
+		t.Errorf("expected errClosed after Close, got %v", err)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var failing int32
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "broken", 500)
+			return
+		}
+		io.WriteString(w, "old")
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 20 * time.Millisecond
+		cf.gcpause = 10 * time.Millisecond
+		cf.staleIfError = 200 * time.Millisecond
+		cf.retries = 0
+	})
+	q := newQuery("cranes", nil, nil)
+	if _, err := o.cache.get(q, 0); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(30 * time.Millisecond)
+	p, err := o.cache.get(q, 0)
+	if err != nil {
+		t.Fatalf("expected the stale page, got %s", err)
+	}
+	if p.status != "STALE-ERROR" || string(p.body) != "old" {
+		t.Errorf("unexpected page %q with status %q", p.body, p.status)
+	}
+	// Past the grace window the error is returned
+	time.Sleep(200 * time.Millisecond)
+	if _, err := o.cache.get(q, 0); err == nil {
+		t.Error("expected the fetch error after the grace window")
+	} else if _, ok := err.(*fetchError); !ok {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestPutRacingGC(t *testing.T) {
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.lifetime = 50 * time.Millisecond
+		cf.gcpause = time.Millisecond
+	})
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	// Fetched before the garbage collector purged the group, and expired since
+	p := newPage(0, []byte("old"))
+	p.fetched = time.Now().Add(-time.Minute)
+	c.put(q.cg, p, nil)
+	if cached(c, q, 0) {
+		t.Error("expected the expired page not to be cached")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				p := newPage(offset(n*10), []byte("new"))
+				p.fetched = time.Now().Add(-time.Duration(n) * time.Millisecond)
+				c.put(q.cg, p, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	res := make(chan error)
+	c.send(func() error {
+		var err error
+		for n, ce := range c.entries.ents[q.cg] {
+			if ce.deadline.After(ce.fetched.Add(c.config.lifetime)) {
+				err = fmt.Errorf("page %d valid until %s, fetched at %s", n, ce.deadline, ce.fetched)
+			}
+		}
+		res <- err
+		return nil
+	})
+	if err := <-res; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrefetchWindow(t *testing.T) {
+	for _, tt := range []struct {
+		n, behind, ahead, max int
+		pages                 []int
+	}{
+		{5, 0, 2, 0, []int{5, 6, 7}},
+		{5, 2, 0, 0, []int{5, 3, 4}},
+		{1, 3, 1, 0, []int{1, 0, 2}},
+		{5, 1, 3, 6, []int{5, 4, 6}},
+	} {
+		if ps := around(tt.n, tt.behind, tt.ahead, tt.max); !reflect.DeepEqual(ps, tt.pages) {
+			t.Errorf("around(%d, %d, %d, %d) = %v, expected %v", tt.n, tt.behind, tt.ahead, tt.max, ps, tt.pages)
+		}
+	}
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 4
+		cf.prefetchBehind = 1
+		cf.prefetchAhead = 2
+	})
+	q := newQuery("cranes", nil, nil)
+	if _, err := o.cache.get(q, 5); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return u.total() == 4 })
+	time.Sleep(20 * time.Millisecond)
+	for _, n := range []int{4, 6, 7} {
+		if !cached(o.cache, q, n) {
+			t.Errorf("expected page %d to be prefetched", n)
+		}
+	}
+	if n := u.total(); n != 4 {
+		t.Errorf("expected 4 upstream requests, got %d", n)
+	}
+}
+
+func TestEventPanic(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, nil)
+	c := o.cache
+	var m map[group]int
+	if err := c.send(func() error {
+		m["cranes"]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.call(func() error {
+		panic("broken")
+	}); err != errPanic {
+		t.Errorf("expected the caller to get errPanic, got %v", err)
+	}
+	q := newQuery("cranes", nil, nil)
+	if p, err := c.get(q, 0); err != nil || string(p.body) != "q=cranes&of=0" {
+		t.Fatalf("expected the cache to keep working, got %v", err)
+	}
+	if _, err := c.stats(); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadUint64(&c.metrics.eventsPanicked); n != 2 {
+		t.Errorf("expected 2 panics counted, got %d", n)
+	}
+}
+
+func TestGetAttempts(t *testing.T) {
+	u := newUpstream(t, nil)
+	var o *origin
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		// The fetched pages are gone before the clients look them up
+		cf.onFill = func(cg group, n offset) {
+			o.cache.entries.remove(cg, n)
+		}
+	})
+	if _, err := o.cache.get(newQuery("cranes", nil, nil), 0); err != errUnstable {
+		t.Errorf("expected the lookups to stop, got %v", err)
+	}
+	if n := u.total(); n != getAttempts {
+		t.Errorf("expected %d fetches, got %d", getAttempts, n)
+	}
+	if w := serve(h, "/test/search/forklifts"); w.Code != 502 {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+}
+
+func TestHitWhileBusy(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, nil)
+	c := o.cache
+	q := newQuery("cranes", nil, nil)
+	if _, err := c.get(q, 0); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	c.shard(q.cg).send(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	got := make(chan *page)
+	go func() {
+		p, err := c.get(q, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- p
+	}()
+	select {
+	case p := <-got:
+		if !p.cached || string(p.body) != "q=cranes&of=0" {
+			t.Errorf("expected the cached page, got %q", p.body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hit waited for the event loop")
+	}
+	close(release)
+	eventually(t, func() bool {
+		st, err := c.stats()
+		return err == nil && st.Cached == 1
+	})
+}
+
+func TestCloseDrainsFetches(t *testing.T) {
+	started := make(chan struct{}, 2)
+	slow := make(chan struct{})
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-slow:
+			io.WriteString(w, r.URL.RawQuery)
+		case <-r.Context().Done():
+		}
+	})
+	var filled int32
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+		cf.drainWait = time.Second
+		cf.onFill = func(cg group, n offset) {
+			atomic.AddInt32(&filled, 1)
+		}
+	})
+	c := o.cache
+	go c.get(newQuery("cranes", nil, nil), 0)
+	<-started
+	time.AfterFunc(50*time.Millisecond, func() { close(slow) })
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&filled) != 1 {
+		t.Error("expected the page in flight to be cached before closing")
+	}
+
+	// Past drainWait, the fetches left are canceled
+	u = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	})
+	o, _ = newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+		cf.drainWait = 50 * time.Millisecond
+	})
+	c = o.cache
+	errs := make(chan error)
+	go func() {
+		_, err := c.get(newQuery("forklifts", nil, nil), 0)
+		errs <- err
+	}()
+	<-started
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Close to stop waiting, took %s", d)
+	}
+	if err := <-errs; err == nil {
+		t.Error("expected the client to fail")
+	}
+	eventually(t, func() bool { return atomic.LoadInt64(&c.fetching) == 0 })
+}
+
+func TestMemoryCapExact(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 10))
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.maxMemory = 20
+	})
+	for _, q := range []string{"cranes", "forklifts"} {
+		if _, err := o.cache.get(newQuery(q, nil, nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, q := range []string{"cranes", "forklifts"} {
+		if !cached(o.cache, newQuery(q, nil, nil), 0) {
+			t.Errorf("%s: expected the pages filling the limit exactly to stay cached", q)
+		}
+	}
+}
+
+func TestMemoryCap(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		n := 100
+		if r.URL.Query().Get("q") == "huge" {
+			n = 1000
+		}
+		io.WriteString(w, strings.Repeat("x", n))
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.maxMemory = 250
+	})
+	c := o.cache
+	get := func(q string) {
+		if _, err := c.get(newQuery(q, nil, nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("cranes")
+	get("forklifts")
+	get("cranes")
+	// The least recently used group makes room for the new page
+	get("tractors")
+	for q, want := range map[string]bool{"cranes": true, "forklifts": false, "tractors": true} {
+		if cached(c, newQuery(q, nil, nil), 0) != want {
+			t.Errorf("%s: expected cached to be %v", q, want)
+		}
+	}
+	get("huge")
+	if cached(c, newQuery("huge", nil, nil), 0) {
+		t.Error("expected a page larger than the limit not to be cached")
+	}
+	st, err := c.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mem != 200 || st.MaxMem != 250 {
+		t.Errorf("expected 200 of 250 bytes used, got %d of %d", st.Mem, st.MaxMem)
+	}
+	body := serve(h, "/metrics").Body.String()
+	for _, line := range []string{
+		`interproxy_cache_memory_bytes{origin="test"} 200`,
+		`interproxy_cache_memory_limit_bytes{origin="test"} 250`,
+		`interproxy_cache_too_large_total{origin="test"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in metrics", line)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command interproxy is a caching proxy for paginated search results.
+package main
+
+import "github.com/dullgiulio/interproxy"
+
+func main() {
+	interproxy.Main()
+}
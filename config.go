@@ -2,44 +2,715 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
 
 type config struct {
-	lifetime  time.Duration
-	gcpause   time.Duration
-	tmpl      string
-	npref     int
-	incr      int
-	maxMemory int64
+	lifetime   time.Duration
+	gcpause    time.Duration
+	tmpl       string
+	npref      int
+	incr       int
+	maxMemory  int64
+	keyHeaders []string
+	// keyParams are the query parameters of requests forwarded to the
+	// upstream and part of the cache group.
+	keyParams []string
+	// hits is how many results per page are asked to the upstream with the
+	// query parameter hitsParam; 0 leaves it to the upstream.
+	hits      int
+	hitsParam string
+	// normalize are the normalizers applied to queries in cache groups.
+	normalize []string
+	// fallbacks are the templates of other upstreams of the origin, tried
+	// in order when fetching from tmpl fails.
+	fallbacks []string
+	// modes are the templates clients can pick instead of tmpl by name, in
+	// the query parameter modeParam. Pages of each mode are cached apart.
+	modes     map[string]string
+	modeParam string
+	// shards is how many parts the groups are split into, each served by
+	// its own goroutine.
+	shards int
+	// maxGroups is how many groups are cached at most, evicting the least
+	// recently used ones; 0 means no limit.
+	maxGroups int
+	// pageLifetimes overrides lifetime for the first pages; the last one
+	// applies to all the following pages.
+	pageLifetimes []time.Duration
+	// groupExpiry makes the pages of a group expire with the first one
+	// cached, instead of each after its own lifetime.
+	groupExpiry bool
+	// sliding extends the lifetime of a page each time it is served, up to
+	// slidingMax after it was fetched.
+	sliding    bool
+	slidingMax time.Duration
+	// negativeTTL is how long a failed fetch is cached, to answer with its
+	// error without fetching again; 0 disables it.
+	negativeTTL time.Duration
+	// stale is how long after expiry an entry is still served while it is refreshed.
+	stale time.Duration
+	// sla is how long to wait for a fetch before serving an expired entry instead.
+	sla time.Duration
+	// slaRetain is how long after expiry an entry is kept to be served when the sla is exceeded.
+	slaRetain time.Duration
+	// staleIfError is how long after expiry an entry is served when fetching it again fails.
+	staleIfError time.Duration
+	// refreshProb is the probability that serving a stale entry refreshes it.
+	refreshProb float64
+	// lookahead is how many pages after the furthest requested one are kept warm.
+	lookahead int
+	// noPrefetch matches the queries for which only the requested page is fetched.
+	noPrefetch *regexp.Regexp
+	// prefetchBehind and prefetchAhead are how many pages before and after
+	// the requested one are prefetched; if negative, npref before and npref-1 after.
+	prefetchBehind int
+	prefetchAhead  int
+	// prefetchRate is how many prefetches can start each second; 0 means no limit.
+	prefetchRate float64
+	// fetchRate is how many requests are sent to the upstream each second,
+	// up to fetchBurst at once; 0 means no limit.
+	fetchRate  float64
+	fetchBurst int
+	// coalesce makes requests for pages already being fetched wait for them
+	// without prefetching the pages around them.
+	coalesce bool
+	// minFetchInterval is the least time between two fetches of a group
+	// for missing pages; 0 means no limit.
+	minFetchInterval time.Duration
+	// refreshEvery is the least time between two fetches of a cached
+	// group requested by the clients; 0 ignores their requests.
+	refreshEvery time.Duration
+	// maxPage is the last page that can be requested or fetched; 0 means no limit.
+	maxPage int
+	// compress keeps the cached bodies gzip compressed in memory.
+	compress bool
+	// gzip compresses the bodies not kept compressed for the clients accepting it.
+	gzip bool
+	// readOnly never fetches from the upstream: pages are only imported.
+	readOnly bool
+	// replicaWait is how long a read-only cache waits for a missing page to be imported.
+	replicaWait time.Duration
+	// expiry selects additional expiry headers: "rfc3339", "unix", "maxage" or "all".
+	expiry string
+	// extractor, if set, extracts results from fetched pages to serve as JSON.
+	extractor extractor
+	// transform, if set, replaces the body and content type of fetched pages
+	// before they are cached.
+	transform transformer
+	// totals, if set, reads the number of results from fetched pages to
+	// prefetch only the pages that exist.
+	totals totalParser
+	// signer signs upstream requests if not nil.
+	signer *signer
+	// client, if set, sends the requests to the upstream instead of a
+	// client of the cache.
+	client doer
+	// userAgent is sent to the upstream unless a forwarded header sets it.
+	userAgent string
+	// minBody is the least size of the body of a successful fetch, shorter
+	// bodies are failed fetches.
+	minBody int
+	// maxBody is the largest size of the body of a fetch, larger ones fail;
+	// 0 means no limit.
+	maxBody int64
+	// maxImport is the largest size of a dump imported over HTTP; 0 means
+	// no limit.
+	maxImport int64
+	// maxIdleConns is how many idle connections to the upstreams are kept
+	// open, and maxIdlePerHost how many of them to each host: fetches beyond
+	// them open new connections, which are closed once done.
+	maxIdleConns   int
+	maxIdlePerHost int
+	// maxConnsPerHost limits the connections to each upstream host, making
+	// further fetches wait for one; 0 means no limit.
+	maxConnsPerHost int
+	// idleTimeout is how long an idle connection to the upstream is kept open.
+	idleTimeout time.Duration
+	// fetchTimeout limits the time of an upstream request; 0 means no limit.
+	fetchTimeout time.Duration
+	// waitTimeout is how long after a fetch starts its waiters are woken up
+	// with an error, in case the fetch never ends; 0 means never.
+	waitTimeout time.Duration
+	// requestTimeout is how long a client waits for a page; 0 means no limit.
+	requestTimeout time.Duration
+	// timeoutHeader is a request header with the milliseconds the client waits,
+	// to stop fetching for it earlier than fetchTimeout.
+	timeoutHeader string
+	// retries is how many times a fetch rate limited by the upstream or failed
+	// because of the network or a 5xx is retried; the latter after retryBase,
+	// doubled for each further retry.
+	retries   int
+	retryBase time.Duration
+	// retryJitter spreads the retries of rate limited fetches of the origin.
+	retryJitter time.Duration
+	// reuseModified keeps the stored body of a refreshed page whose
+	// Last-Modified did not change.
+	reuseModified bool
+	// revalidate fetches again a cached page only if the upstream reports
+	// that it changed since, by its ETag or Last-Modified. Expired pages can
+	// be revalidated until collected, see retention.
+	revalidate bool
+	// dedup keeps a single copy of identical page bodies, at the cost of
+	// hashing each of them.
+	dedup bool
+	// drainWait is how long Close waits for the fetches in flight to cache
+	// their pages before canceling them.
+	drainWait time.Duration
+	// ttlHeader is an upstream response header with the seconds a page is
+	// cached for, bounded by ttlMin and, if positive, ttlMax.
+	ttlHeader string
+	ttlMin    time.Duration
+	ttlMax    time.Duration
+	// cacheControl takes the lifetime of pages from the Cache-Control and
+	// Expires headers of the upstream, if ttlHeader does not set it, and
+	// does not cache the pages the upstream does not allow to.
+	cacheControl bool
+	// batchURL, if set, is where the pages of the origin are fetched in batches
+	// of up to batchMax, waiting at most batchWait for a batch to fill up.
+	batchURL  string
+	batchMax  int
+	batchWait time.Duration
+	// tenantHeader is the request header with the tenant owning the requested
+	// pages. Each tenant can keep at most tenantEntries pages and tenantMemory
+	// bytes, if positive.
+	tenantHeader  string
+	tenantEntries int
+	tenantMemory  int64
+	// diskDir, if set, keeps the bodies larger than diskThreshold bytes in
+	// files in the directory, to be streamed from there.
+	diskDir       string
+	diskThreshold int
+	// cacheFile, if set, is where the cache is saved when closed and
+	// restored from when created.
+	cacheFile string
+	// synthetic, if set, renders the pages instead of fetching them, for
+	// clients to develop against. They are cached only if syntheticCache is set.
+	synthetic      *template.Template
+	syntheticCache bool
+	// traceRatio is the fraction of requests traced in the logs, besides the
+	// ones carrying traceHeader.
+	traceRatio  float64
+	traceHeader string
+	// passthrough sends requests with other methods than GET and HEAD to the
+	// upstream, without caching them.
+	passthrough bool
+	// headFetch fetches the pages not cached for HEAD requests too, instead
+	// of answering that they are not cached.
+	headFetch bool
+	// maxRange is the most pages a client can request at once.
+	maxRange int
+	// stream sends pages not cached to the clients while they are fetched.
+	stream bool
+	// rewriter replaces the links to the upstream in HTML pages, if not nil.
+	rewriter *urlRewriter
+	// eventQueue is how many operations can wait for each cache goroutine
+	// without blocking their callers.
+	eventQueue int
+	// breakerFails is how many fetches must fail in a row, each less than
+	// breakerWindow after the previous one, to stop fetching for
+	// breakerRetry, until a probe succeeds; 0 disables the circuit breaker.
+	breakerFails  int
+	breakerWindow time.Duration
+	breakerRetry  time.Duration
+	// variants is how many representations computed from a page are kept
+	// with it; 0 disables keeping them.
+	variants int
+	// errors is the format of error responses: "plain", "json" or "problem".
+	// Plain errors are sent as JSON to clients accepting application/json.
+	errors string
+	// ranges serves byte ranges of the uncompressed and normalized bodies.
+	ranges bool
+	// http10 always sends a Content-Length and closes the connection to HTTP/1.0 clients.
+	http10 bool
+	// maxGroupFetches limits parallel fetches for a single group; 0 means no limit.
+	maxGroupFetches int
+	// maxFetches limits parallel fetches for the whole origin; 0 means no limit.
+	maxFetches int
+	// schedule overrides npref and maxFetches at certain times of the day.
+	schedule []window
+	clock    func() time.Time
+	// adminToken enables the export and import endpoints for requests carrying it.
+	adminToken string
+	// onEvict is called when a group is removed from the cache.
+	onEvict func(cg group, reason string)
+	// onFill is called from the cache goroutine when a fetched page is cached;
+	// it must not block.
+	onFill func(cg group, n offset)
+	// onClose is called once the cache is closed.
+	onClose func()
 }
 
 func newConfig(tmpl string, incr int) *config {
 	return &config{
-		tmpl:      tmpl,
-		incr:      incr,
-		lifetime:  5 * time.Minute,
-		gcpause:   20 * time.Second,
-		npref:     4,
-		maxMemory: 1024 * 1024 * 256, // 256MB
+		tmpl:           tmpl,
+		incr:           incr,
+		lifetime:       5 * time.Minute,
+		gcpause:        20 * time.Second,
+		npref:          4,
+		prefetchBehind: -1,
+		prefetchAhead:  -1,
+		hitsParam:      "hits",
+		modeParam:      "mode",
+		revalidate:     true,
+		maxIdleConns:   100,
+		maxIdlePerHost: 100,
+		idleTimeout:    90 * time.Second,
+		refreshProb:    1,
+		http10:         true,
+		ranges:         true,
+		gzip:           true,
+		shards:         1,
+		variants:       2,
+		maxRange:       10,
+		eventQueue:     64,
+		breakerWindow:  10 * time.Second,
+		breakerRetry:   30 * time.Second,
+		errors:         "plain",
+		retries:        2,
+		requestTimeout: 30 * time.Second,
+		waitTimeout:    2 * time.Minute,
+		retryJitter:    time.Second,
+		retryBase:      100 * time.Millisecond,
+		negativeTTL:    5 * time.Second,
+		refreshEvery:   10 * time.Second,
+		minBody:        1,
+		maxBody:        10 * 1024 * 1024,
+		maxImport:      1024 * 1024 * 1024,
+		userAgent:      "interproxy/" + version,
+		slidingMax:     time.Hour,
+		expiry:         "rfc3339",
+		clock:          time.Now,
+		maxMemory:      1024 * 1024 * 256, // 256MB
 	}
 }
 
+// shard returns the configuration of one of n shards: the limits on the
+// groups of the whole cache are split among them.
+func (cf *config) shard(n int) *config {
+	scf := *cf
+	scf.maxMemory /= int64(n)
+	scf.maxGroups = (cf.maxGroups + n - 1) / n
+	scf.tenantEntries = (cf.tenantEntries + n - 1) / n
+	scf.tenantMemory /= int64(n)
+	return &scf
+}
+
+func (cf *config) window(t time.Time) *window {
+	for i := range cf.schedule {
+		if cf.schedule[i].contains(t) {
+			return &cf.schedule[i]
+		}
+	}
+	return nil
+}
+
+// retention returns how long expired entries are kept before being collected.
+func (cf *config) retention() time.Duration {
+	d := cf.stale
+	if cf.sla > 0 && cf.slaRetain > d {
+		d = cf.slaRetain
+	}
+	if cf.staleIfError > d {
+		d = cf.staleIfError
+	}
+	return d
+}
+
+// pageLifetime returns how long the page at offset n is cached.
+func (cf *config) pageLifetime(n offset) time.Duration {
+	if len(cf.pageLifetimes) == 0 {
+		return cf.lifetime
+	}
+	i := int(n) / cf.incr
+	if i >= len(cf.pageLifetimes) {
+		i = len(cf.pageLifetimes) - 1
+	}
+	return cf.pageLifetimes[i]
+}
+
+// pageTTL returns how long p is cached, preferring the lifetime requested by the upstream.
+func (cf *config) pageTTL(p *page) time.Duration {
+	if p.ttl <= 0 {
+		return cf.pageLifetime(p.n)
+	}
+	d := p.ttl
+	if d < cf.ttlMin {
+		d = cf.ttlMin
+	}
+	if cf.ttlMax > 0 && d > cf.ttlMax {
+		d = cf.ttlMax
+	}
+	return d
+}
+
+// parseNormalize parses a comma separated list of normalizers.
+func parseNormalize(s string) ([]string, error) {
+	var rules []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if _, ok := normalizers[r]; !ok {
+			return nil, fmt.Errorf("unknown query normalizer %q", r)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// template returns the URL template of mode, tmpl for the primary mode.
+func (cf *config) template(mode string) string {
+	if mode == "" {
+		return cf.tmpl
+	}
+	return cf.modes[mode]
+}
+
+// parseModes parses a comma separated list of name=template modes.
+func parseModes(s string) (map[string]string, error) {
+	modes := make(map[string]string)
+	for _, m := range strings.Split(s, ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		name, tmpl, ok := strings.Cut(m, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mode %q: needs name=template", m)
+		}
+		modes[name] = tmpl
+	}
+	if err := checkModes(modes); err != nil {
+		return nil, err
+	}
+	return modes, nil
+}
+
+// checkModes verifies the names and templates of modes.
+func checkModes(modes map[string]string) error {
+	for name, tmpl := range modes {
+		if name == "" || strings.ContainsAny(name, "/?#%&=!@") {
+			return fmt.Errorf("invalid mode name %q", name)
+		}
+		if err := checkTemplate(tmpl); err != nil {
+			return fmt.Errorf("mode %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// checkTemplate verifies that tmpl formats a query and an offset, in this order.
+func checkTemplate(tmpl string) error {
+	i := strings.Index(tmpl, "%s")
+	if i < 0 || !strings.Contains(tmpl[i:], "%d") {
+		return fmt.Errorf("invalid URL template %q: needs %%s for the query followed by %%d for the offset", tmpl)
+	}
+	if u := fmt.Sprintf(tmpl, "q", 0); strings.Contains(u, "%!") {
+		return fmt.Errorf("invalid URL template %q: formats as %q", tmpl, u)
+	}
+	return nil
+}
+
+// originConfig describes an origin in the file of origins. Incr, Npref
+// and TTL override the ones of the command line, if set.
+type originConfig struct {
+	Name  string
+	Tmpl  string
+	Incr  int
+	Npref *int
+	TTL   string
+	ttl   time.Duration
+	// Hits is how many results per page are asked to the upstream, if set
+	Hits int
+	// FetchRate and FetchBurst limit the requests sent to the upstream
+	FetchRate  float64
+	FetchBurst int
+	UserAgent  string
+	// Fallbacks are the templates tried in order when Tmpl fails
+	Fallbacks []string
+	// Modes replace the modes of the command line, if set
+	Modes map[string]string
+	// Normalize replaces the normalizers of the command line, if set
+	Normalize *string
+	normalize []string
+	// RewriteFrom is the base URL of the upstream replaced by RewriteTo in
+	// the links of HTML pages
+	RewriteFrom string
+	RewriteTo   string
+	rewriter    *urlRewriter
+}
+
+// setUserAgent sets the User-Agent of an upstream request, if not forwarded.
+func (cf *config) setUserAgent(req *http.Request) {
+	if cf.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", cf.userAgent)
+	}
+}
+
+// loadOrigins reads and validates the JSON list of origins in file path.
+func loadOrigins(path string) ([]*originConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read origins: %s", err)
+	}
+	var ocs []*originConfig
+	if err := json.Unmarshal(data, &ocs); err != nil {
+		return nil, fmt.Errorf("cannot parse origins in %s: %s", path, err)
+	}
+	if len(ocs) == 0 {
+		return nil, fmt.Errorf("no origins in %s", path)
+	}
+	names := make(map[string]bool)
+	for i, oc := range ocs {
+		if oc.Name == "" || strings.ContainsAny(oc.Name, "/?#%") {
+			return nil, fmt.Errorf("origin %d: invalid name %q", i, oc.Name)
+		}
+		if names[oc.Name] {
+			return nil, fmt.Errorf("origin %s: duplicate name", oc.Name)
+		}
+		names[oc.Name] = true
+		for _, t := range append([]string{oc.Tmpl}, oc.Fallbacks...) {
+			if err := checkTemplate(t); err != nil {
+				return nil, fmt.Errorf("origin %s: %s", oc.Name, err)
+			}
+		}
+		if err := checkModes(oc.Modes); err != nil {
+			return nil, fmt.Errorf("origin %s: %s", oc.Name, err)
+		}
+		if oc.Incr < 0 {
+			return nil, fmt.Errorf("origin %s: incr must be positive", oc.Name)
+		}
+		if oc.Hits < 0 {
+			return nil, fmt.Errorf("origin %s: hits cannot be negative", oc.Name)
+		}
+		if oc.Npref != nil && *oc.Npref < 0 {
+			return nil, fmt.Errorf("origin %s: npref cannot be negative", oc.Name)
+		}
+		if oc.FetchRate < 0 || oc.FetchBurst < 0 {
+			return nil, fmt.Errorf("origin %s: fetchrate and fetchburst cannot be negative", oc.Name)
+		}
+		if oc.Normalize != nil {
+			if oc.normalize, err = parseNormalize(*oc.Normalize); err != nil {
+				return nil, fmt.Errorf("origin %s: %s", oc.Name, err)
+			}
+		}
+		if oc.RewriteFrom != "" {
+			if oc.rewriter, err = newURLRewriter(oc.RewriteFrom, oc.RewriteTo); err != nil {
+				return nil, fmt.Errorf("origin %s: %s", oc.Name, err)
+			}
+		}
+		if oc.TTL != "" {
+			if oc.ttl, err = time.ParseDuration(oc.TTL); err != nil || oc.ttl <= 0 {
+				return nil, fmt.Errorf("origin %s: invalid ttl %q", oc.Name, oc.TTL)
+			}
+		}
+	}
+	return ocs, nil
+}
+
+// config returns a copy of base with the settings of the origin.
+func (oc *originConfig) config(base *config) *config {
+	cf := *base
+	cf.tmpl = oc.Tmpl
+	cf.fallbacks = oc.Fallbacks
+	if oc.Modes != nil {
+		cf.modes = oc.Modes
+	}
+	if oc.Normalize != nil {
+		cf.normalize = oc.normalize
+	}
+	if oc.Incr > 0 {
+		cf.incr = oc.Incr
+	}
+	if oc.Npref != nil {
+		cf.npref = *oc.Npref
+	}
+	if oc.Hits > 0 {
+		cf.hits = oc.Hits
+	}
+	if oc.ttl > 0 {
+		cf.lifetime = oc.ttl
+	}
+	if oc.FetchRate > 0 {
+		cf.fetchRate = oc.FetchRate
+	}
+	if oc.FetchBurst > 0 {
+		cf.fetchBurst = oc.FetchBurst
+	}
+	if oc.UserAgent != "" {
+		cf.userAgent = oc.UserAgent
+	}
+	if oc.rewriter != nil {
+		cf.rewriter = oc.rewriter
+	}
+	return &cf
+}
+
+// parseLifetimes parses a comma separated list of durations.
+func parseLifetimes(s string) ([]time.Duration, error) {
+	var ds []time.Duration
+	for _, v := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page lifetime %q: %s", v, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid page lifetime %q: must be positive", v)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// prefetches reports whether the pages around the requested one are fetched for q.
+func (cf *config) prefetches(q string) bool {
+	return cf.noPrefetch == nil || !cf.noPrefetch.MatchString(q)
+}
+
+// prefetchDepth returns the number of pages to prefetch at t.
+func (cf *config) prefetchDepth(t time.Time) int {
+	if w := cf.window(t); w != nil {
+		return w.npref
+	}
+	return cf.npref
+}
+
+// prefetchWindow returns how many pages before and after the requested one
+// are prefetched with depth npref.
+func (cf *config) prefetchWindow(npref int) (behind, ahead int) {
+	behind, ahead = npref, npref-1
+	if cf.prefetchBehind >= 0 {
+		behind = cf.prefetchBehind
+	}
+	if cf.prefetchAhead >= 0 {
+		ahead = cf.prefetchAhead
+	}
+	return behind, ahead
+}
+
+// fetchLimit returns the maximum number of parallel fetches at t.
+func (cf *config) fetchLimit(t time.Time) int {
+	if w := cf.window(t); w != nil {
+		return w.maxFetches
+	}
+	return cf.maxFetches
+}
+
 type stats struct {
 	Entries  int
 	Waiters  int
 	Requests int
 	Cached   int
 	Mem      int64
+	// RawMem is the uncompressed size of the cached entries
+	RawMem int64
+	// Disk is the size of the bodies kept in files
+	Disk     int64
+	Fetching map[group]int
+	// Evictions counts the groups removed from the cache for any reason
+	Evictions int
+	Tenants   map[string]*tenantStats `json:",omitempty"`
+	// Hits and Misses count the pages served from the cache or fetched
+	// for the clients; HitRatio is the fraction of hits.
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64
+	// Breaker is the state of the circuit breaker of the upstream, if any
+	Breaker string `json:",omitempty"`
+	// SharedBodies are the distinct bodies kept if deduplicated; Deduped is
+	// the size of the identical copies not kept, still counted in Mem.
+	SharedBodies int   `json:",omitempty"`
+	Deduped      int64 `json:",omitempty"`
+	// MaxMem is the most memory the cached entries can use
+	MaxMem int64
+	// gauge follows Mem for the metrics, if set
+	gauge *int64
+}
+
+type tenantStats struct {
+	Entries int
+	Mem     int64
 }
 
 func newStats() *stats {
 	return &stats{}
 }
 
-func (s *stats) mem(n int) {
-	s.Mem += int64(n)
+// addMem changes Mem by n, following it in gauge if set.
+func (s *stats) addMem(n int64) {
+	s.Mem += n
+	if s.gauge != nil {
+		atomic.AddInt64(s.gauge, n)
+	}
+}
+
+func (s *stats) store(ce *entry) {
+	s.addMem(ce.memSize())
+	s.RawMem += int64(len(ce.normalized))
+	if ce.file != "" {
+		s.Disk += int64(ce.size)
+	} else {
+		s.RawMem += int64(ce.size)
+	}
+	if ce.tenant != "" {
+		if s.Tenants == nil {
+			s.Tenants = make(map[string]*tenantStats)
+		}
+		ts, ok := s.Tenants[ce.tenant]
+		if !ok {
+			ts = &tenantStats{}
+			s.Tenants[ce.tenant] = ts
+		}
+		ts.Entries++
+		ts.Mem += int64(len(ce.data) + len(ce.normalized))
+	}
+}
+
+func (s *stats) drop(ce *entry) {
+	vsize := int64(ce.variantsSize())
+	s.addMem(-ce.memSize() - vsize)
+	s.RawMem -= int64(len(ce.normalized))
+	if ce.file != "" {
+		s.Disk -= int64(ce.size)
+	} else {
+		s.RawMem -= int64(ce.size)
+	}
+	if ts, ok := s.Tenants[ce.tenant]; ok {
+		ts.Entries--
+		ts.Mem -= int64(len(ce.data)+len(ce.normalized)) + vsize
+		if ts.Entries <= 0 {
+			delete(s.Tenants, ce.tenant)
+		}
+	}
+}
+
+// resize accounts for the memory of ce growing by n bytes.
+func (s *stats) resize(ce *entry, n int) {
+	s.addMem(int64(n))
+	if ts, ok := s.Tenants[ce.tenant]; ok {
+		ts.Mem += int64(n)
+	}
+}
+
+// tenantAbove reports whether tenant t has more than entries pages or
+// uses more than mem bytes, for the limits that are positive.
+func (s *stats) tenantAbove(t string, entries int, mem int64) bool {
+	ts, ok := s.Tenants[t]
+	if !ok {
+		return false
+	}
+	return (entries > 0 && ts.Entries > entries) || (mem > 0 && ts.Mem > mem)
 }
 
 func (s *stats) hit(cached bool) {
@@ -50,10 +721,42 @@ func (s *stats) hit(cached bool) {
 }
 
 func (s *stats) above(mem int64) bool {
-	return s.Mem >= mem
+	return s.Mem > mem
+}
+
+// add sums the stats of o to s.
+func (s *stats) add(o *stats) {
+	s.Entries += o.Entries
+	s.Waiters += o.Waiters
+	s.Requests += o.Requests
+	s.Cached += o.Cached
+	s.Mem += o.Mem
+	s.RawMem += o.RawMem
+	s.Disk += o.Disk
+	s.Evictions += o.Evictions
+	for t, ots := range o.Tenants {
+		if s.Tenants == nil {
+			s.Tenants = make(map[string]*tenantStats)
+		}
+		ts, ok := s.Tenants[t]
+		if !ok {
+			ts = &tenantStats{}
+			s.Tenants[t] = ts
+		}
+		ts.Entries += ots.Entries
+		ts.Mem += ots.Mem
+	}
 }
 
 func (s *stats) clone() *stats {
 	st := *s
+	st.gauge = nil
+	if s.Tenants != nil {
+		st.Tenants = make(map[string]*tenantStats)
+		for t, ts := range s.Tenants {
+			tsc := *ts
+			st.Tenants[t] = &tsc
+		}
+	}
 	return &st
 }
@@ -0,0 +1,67 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cors lets browsers call the proxy from the allowed origins. The origin of
+// the request is sent back instead of "*". Requests with credentials are
+// only allowed from the origins listed explicitly, not from any origin.
+type cors struct {
+	origins map[string]bool
+	// any allows all origins
+	any bool
+}
+
+// newCORS allows the origins in list; "*" allows any origin.
+func newCORS(list []string) *cors {
+	c := &cors{origins: make(map[string]bool)}
+	for _, o := range list {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		switch o {
+		case "":
+		case "*":
+			c.any = true
+		default:
+			c.origins[o] = true
+		}
+	}
+	return c
+}
+
+func (c *cors) allowed(origin string) bool {
+	return origin != "" && (c.any || c.origins[origin])
+}
+
+// wrap sets the CORS headers on the responses to allowed origins and answers
+// their preflight requests, before they reach h.
+func (c *cors) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if !c.allowed(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if c.origins[origin] {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE, OPTIONS")
+			if hs := r.Header.Get("Access-Control-Request-Headers"); hs != "" {
+				w.Header().Set("Access-Control-Allow-Headers", hs)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "X-From-Cache, X-Cached-Until, X-Cache-Status, X-Cache-Age, Age, ETag")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	h := newCORS([]string{"https://app.example.com/", " https://other.example.com"}).wrap(http.HandlerFunc(healthz))
+	for _, tt := range []struct {
+		method string
+		origin string
+		code   int
+		allow  string
+	}{
+		{"GET", "https://app.example.com", 200, "https://app.example.com"},
+		{"GET", "https://other.example.com", 200, "https://other.example.com"},
+		{"GET", "https://evil.example.com", 200, ""},
+		{"GET", "", 200, ""},
+		{"OPTIONS", "https://app.example.com", 204, "https://app.example.com"},
+	} {
+		r := httptest.NewRequest(tt.method, "/healthz", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+			r.Header.Set("Access-Control-Request-Headers", "Authorization")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s from %q: expected %d, got %d", tt.method, tt.origin, tt.code, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%s from %q: expected allowed origin %q, got %q", tt.method, tt.origin, tt.allow, got)
+		}
+		if tt.method == "OPTIONS" && (w.Header().Get("Access-Control-Allow-Methods") == "" || w.Header().Get("Access-Control-Allow-Headers") != "Authorization") {
+			t.Errorf("expected the allowed methods and headers in the preflight response, got %v", w.Header())
+		}
+	}
+
+	h = newCORS([]string{"*"}).wrap(http.HandlerFunc(healthz))
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	r.Header.Set("Origin", "https://any.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://any.example.com" {
+		t.Errorf("expected the origin of the request echoed back, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("expected no credentials for the wildcard, got %q", got)
+	}
+
+	h = newCORS([]string{"*", "https://app.example.com"}).wrap(http.HandlerFunc(healthz))
+	for origin, creds := range map[string]string{"https://app.example.com": "true", "https://any.example.com": ""} {
+		r := httptest.NewRequest("GET", "/healthz", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != creds {
+			t.Errorf("%s: expected credentials %q, got %q", origin, creds, got)
+		}
+	}
+}
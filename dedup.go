@@ -0,0 +1,78 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// bodies keeps a single copy of the identical bodies of cached pages,
+// shared by the shards of a cache.
+type bodies struct {
+	mux    sync.Mutex
+	bodies map[[sha256.Size]byte]*body
+	// saved is the size of the copies not kept
+	saved int64
+}
+
+// body is a page body referenced by refs entries.
+type body struct {
+	store *bodies
+	sum   [sha256.Size]byte
+	data  []byte
+	refs  int
+}
+
+func newBodies() *bodies {
+	return &bodies{bodies: make(map[[sha256.Size]byte]*body)}
+}
+
+// intern returns the shared body with the same contents as data, adding it
+// if it is the first.
+func (b *bodies) intern(data []byte) *body {
+	sum := sha256.Sum256(data)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	bd, ok := b.bodies[sum]
+	if !ok {
+		bd = &body{store: b, sum: sum, data: data}
+		b.bodies[sum] = bd
+	} else {
+		b.saved += int64(len(data))
+	}
+	bd.refs++
+	return bd
+}
+
+// release drops a reference to bd, forgetting it after the last one.
+func (bd *body) release() {
+	b := bd.store
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	bd.refs--
+	if bd.refs > 0 {
+		b.saved -= int64(len(bd.data))
+		return
+	}
+	delete(b.bodies, bd.sum)
+}
+
+// savings returns the number of bodies kept and the size of the copies
+// not kept.
+func (b *bodies) savings() (int, int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.bodies), b.saved
+}
+
+// share replaces the body of ce with the copy shared with identical ones.
+func (ce *entry) share(b *bodies) {
+	if b == nil || ce.err != nil || ce.file != "" || len(ce.data) == 0 {
+		return
+	}
+	ce.shared = b.intern(ce.data)
+	ce.data = ce.shared.data
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	const empty = "no results"
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, empty)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.dedup = true
+		cf.shards = 2
+	})
+	c := o.cache
+	var datas [][]byte
+	for _, q := range []string{"cranes", "forklifts", "tractors"} {
+		qr := newQuery(q, nil, nil)
+		if _, err := c.get(qr, 0); err != nil {
+			t.Fatal(err)
+		}
+		p, err := c.get(qr, 0)
+		if err != nil || !p.cached || string(p.body) != empty {
+			t.Fatalf("expected the cached body for %s, got %q (%v)", q, p.body, err)
+		}
+		datas = append(datas, p.body)
+	}
+	if &datas[0][0] != &datas[1][0] || &datas[1][0] != &datas[2][0] {
+		t.Error("expected the pages to share their body")
+	}
+	st, err := c.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SharedBodies != 1 || st.Deduped != 2*int64(len(empty)) {
+		t.Errorf("expected 1 body and %d bytes saved, got %d and %d", 2*len(empty), st.SharedBodies, st.Deduped)
+	}
+	for _, q := range []string{"cranes", "forklifts"} {
+		if _, err := c.purge(group(q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, saved := c.bodies.savings(); n != 1 || saved != 0 {
+		t.Errorf("expected the body kept for the last page, got %d bodies, %d bytes saved", n, saved)
+	}
+	if _, err := c.purge("tractors"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.bodies.savings(); n != 0 {
+		t.Errorf("expected no bodies left, got %d", n)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// pageFiles matches the names of the files of page bodies.
+const pageFiles = "page-*"
+
+// store moves the body of p to a new file in dir.
+func (p *page) store(dir string) error {
+	f, err := os.CreateTemp(dir, pageFiles)
+	if err != nil {
+		return fmt.Errorf("cannot create page file: %s", err)
+	}
+	_, err = f.Write(p.body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("cannot write page file: %s", err)
+	}
+	p.file = f.Name()
+	p.body = nil
+	return nil
+}
+
+// load returns p with the body read back from its file, which is removed.
+func (p *page) load() (*page, error) {
+	body, err := os.ReadFile(p.file)
+	os.Remove(p.file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read page file: %s", err)
+	}
+	lp := *p
+	lp.body, lp.file = body, ""
+	return &lp, nil
+}
+
+// contents returns the uncompressed body of p, reading it from its file or
+// waiting for its fetch to end if needed.
+func (p *page) contents() ([]byte, error) {
+	if p.stream != nil {
+		return io.ReadAll(p.stream.reader(context.Background()))
+	}
+	if p.file == "" {
+		return p.uncompressed()
+	}
+	body, err := os.ReadFile(p.file)
+	if err != nil {
+		return nil, fmt.Errorf("page no longer cached: %s", err)
+	}
+	fp := *p
+	fp.body, fp.file = body, ""
+	return fp.uncompressed()
+}
+
+// release removes the file of ce, if any, once it is no longer cached, and
+// drops its reference to a shared body.
+func (ce *entry) release() {
+	if ce.file != "" {
+		os.Remove(ce.file)
+	}
+	if ce.shared != nil {
+		ce.shared.release()
+		ce.shared = nil
+	}
+}
+
+// removeFiles removes the files of the entries kept on disk.
+func (e *entries) removeFiles() {
+	for _, ents := range e.ents {
+		for _, ce := range ents {
+			if ce.file != "" {
+				os.Remove(ce.file)
+			}
+		}
+	}
+}
+
+// cleanDiskDir removes the page files left in dir by an earlier run and
+// returns how many there were.
+func cleanDiskDir(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, pageFiles))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return 0, fmt.Errorf("cannot remove page file: %s", err)
+		}
+	}
+	return len(files), nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// record is the serialized form of a cached page.
+type record struct {
+	Group      string
+	Offset     int
+	Deadline   time.Time
+	Fetched    time.Time
+	OriginAge  time.Duration
+	Size       int
+	Gzipped    bool
+	Data       []byte
+	Normalized []byte
+	ETag       string
+	Modified   time.Time
+	OriginTag  string
+	Type       string
+	Code       int
+	Tenant     string
+	// file holds Data for entries kept on disk
+	file string
+}
+
+func newRecord(cg group, n offset, ce *entry) *record {
+	return &record{
+		Group:      string(cg),
+		Offset:     int(n),
+		Deadline:   ce.deadline,
+		Fetched:    ce.fetched,
+		OriginAge:  ce.originAge,
+		Size:       ce.size,
+		Gzipped:    ce.gzipped,
+		Data:       ce.data,
+		Normalized: ce.normalized,
+		ETag:       ce.etag,
+		Modified:   ce.lastModified,
+		OriginTag:  ce.originTag,
+		Type:       ce.ctype,
+		Code:       ce.code,
+		Tenant:     ce.tenant,
+		file:       ce.file,
+	}
+}
+
+func (r *record) entry() *entry {
+	return &entry{
+		deadline:     r.Deadline,
+		fetched:      r.Fetched,
+		originAge:    r.OriginAge,
+		data:         r.Data,
+		size:         r.Size,
+		gzipped:      r.Gzipped,
+		normalized:   r.Normalized,
+		etag:         r.ETag,
+		lastModified: r.Modified,
+		originTag:    r.OriginTag,
+		ctype:        r.Type,
+		code:         r.Code,
+		tenant:       r.Tenant,
+	}
+}
+
+// export writes all cached pages to w as a stream of gob encoded records.
+func (c *cache) export(w io.Writer) (int, error) {
+	var recs []*record
+	for _, s := range c.shards {
+		srecs, err := s.records()
+		if err != nil {
+			return 0, err
+		}
+		recs = append(recs, srecs...)
+	}
+	enc := gob.NewEncoder(w)
+	for i := range recs {
+		if recs[i].file != "" {
+			// Imported as an in-memory entry
+			data, err := os.ReadFile(recs[i].file)
+			if err != nil {
+				// Removed since it was collected
+				continue
+			}
+			recs[i].Data = data
+		}
+		if err := enc.Encode(recs[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(recs), nil
+}
+
+// records returns the records of the pages cached in shard c.
+func (c *cache) records() ([]*record, error) {
+	var recs []*record
+	err := c.call(func() error {
+		for cg, ents := range c.entries.ents {
+			for n, ce := range ents {
+				if ce.err != nil {
+					continue
+				}
+				recs = append(recs, newRecord(cg, n, ce))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// load reads records written by export from r. Expired records and records
+// older than the entries already cached are skipped. Like put, load evicts
+// the least recently used groups to keep the cache within its limits.
+func (c *cache) load(r io.Reader) (int, error) {
+	var recs []*record
+	dec := gob.NewDecoder(r)
+	for {
+		rec := &record{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		recs = append(recs, rec)
+	}
+	shards := make(map[*cache][]*record)
+	for _, rec := range recs {
+		s := c.shard(group(rec.Group))
+		shards[s] = append(shards[s], rec)
+	}
+	var loaded int
+	for s, srecs := range shards {
+		n, err := s.insert(srecs)
+		if err != nil {
+			return loaded, err
+		}
+		loaded += n
+	}
+	return loaded, nil
+}
+
+// insert caches the records in shard c, like load.
+func (c *cache) insert(recs []*record) (int, error) {
+	var loaded int
+	err := c.call(func() error {
+		now := time.Now()
+		for _, rec := range recs {
+			cg, n, ce := group(rec.Group), offset(rec.Offset), rec.entry()
+			if ce.invalid(now) {
+				continue
+			}
+			if old, ok := c.entries.get(cg, n); ok && !old.deadline.Before(ce.deadline) {
+				continue
+			}
+			if max := c.config.maxMemory; max > 0 && ce.memSize() > max {
+				continue
+			}
+			// Recently used for eviction, as if just fetched
+			ce.accessed = now
+			c.add(cg, n, ce)
+			c.waits.done(cg, n, nil)
+			loaded++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return loaded, nil
+}
+
+// save exports the cache to the file path, replacing it only once written.
+func (c *cache) save(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot save cache: %s", err)
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	n, err := c.export(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save cache to %s: %s", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("cannot save cache: %s", err)
+	}
+	c.debug("saved %d entries to %s", n, path)
+	return nil
+}
+
+// restore loads the cache saved to the file path, if any. An unreadable
+// file is ignored: the cache starts empty.
+func (c *cache) restore(path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("cannot restore cache", "file", path, "err", err)
+		return
+	}
+	defer f.Close()
+	n, err := c.load(bufio.NewReader(f))
+	if err != nil {
+		slog.Warn("cannot restore cache", "file", path, "err", err)
+		return
+	}
+	c.debug("restored %d entries from %s", n, path)
+}
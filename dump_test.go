@@ -0,0 +1,245 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func post(h http.Handler, path string, body []byte, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestExportImport(t *testing.T) {
+	admin := func(cf *config) { cf.adminToken = "secret" }
+	src := newUpstream(t, nil)
+	_, hs := newTestOrigin(t, src, admin)
+	for n := 0; n < 3; n++ {
+		serve(hs, fmt.Sprintf("/test/search/cranes/%d", n))
+	}
+	w := serve(hs, "/_/test/export", "X-Admin-Token", "secret")
+	if w.Code != 200 {
+		t.Fatalf("export failed: %d %s", w.Code, w.Body)
+	}
+	dump := w.Body.Bytes()
+
+	dst := newUpstream(t, nil)
+	_, hd := newTestOrigin(t, dst, admin)
+	if w := post(hd, "/_/test/import", dump, "X-Admin-Token", "secret"); w.Body.String() != "3 entries imported\n" {
+		t.Fatalf("import failed: %d %s", w.Code, w.Body)
+	}
+	for n := 0; n < 3; n++ {
+		w := serve(hd, fmt.Sprintf("/test/search/cranes/%d", n))
+		want := fmt.Sprintf("q=cranes&of=%d", n*10)
+		if w.Body.String() != want || w.Header().Get("X-From-Cache") != "1" {
+			t.Errorf("page %d: expected a hit for %q, got %q", n, want, w.Body)
+		}
+	}
+	if n := dst.total(); n != 0 {
+		t.Errorf("expected no upstream requests after the import, got %d", n)
+	}
+}
+
+func TestExportImportToken(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, nil)
+	if w := serve(h, "/_/test/export"); w.Code != 404 {
+		t.Errorf("without a token the export should not exist, got %d", w.Code)
+	}
+	_, h = newTestOrigin(t, u, func(cf *config) { cf.adminToken = "secret" })
+	for _, token := range []string{"", "wrong"} {
+		if w := serve(h, "/_/test/export", "X-Admin-Token", token); w.Code != 403 {
+			t.Errorf("token %q: expected export to be forbidden, got %d", token, w.Code)
+		}
+		if w := post(h, "/_/test/import", nil, "X-Admin-Token", token); w.Code != 403 {
+			t.Errorf("token %q: expected import to be forbidden, got %d", token, w.Code)
+		}
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) { cf.adminToken = "secret" })
+	for n := 0; n < 10; n++ {
+		serve(h, fmt.Sprintf("/test/search/q%d", n))
+	}
+	var dump bytes.Buffer
+	if _, err := o.cache.export(&dump); err != nil {
+		t.Fatal(err)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body of the import is bounded by its own limit
+	_, hs := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.adminToken = "secret"
+		cf.maxImport = int64(dump.Len() / 2)
+	})
+	if w := post(hs, "/_/test/import", dump.Bytes(), "X-Admin-Token", "secret"); w.Code != 413 {
+		t.Errorf("expected an oversized import to be rejected, got %d", w.Code)
+	}
+
+	// Imported entries count against the memory limit like fetched ones
+	small, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.maxMemory = st.Mem / 2
+	})
+	if _, err := small.cache.load(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := small.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sst.Mem > st.Mem/2 || sst.Entries == 0 {
+		t.Errorf("expected the import to be trimmed to %d bytes, got %d in %d entries", st.Mem/2, sst.Mem, sst.Entries)
+	}
+}
+
+func TestImportAdmission(t *testing.T) {
+	src, _ := newTestOrigin(t, newUpstream(t, nil), nil)
+	for _, q := range []string{"a", "b", "c"} {
+		if _, err := src.cache.get(newQuery(q, nil, nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dump bytes.Buffer
+	if _, err := src.cache.export(&dump); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.maxGroups = 3
+	})
+	if _, err := o.cache.get(newQuery("old", nil, nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.cache.load(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != 3 {
+		t.Errorf("expected the import to keep 3 groups, got %d pages", st.Entries)
+	}
+	// Imported pages count as just used, the page cached before is evicted
+	if cached(o.cache, newQuery("old", nil, nil), 0) {
+		t.Error("expected the least recently used page to be evicted")
+	}
+}
+
+func TestReplicaWaitsForImport(t *testing.T) {
+	owner, _ := newTestOrigin(t, newUpstream(t, nil), nil)
+	replicaUp := newUpstream(t, nil)
+	replica, _ := newTestOrigin(t, replicaUp, func(cf *config) {
+		cf.readOnly = true
+		cf.replicaWait = time.Second
+	})
+	q := newQuery("cranes", nil, nil)
+	res := make(chan *page)
+	go func() {
+		p, err := replica.cache.get(q, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		res <- p
+	}()
+	eventually(t, func() bool {
+		st, err := replica.cache.stats()
+		return err == nil && st.Waiters == 1
+	})
+	if _, err := owner.cache.get(q, 0); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if _, err := owner.cache.export(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replica.cache.load(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-res; p == nil || string(p.body) != "q=cranes&of=0" {
+		t.Errorf("expected the imported page, got %v", p)
+	}
+	if n := replicaUp.total(); n != 0 {
+		t.Errorf("a replica should never fetch, got %d upstream requests", n)
+	}
+}
+
+func TestReplicaWaitTimeout(t *testing.T) {
+	u := newUpstream(t, nil)
+	replica, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.readOnly = true
+		cf.replicaWait = 20 * time.Millisecond
+		cf.lifetime = 10 * time.Millisecond
+		cf.stale = time.Minute
+	})
+	c := replica.cache
+	q := newQuery("cranes", nil, nil)
+	if _, err := c.get(q, 0); err != errReadOnly {
+		t.Errorf("expected errReadOnly after the wait, got %v", err)
+	}
+	// A stale page is served without waiting for a refresh that cannot come
+	c.put(q.cg, newPage(0, []byte("old")), nil)
+	time.Sleep(20 * time.Millisecond)
+	if p, err := c.get(q, 0); err != nil || p.status != "STALE" {
+		t.Errorf("expected the stale page, got %v, %v", p, err)
+	}
+	st, err := c.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Waiters != 0 {
+		t.Errorf("expected no waiters left, got %d", st.Waiters)
+	}
+	if n := u.total(); n != 0 {
+		t.Errorf("a replica should never fetch, got %d upstream requests", n)
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache")
+	persist := func(cf *config) { cf.cacheFile = file }
+	src := newUpstream(t, nil)
+	o, h := newTestOrigin(t, src, persist)
+	serve(h, "/test/search/cranes/0")
+	serve(h, "/test/search/cranes/1")
+	if err := o.cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst := newUpstream(t, nil)
+	_, h = newTestOrigin(t, dst, persist)
+	for n := 0; n < 2; n++ {
+		w := serve(h, fmt.Sprintf("/test/search/cranes/%d", n))
+		if w.Header().Get("X-From-Cache") != "1" || w.Body.String() != fmt.Sprintf("q=cranes&of=%d", n*10) {
+			t.Errorf("page %d: expected it restored, got %q", n, w.Body)
+		}
+	}
+	if n := dst.total(); n != 0 {
+		t.Errorf("expected no fetches after a restore, got %d", n)
+	}
+	if err := os.WriteFile(file, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, h = newTestOrigin(t, dst, persist)
+	if w := serve(h, "/test/search/cranes"); w.Code != 200 || w.Header().Get("X-From-Cache") != "" {
+		t.Errorf("expected a corrupt file to be ignored, got %d", w.Code)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// evictNotifier returns an eviction hook that posts the group and the
+// reason of each eviction as a form to u.
+func evictNotifier(u string) func(cg group, reason string) {
+	return func(cg group, reason string) {
+		resp, err := http.PostForm(u, url.Values{"group": {string(cg)}, "reason": {reason}})
+		if err != nil {
+			slog.Warn("cannot notify eviction", "group", string(cg), "url", u, "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("eviction notification refused", "group", string(cg), "url", u, "status", resp.Status)
+		}
+	}
+}
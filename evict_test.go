@@ -0,0 +1,238 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictions records the calls of an eviction hook.
+type evictions struct {
+	mux   sync.Mutex
+	calls map[string]int
+}
+
+func newEvictions() *evictions {
+	return &evictions{calls: make(map[string]int)}
+}
+
+func (e *evictions) hook(cg group, reason string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.calls[string(cg)+" "+reason]++
+}
+
+func (e *evictions) snapshot() map[string]int {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	m := make(map[string]int)
+	for k, v := range e.calls {
+		m[k] = v
+	}
+	return m
+}
+
+func (e *evictions) expect(t *testing.T, want map[string]int) {
+	t.Helper()
+	eventually(t, func() bool { return len(e.snapshot()) >= len(want) })
+	// Give duplicate calls a chance to show up
+	time.Sleep(50 * time.Millisecond)
+	got := e.snapshot()
+	if len(got) != len(want) {
+		t.Errorf("got evictions %v, expected %v", got, want)
+	}
+	for k, n := range want {
+		if got[k] != n {
+			t.Errorf("eviction %q: got %d calls, expected %d", k, got[k], n)
+		}
+	}
+}
+
+func TestEvictExpired(t *testing.T) {
+	ev := newEvictions()
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 10 * time.Millisecond
+		cf.gcpause = 10 * time.Millisecond
+		cf.onEvict = ev.hook
+	})
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/b/0")
+	serve(h, "/test/search/b/1")
+	ev.expect(t, map[string]int{"a expiry": 1, "b expiry": 1})
+}
+
+func TestEvictCapacity(t *testing.T) {
+	ev := newEvictions()
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		// Room for a single page like "q=a&of=0"
+		cf.maxMemory = 10
+		cf.onEvict = ev.hook
+	})
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/b")
+	ev.expect(t, map[string]int{"a capacity": 1})
+}
+
+func TestEvictManual(t *testing.T) {
+	ev := newEvictions()
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.adminToken = "secret"
+		cf.onEvict = ev.hook
+	})
+	serve(h, "/test/search/a/0")
+	serve(h, "/test/search/a/1")
+	if w := post(h, "/_/test/purge/a", nil, "X-Admin-Token", "secret"); w.Code != 200 {
+		t.Errorf("purge failed: %d %s", w.Code, w.Body)
+	}
+	if w := post(h, "/_/test/purge/a", nil, "X-Admin-Token", "secret"); w.Code != 404 {
+		t.Errorf("expected a second purge to find nothing, got %d", w.Code)
+	}
+	ev.expect(t, map[string]int{"a manual": 1})
+	if w := serve(h, "/test/search/a/0"); w.Header().Get("X-From-Cache") != "" {
+		t.Error("a purged page should be fetched again")
+	}
+}
+
+func TestPurgeDelete(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) { cf.adminToken = "secret" })
+	del := func(path string) int {
+		r := httptest.NewRequest("DELETE", path, nil)
+		r.Header.Set("X-Admin-Token", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	serve(h, "/test/search/a")
+	if code := del("/test/cache/a"); code != 204 {
+		t.Errorf("expected 204 purging a cached group, got %d", code)
+	}
+	if code := del("/test/cache/a"); code != 404 {
+		t.Errorf("expected 404 purging a group not cached, got %d", code)
+	}
+	serve(h, "/test/search/a")
+	if n := u.count("q=a&of=0"); n != 2 {
+		t.Errorf("expected the purged page to be fetched again, got %d fetches", n)
+	}
+}
+
+func TestPurgeVariants(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.adminToken = "secret"
+		cf.keyHeaders = []string{"Accept-Language"}
+		cf.keyParams = []string{"facet"}
+		cf.shards = 4
+	})
+	for _, lang := range []string{"de", "en"} {
+		serve(h, "/test/search/cranes", "Accept-Language", lang)
+		serve(h, "/test/search/cranes?facet=news", "Accept-Language", lang)
+	}
+	serve(h, "/test/search/cranes")
+	serve(h, "/test/search/cranes2")
+	if w := post(h, "/_/test/purge/cranes", nil, "X-Admin-Token", "secret"); w.Code != 200 {
+		t.Fatalf("purge failed: %d %s", w.Code, w.Body)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != 1 {
+		t.Errorf("expected all the variants of the query to be purged, %d pages left", st.Entries)
+	}
+	if !cached(o.cache, newQuery("cranes2", nil, nil), 0) {
+		t.Error("expected another query to stay cached")
+	}
+}
+
+func TestVariantOf(t *testing.T) {
+	for _, tt := range []struct {
+		cg      group
+		variant bool
+	}{
+		{"c", true},
+		{"c#0123456789abcdef", true},
+		{"c?facet=news", true},
+		{"c!docs", true},
+		{"acme@c", true},
+		{"acme@c#0123456789abcdef?facet=news", true},
+		{"c2", false},
+		{"c%23other", false},
+		{"c%3Fother", false},
+		{"acme@c2", false},
+		{"c%40x@d", false},
+	} {
+		if v := variantOf(tt.cg, "c"); v != tt.variant {
+			t.Errorf("%s: variant is %v, expected %v", tt.cg, v, tt.variant)
+		}
+	}
+}
+
+func TestPurgeTenantVariants(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.adminToken = "secret"
+		cf.tenantHeader = "X-Tenant"
+	})
+	serve(h, "/test/search/cranes", "X-Tenant", "acme")
+	serve(h, "/test/search/cranes")
+	serve(h, "/test/search/cranes%23other")
+	serve(h, "/test/search/cranes%3Fother")
+	if w := post(h, "/_/test/purge/cranes", nil, "X-Admin-Token", "secret"); w.Code != 200 {
+		t.Fatalf("purge failed: %d %s", w.Code, w.Body)
+	}
+	st, err := o.cache.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Entries != 2 {
+		t.Errorf("expected the pages of the tenant purged and other queries kept, %d pages left", st.Entries)
+	}
+	for _, s := range []string{"cranes#other", "cranes?other"} {
+		if !cached(o.cache, newQuery(s, nil, nil), 0) {
+			t.Errorf("expected query %q to stay cached", s)
+		}
+	}
+}
+
+func TestWaitersClear(t *testing.T) {
+	w := newWaiters()
+	a, b := w.wait("a", 0), w.wait("a", 10)
+	other := w.wait("b", 0)
+	w.clear("a")
+	for _, wt := range []*waiter{a, b} {
+		select {
+		case <-wt.ch:
+		default:
+			t.Error("a waiter of the cleared group was not woken up")
+		}
+	}
+	if !w.has("b", 0) || w.has("a", 0) || w.count() != 1 {
+		t.Errorf("expected only the waiter of the other group left, got %d", w.count())
+	}
+	select {
+	case <-other.ch:
+		t.Error("a waiter of another group was woken up")
+	default:
+	}
+}
+
+func TestEvictNotifier(t *testing.T) {
+	got := make(chan string, 1)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got <- r.FormValue("group") + " " + r.FormValue("reason")
+	})
+	evictNotifier(u.URL)("q#1", evictManual)
+	if s := <-got; s != "q#1 manual" {
+		t.Errorf("unexpected notification %q", s)
+	}
+}
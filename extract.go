@@ -0,0 +1,348 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type result struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+}
+
+// extractor turns an upstream body into a list of results.
+type extractor interface {
+	extract(body []byte) ([]result, error)
+}
+
+// node is an element or, if tag is empty, a text node of a parsed HTML document.
+type node struct {
+	tag      string
+	attrs    map[string]string
+	text     string
+	children []*node
+}
+
+func (n *node) contents() string {
+	if n.tag == "" {
+		return n.text
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.contents())
+	}
+	return b.String()
+}
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "link": true, "meta": true, "source": true, "wbr": true,
+}
+
+// parseHTML builds a tree out of a possibly malformed HTML document.
+// Unclosed elements are closed by the first closing tag of an ancestor.
+func parseHTML(body []byte) *node {
+	s := string(body)
+	root := &node{tag: "#document"}
+	stack := []*node{root}
+	for len(s) > 0 {
+		top := stack[len(stack)-1]
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			i = len(s)
+		}
+		if i > 0 {
+			top.children = append(top.children, &node{text: html.UnescapeString(s[:i])})
+			s = s[i:]
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			s = skipPast(s, "-->")
+		case strings.HasPrefix(s, "<!"), strings.HasPrefix(s, "<?"):
+			s = skipPast(s, ">")
+		case strings.HasPrefix(s, "</"):
+			var tag string
+			tag, s = parseName(s[2:])
+			s = skipPast(s, ">")
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].tag == tag {
+					stack = stack[:i]
+					break
+				}
+			}
+		default:
+			var n *node
+			n, s = parseTag(s[1:])
+			if n == nil {
+				// A lone "<" is text
+				top.children = append(top.children, &node{text: "<"})
+				s = s[1:]
+				continue
+			}
+			top.children = append(top.children, n)
+			switch {
+			case n.tag == "script" || n.tag == "style":
+				end := strings.Index(strings.ToLower(s), "</"+n.tag)
+				if end < 0 {
+					end = len(s)
+				}
+				n.children = append(n.children, &node{text: s[:end]})
+				s = skipPast(s[end:], ">")
+			case !voidElements[n.tag]:
+				stack = append(stack, n)
+			}
+		}
+	}
+	return root
+}
+
+func skipPast(s, sep string) string {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return ""
+	}
+	return s[i+len(sep):]
+}
+
+func parseName(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '/' || r == '>' || r == '='
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	return strings.ToLower(s[:i]), s[i:]
+}
+
+// parseTag parses the element starting after "<" in s. It returns nil if
+// s does not start with a tag name.
+func parseTag(s string) (*node, string) {
+	tag, rest := parseName(s)
+	if tag == "" {
+		return nil, "<" + s
+	}
+	n := &node{tag: tag, attrs: make(map[string]string)}
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r/")
+		if rest == "" {
+			return n, rest
+		}
+		if rest[0] == '>' {
+			return n, rest[1:]
+		}
+		var key, val string
+		key, rest = parseName(rest)
+		if key == "" {
+			// Skip a stray character
+			rest = rest[1:]
+			continue
+		}
+		rest = strings.TrimLeft(rest, " \t\n\r")
+		if strings.HasPrefix(rest, "=") {
+			rest = strings.TrimLeft(rest[1:], " \t\n\r")
+			if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+				end := strings.IndexByte(rest[1:], rest[0])
+				if end < 0 {
+					end = len(rest) - 1
+				}
+				val, rest = rest[1:end+1], rest[min(end+2, len(rest)):]
+			} else {
+				end := strings.IndexAny(rest, " \t\n\r>")
+				if end < 0 {
+					end = len(rest)
+				}
+				val, rest = rest[:end], rest[end:]
+			}
+		}
+		n.attrs[key] = html.UnescapeString(val)
+	}
+}
+
+// selector matches elements by tag and class, like "div.result". If attr
+// is set, the value of the matched element is that attribute instead of its text.
+type selector struct {
+	tag   string
+	class string
+	attr  string
+}
+
+func parseSelector(s string) selector {
+	var sel selector
+	s, sel.attr, _ = strings.Cut(s, "@")
+	sel.tag, sel.class, _ = strings.Cut(s, ".")
+	return sel
+}
+
+func (s selector) empty() bool {
+	return s.tag == "" && s.class == ""
+}
+
+func (s selector) match(n *node) bool {
+	if n.tag == "" {
+		return false
+	}
+	if s.tag != "" && n.tag != s.tag {
+		return false
+	}
+	if s.class == "" {
+		return true
+	}
+	for _, c := range strings.Fields(n.attrs["class"]) {
+		if c == s.class {
+			return true
+		}
+	}
+	return false
+}
+
+func (s selector) value(n *node) string {
+	if s.attr == "" {
+		return strings.Join(strings.Fields(n.contents()), " ")
+	}
+	return n.attrs[s.attr]
+}
+
+// find returns the first descendant of n matching s.
+func (s selector) find(n *node) *node {
+	for _, c := range n.children {
+		if s.match(c) {
+			return c
+		}
+		if m := s.find(c); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// findAll returns all the outermost descendants of n matching s.
+func (s selector) findAll(n *node, ns []*node) []*node {
+	for _, c := range n.children {
+		if s.match(c) {
+			ns = append(ns, c)
+			continue
+		}
+		ns = s.findAll(c, ns)
+	}
+	return ns
+}
+
+type htmlExtractor struct {
+	item, title, url, snippet selector
+}
+
+// newHTMLExtractor parses a spec like "item=div.result,title=h3,url=a@href,snippet=p".
+func newHTMLExtractor(spec string) (*htmlExtractor, error) {
+	e := &htmlExtractor{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid extractor selector %q", kv)
+		}
+		sel := parseSelector(v)
+		switch k {
+		case "item":
+			e.item = sel
+		case "title":
+			e.title = sel
+		case "url":
+			e.url = sel
+		case "snippet":
+			e.snippet = sel
+		default:
+			return nil, fmt.Errorf("unknown extractor field %q", k)
+		}
+	}
+	if e.item.empty() {
+		return nil, fmt.Errorf("extractor needs an item selector")
+	}
+	return e, nil
+}
+
+func (e *htmlExtractor) field(s selector, n *node) string {
+	if s.empty() {
+		return ""
+	}
+	if m := s.find(n); m != nil {
+		return s.value(m)
+	}
+	return ""
+}
+
+func (e *htmlExtractor) extract(body []byte) ([]result, error) {
+	doc := parseHTML(body)
+	results := []result{}
+	for _, n := range e.item.findAll(doc, nil) {
+		results = append(results, result{
+			Title:   e.field(e.title, n),
+			URL:     e.field(e.url, n),
+			Snippet: e.field(e.snippet, n),
+		})
+	}
+	return results, nil
+}
+
+// normalize returns the results extracted from body encoded as JSON.
+func normalize(e extractor, body []byte) ([]byte, error) {
+	results, err := e.extract(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract results: %s", err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(results); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// transformer returns the body and content type to cache instead of the
+// ones fetched.
+type transformer func(body []byte, ctype string) ([]byte, string, error)
+
+// extractTransform caches the results extracted by e as JSON.
+func extractTransform(e extractor) transformer {
+	return func(body []byte, ctype string) ([]byte, string, error) {
+		res, err := normalize(e, body)
+		if err != nil {
+			return nil, "", err
+		}
+		return res, "application/json", nil
+	}
+}
+
+// totalParser returns the total number of results reported in an upstream
+// body, if it can find it.
+type totalParser func(body []byte) (int, bool)
+
+// newTotalRegexp returns a totalParser that reads the total from the first
+// group matched by expr.
+func newTotalRegexp(expr string) (totalParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid total expression: %s", err)
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("total expression %q has no group", expr)
+	}
+	return func(body []byte) (int, bool) {
+		m := re.FindSubmatch(body)
+		if m == nil {
+			return 0, false
+		}
+		n, err := strconv.Atoi(string(m[1]))
+		return n, err == nil && n >= 0
+	}, nil
+}
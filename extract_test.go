@@ -0,0 +1,126 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+const resultsHTML = `<!DOCTYPE html>
+<html><head><title>Search</title></head>
+<body>
+<div class="header"><h3>Not a result</h3></div>
+<div class="result first">
+  <h3>Cranes &amp; more</h3>
+  <a href="/cranes">link</a>
+  <p class="snippet">All   the
+  cranes<br> you need</p>
+</div>
+<div class="result"><h3>Forklifts</h3><a href=/forklifts>link</a></div>
+</body></html>`
+
+func TestHTMLExtractor(t *testing.T) {
+	e, err := newHTMLExtractor("item=div.result,title=h3,url=a@href,snippet=p.snippet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := e.extract([]byte(resultsHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []result{
+		{Title: "Cranes & more", URL: "/cranes", Snippet: "All the cranes you need"},
+		{Title: "Forklifts", URL: "/forklifts"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("got %+v, expected %+v", results, expected)
+	}
+}
+
+func TestHTMLExtractorNoResults(t *testing.T) {
+	e, err := newHTMLExtractor("item=li")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := normalize(e, []byte(resultsHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != "[]" {
+		t.Errorf("got %s, expected an empty list", js)
+	}
+}
+
+func TestHTMLExtractorSpec(t *testing.T) {
+	for _, spec := range []string{"", "title=h3", "item", "item=div,color=red"} {
+		if _, err := newHTMLExtractor(spec); err == nil {
+			t.Errorf("spec %q: expected an error", spec)
+		}
+	}
+}
+
+func TestTotalRegexp(t *testing.T) {
+	if _, err := newTotalRegexp(`total: \d+`); err == nil {
+		t.Error("expected an expression without a group to be refused")
+	}
+	parse, err := newTotalRegexp(`"total":\s*(\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := parse([]byte(`{"total": 42, "hits": []}`)); !ok || n != 42 {
+		t.Errorf("expected a total of 42, got %d", n)
+	}
+	if _, ok := parse([]byte(`{"hits": []}`)); ok {
+		t.Error("expected no total")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Query().Get("q") == "broken" {
+			io.WriteString(w, "<p>broken</p>")
+			return
+		}
+		io.WriteString(w, resultsHTML)
+	})
+	e, err := newHTMLExtractor("item=div.result,title=h3,url=a@href")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	extract := extractTransform(e)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.transform = func(body []byte, ctype string) ([]byte, string, error) {
+			atomic.AddInt32(&calls, 1)
+			if bytes.Contains(body, []byte("broken")) {
+				return nil, "", errors.New("cannot transform")
+			}
+			if ctype != "text/html" {
+				t.Errorf("unexpected content type %q", ctype)
+			}
+			return extract(body, ctype)
+		}
+	})
+	exp := `[{"title":"Cranes & more","url":"/cranes","snippet":""},{"title":"Forklifts","url":"/forklifts","snippet":""}]`
+	for i := 0; i < 2; i++ {
+		w := serve(h, "/test/search/cranes")
+		if w.Body.String() != exp || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected page %q of type %q", w.Body, w.Header().Get("Content-Type"))
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected the page to be transformed once, got %d", n)
+	}
+	if w := serve(h, "/test/search/broken"); w.Code != 502 {
+		t.Errorf("expected a failed transform to fail the fetch, got %d", w.Code)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// endpointFails is how many fetches in a row must fail for an endpoint
+	// to be skipped for endpointSkip.
+	endpointFails = 3
+	endpointSkip  = 30 * time.Second
+)
+
+// endpoints tracks the health of the upstream templates of an origin, the
+// main one followed by its fallbacks.
+type endpoints struct {
+	mux   sync.Mutex
+	fails []int
+	// skip holds until when each endpoint is only tried if all others fail
+	skip []time.Time
+}
+
+func newEndpoints(n int) *endpoints {
+	return &endpoints{fails: make([]int, n), skip: make([]time.Time, n)}
+}
+
+// order returns the endpoints to try at t: the healthy ones in their order,
+// then the ones being skipped, in case all of them are down.
+func (e *endpoints) order(t time.Time) []int {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	var ok, skipped []int
+	for i := range e.fails {
+		if t.Before(e.skip[i]) {
+			skipped = append(skipped, i)
+			continue
+		}
+		ok = append(ok, i)
+	}
+	return append(ok, skipped...)
+}
+
+func (e *endpoints) failed(i int, t time.Time) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.fails[i]++
+	if e.fails[i] >= endpointFails {
+		e.skip[i] = t.Add(endpointSkip)
+	}
+}
+
+func (e *endpoints) succeeded(i int) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.fails[i] = 0
+	e.skip[i] = time.Time{}
+}
+
+// fetch gets the page from the first endpoint of the origin that does not
+// fail because of the network or a 5xx.
+func (j *job) fetch() (*page, error) {
+	e := j.cache.endpoints
+	if e == nil || j.res.mode != "" {
+		return j.get(j.res.String())
+	}
+	var (
+		p   *page
+		err error
+	)
+	for _, i := range e.order(time.Now()) {
+		u := j.res.String()
+		if i > 0 {
+			u = j.res.url(j.cache.config.fallbacks[i-1])
+		}
+		p, err = j.get(u)
+		if _, ok := err.(*transientError); !ok {
+			if err == nil {
+				e.succeeded(i)
+			}
+			return p, err
+		}
+		e.failed(i, time.Now())
+		j.debug("%s: %s, trying the next endpoint", j.res, err)
+	}
+	return p, err
+}
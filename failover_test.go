@@ -0,0 +1,54 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	down := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	up := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback")
+	})
+	o, _ := newTestOrigin(t, down, func(cf *config) {
+		cf.retries = 0
+		cf.fallbacks = []string{up.tmpl()}
+	})
+	for i := 0; i < endpointFails+1; i++ {
+		p, err := o.cache.get(newQuery(fmt.Sprintf("q%d", i), nil, nil), 0)
+		if err != nil || string(p.body) != "fallback" {
+			t.Fatalf("expected the page from the fallback, got %v", err)
+		}
+	}
+	if n := down.total(); n != endpointFails {
+		t.Errorf("expected the failing endpoint to be skipped after %d fetches, got %d", endpointFails, n)
+	}
+}
+
+func TestEndpointsOrder(t *testing.T) {
+	now := time.Now()
+	e := newEndpoints(3)
+	for i := 0; i < endpointFails; i++ {
+		e.failed(0, now)
+	}
+	if got := e.order(now); !reflect.DeepEqual(got, []int{1, 2, 0}) {
+		t.Errorf("expected the failing endpoint last, got %v", got)
+	}
+	if got := e.order(now.Add(endpointSkip)); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("expected the endpoint to be tried first again after a while, got %v", got)
+	}
+	e.succeeded(0)
+	if got := e.order(now); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("expected the endpoint to be healthy again, got %v", got)
+	}
+}
@@ -2,38 +2,121 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type offset int
 
 type resource struct {
-	str string
-	cg  group
-	n   offset
+	str      string
+	q        string
+	params   url.Values
+	tenant   string
+	ctx      context.Context
+	cg       group
+	n        offset
+	header   http.Header
+	deadline time.Time
+	cutoff   time.Time
+	// id is the ID of the client request the fetch started for, if any
+	id string
+	// etag and modified are the validators of the cached page, if any,
+	// sent to the upstream to fetch the page only if it changed
+	etag     string
+	modified time.Time
+	// mode is the mode of the query, whose template has no fallbacks
+	mode string
 }
 
-func newResource(tmpl string, cg group, n offset) *resource {
-	return &resource{
-		cg:  cg,
-		n:   n,
-		str: fmt.Sprintf(tmpl, string(cg), n),
+// conditional reports whether the fetch of r revalidates a cached page.
+func (r *resource) conditional() bool {
+	return r.etag != "" || !r.modified.IsZero()
+}
+
+func newResource(tmpl string, q *query, n offset) *resource {
+	r := &resource{
+		cg:       q.cg,
+		n:        n,
+		q:        q.q,
+		params:   q.params,
+		tenant:   q.tenant,
+		ctx:      q.ctx,
+		header:   q.header,
+		deadline: q.deadline,
+		cutoff:   q.cutoff,
+		id:       q.id,
+		mode:     q.mode,
+	}
+	r.str = r.url(tmpl)
+	return r
+}
+
+// url returns the URL of r on the upstream of template tmpl.
+func (r *resource) url(tmpl string) string {
+	str := fmt.Sprintf(tmpl, escapeQuery(tmpl, r.q), r.n)
+	if len(r.params) > 0 {
+		sep := "?"
+		if strings.Contains(str, "?") {
+			sep = "&"
+		}
+		str += sep + r.params.Encode()
+	}
+	return str
+}
+
+// escapeQuery escapes q for the place of the query in template tmpl: in
+// the query string or in the path.
+func escapeQuery(tmpl, q string) string {
+	if i := strings.Index(tmpl, "?"); i >= 0 && i < strings.Index(tmpl, "%s") {
+		// Spaces as %20 rather than +, which not all upstreams decode
+		return strings.ReplaceAll(url.QueryEscape(q), "+", "%20")
 	}
+	return url.PathEscape(q)
+}
+
+// context returns the context of the request for r: it ends after timeout or
+// at the deadline set by the client, whichever comes first. The wait deadline
+// of the proxy does not end it, so that the page is cached for the next
+// clients even if the current one stopped waiting.
+func (r *resource) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	parent := r.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	d := r.cutoff
+	if timeout > 0 && (d.IsZero() || time.Now().Add(timeout).Before(d)) {
+		d = time.Now().Add(timeout)
+	}
+	if d.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, d)
+}
+
+// gone reports whether the client that requested r went away.
+func (r *resource) gone() bool {
+	return r.ctx != nil && r.ctx.Err() == context.Canceled
 }
 
 func (r *resource) String() string {
 	return r.str
 }
 
-func (r *resource) cache(c *cache, body []byte, err error) {
-	c.put(r.cg, newPage(r.n, body), err)
+func (r *resource) cache(c *cache, p *page, err error) {
+	c.put(r.cg, p, err)
 }
 
 type job struct {
@@ -45,42 +128,431 @@ func newJob(r *resource, c *cache) *job {
 	return &job{res: r, cache: c}
 }
 
-func (j *job) get() ([]byte, error) {
+// doer sends requests to the upstream, usually an *http.Client.
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// upstreamError is the response of the upstream to a fetch that failed on
+// its side. Pages answered with other statuses are cached as they are.
+type upstreamError struct {
+	url    string
+	status string
+	code   int
+	// body is the start of the body of the response
+	body []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("cannot GET %s: %s", e.url, e.status)
+}
+
+// upstreamErrorBody is how much of the body of a failed response is kept.
+const upstreamErrorBody = 4096
+
+// newUpstreamClient returns the client shared by the requests of a cache
+// to the upstream, to reuse their connections.
+func newUpstreamClient(cf *config) *http.Client {
 	tr := &http.Transport{
-		MaxIdleConns:    10,               // TODO: not hardcoded
-		IdleConnTimeout: 30 * time.Second, // TODO: not hardcoded
+		MaxIdleConns:        cf.maxIdleConns,
+		MaxIdleConnsPerHost: cf.maxIdlePerHost,
+		MaxConnsPerHost:     cf.maxConnsPerHost,
+		IdleConnTimeout:     cf.idleTimeout,
+	}
+	return &http.Client{Transport: tr}
+}
+
+// get fetches the page from url u.
+func (j *job) get(u string) (*page, error) {
+	ctx, cancel := j.res.context(j.cache.config.fetchTimeout)
+	defer cancel()
+	stop := context.AfterFunc(j.cache.parent.stopped, cancel)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for %s: %s", u, err)
+	}
+	for k, v := range j.res.header {
+		req.Header[k] = v
+	}
+	j.cache.config.setUserAgent(req)
+	j.res.tag(req)
+	if j.res.etag != "" {
+		req.Header.Set("If-None-Match", j.res.etag)
+	} else if !j.res.modified.IsZero() {
+		req.Header.Set("If-Modified-Since", j.res.modified.UTC().Format(http.TimeFormat))
+	}
+	if s := j.cache.config.signer; s != nil {
+		if err := s.sign(req); err != nil {
+			return nil, fmt.Errorf("cannot sign request for %s: %s", u, err)
+		}
+	}
+	resp, err := j.cache.client.Do(req)
+	if err != nil && j.res.gone() {
+		return nil, errGone
 	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Get(j.res.String())
 	if err != nil {
-		return nil, fmt.Errorf("cannot GET %s: %s", j.res, err)
+		return nil, transient(ctx, fmt.Errorf("cannot GET %s: %s", u, err))
 	}
 	defer resp.Body.Close()
-	buf := &bytes.Buffer{}
-	_, err = io.Copy(buf, resp.Body)
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "") {
+		return nil, &rateLimitError{parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), time.Second)}
+	}
+	if resp.StatusCode >= 500 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, upstreamErrorBody))
+		return nil, &transientError{&upstreamError{url: u, status: resp.Status, code: resp.StatusCode, body: body}}
+	}
+	if j.res.conditional() {
+		if resp.StatusCode == http.StatusNotModified {
+			atomic.AddUint64(&j.cache.metrics.revalidated, 1)
+			p := newPage(j.res.n, nil)
+			p.notModified = true
+			j.freshness(p, resp)
+			return p, nil
+		}
+		atomic.AddUint64(&j.cache.metrics.refetched, 1)
+	}
+	var s *stream
+	if j.cache.config.stream && j.cache.config.transform == nil {
+		s = newStream(resp.Header.Get("Content-Type"), resp.StatusCode)
+		j.cache.streaming(j.res.cg, j.res.n, s)
+	}
+	body, err := j.read(ctx, u, resp, s)
+	if s != nil {
+		// The clients reading a body that failed get an error, and it is not cached
+		s.close(err)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot copy data from %s: %s", j.res, err)
+		return nil, err
+	}
+	p := newPage(j.res.n, body)
+	p.ctype = resp.Header.Get("Content-Type")
+	p.code = resp.StatusCode
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		p.lastModified = t
+	}
+	p.originTag = resp.Header.Get("ETag")
+	j.freshness(p, resp)
+	return p, nil
+}
+
+// freshness sets when p was fetched with resp and for how long it can be cached.
+func (j *job) freshness(p *page, resp *http.Response) {
+	p.fetched = time.Now()
+	p.originAge = parseAge(resp.Header.Get("Age"))
+	if h := j.cache.config.ttlHeader; h != "" {
+		if n, err := strconv.ParseInt(resp.Header.Get(h), 10, 64); err == nil && n > 0 {
+			p.ttl = time.Duration(n) * time.Second
+		}
+	}
+	if j.cache.config.cacheControl && p.ttl == 0 {
+		p.ttl, p.noStore = freshness(resp.Header, p.fetched)
+	}
+}
+
+// read reads the body of resp from u, writing it to s as well if not nil.
+func (j *job) read(ctx context.Context, u string, resp *http.Response, s *stream) ([]byte, error) {
+	max := j.cache.config.maxBody
+	r, err := limitBody(u, resp, max)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if s != nil {
+		_, err = io.Copy(s, r)
+		body = s.bytes()
+	} else {
+		buf := &bytes.Buffer{}
+		_, err = io.Copy(buf, r)
+		body = buf.Bytes()
+	}
+	if err != nil && j.res.gone() {
+		return nil, errGone
+	}
+	if err != nil {
+		return nil, transient(ctx, fmt.Errorf("cannot copy data from %s: %s", u, err))
+	}
+	if err := checkBody(u, resp, body, max); err != nil {
+		return nil, err
+	}
+	if min := j.cache.config.minBody; resp.StatusCode == http.StatusOK && len(body) < min {
+		// Likely a hiccup of the upstream, not worth caching
+		return nil, &transientError{fmt.Errorf("body from %s too short: %d bytes", u, len(body))}
+	}
+	return body, nil
+}
+
+// limitBody returns a reader of the body of resp from u that stops after
+// max bytes, if max is positive.
+func limitBody(u string, resp *http.Response, max int64) (io.Reader, error) {
+	if max > 0 && resp.ContentLength > max {
+		return nil, fmt.Errorf("body from %s too large: %d bytes", u, resp.ContentLength)
+	}
+	if max <= 0 {
+		return resp.Body, nil
 	}
-	return buf.Bytes(), nil
+	// One more byte to tell a body too large
+	return io.LimitReader(resp.Body, max+1), nil
+}
+
+// checkBody returns an error if body, read from u with limitBody, is too
+// large or shorter than announced by resp.
+func checkBody(u string, resp *http.Response, body []byte, max int64) error {
+	if max > 0 && int64(len(body)) > max {
+		return fmt.Errorf("body from %s too large: more than %d bytes", u, max)
+	}
+	if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+		return &transientError{fmt.Errorf("truncated body from %s: %d of %d bytes", u, len(body), resp.ContentLength)}
+	}
+	return nil
+}
+
+// freshness returns the lifetime set by the Cache-Control or Expires
+// headers in h of a response received at t, zero if there is none. It
+// also reports whether the response cannot be cached at all.
+func freshness(h http.Header, t time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge string
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+			switch strings.ToLower(k) {
+			case "no-store", "no-cache", "private":
+				return 0, true
+			case "max-age":
+				maxAge = v
+			case "s-maxage":
+				sMaxAge = v
+			}
+		}
+	}
+	// As a shared cache, s-maxage takes precedence
+	if sMaxAge != "" {
+		maxAge = sMaxAge
+	}
+	if maxAge != "" {
+		n, err := strconv.ParseInt(strings.Trim(maxAge, `"`), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, n <= 0
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates mean already expired
+			return 0, true
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			t = date
+		}
+		d := exp.Sub(t)
+		return d, d <= 0
+	}
+	return 0, false
+}
+
+// parseAge returns the value of an Age header, or zero if it is invalid.
+func parseAge(s string) time.Duration {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
 }
 
 func (j *job) run() {
-	j.cache.debug("fetch request for %s", j.res)
-	body, err := j.get()
+	j.debug("fetch request for %s", j.res)
+	var (
+		p   *page
+		err error
+	)
+	if j.cache.config.synthetic != nil {
+		p, err = j.cache.config.synthesize(j.res.q, j.res.n)
+		j.finish(p, err)
+		return
+	}
+	err = j.cache.retry(j.debug, j.res.String(), j.ready, func() error {
+		p, err = j.fetch()
+		return err
+	})
+	j.finish(p, err)
+}
+
+// ready returns an error if the fetch of j should not start anymore.
+func (j *job) ready() error {
+	if j.res.gone() {
+		// Queued for a client that went away in the meantime
+		return errGone
+	}
+	return j.waitRate()
+}
+
+// retry calls fetch, retrying it on transient errors and rate limits, as
+// long as the gate and the breaker of the upstream allow it and ready, if
+// set, returns no error. It returns the error of the last attempt.
+func (c *cache) retry(debug func(string, ...interface{}), what string, ready, fetch func() error) error {
+	var err error
+	for i := 0; ; i++ {
+		if d := c.gate.closed(); i == 0 && d > 0 {
+			// Only retries wait for the upstream to accept requests again
+			return &rateLimitError{d}
+		}
+		c.gate.wait()
+		if c.parent.stopped.Err() != nil {
+			return errClosed
+		}
+		if ready != nil {
+			if rerr := ready(); rerr != nil {
+				return rerr
+			}
+		}
+		b := c.breaker
+		if b != nil && !b.allow(time.Now()) {
+			if i == 0 {
+				atomic.AddUint64(&c.metrics.breakerRejects, 1)
+				return errBreakerOpen
+			}
+			// Retries end with the error of the last fetch
+			return err
+		}
+		start := time.Now()
+		err = fetch()
+		c.metrics.fetched(time.Since(start), err)
+		if b != nil && err != errGone && !refused(err) {
+			b.record(err == nil, time.Now())
+		}
+		rerr, limited := err.(*rateLimitError)
+		if limited {
+			c.gate.block(rerr.retry)
+		}
+		if i >= c.config.retries {
+			return err
+		}
+		if limited {
+			debug("%s: %s", what, rerr)
+			continue
+		}
+		if terr, ok := err.(*transientError); ok {
+			d := backoff(c.config.retryBase, i)
+			debug("%s: %s, retry %d in %s", what, terr, i+1, d)
+			time.Sleep(d)
+			continue
+		}
+		return err
+	}
+}
+
+// waitRate waits until the rate limit of the origin allows the fetch. It
+// fails without waiting if the fetch would start after the client deadline.
+func (j *job) waitRate() error {
+	l := j.cache.fetchRate
+	if l == nil {
+		return nil
+	}
+	d, ok := l.reserveBefore(j.res.deadline)
+	if !ok {
+		return errFetchRate
+	}
+	if d <= 0 {
+		return nil
+	}
+	var gone <-chan struct{}
+	if j.res.ctx != nil {
+		gone = j.res.ctx.Done()
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-gone:
+		return errGone
+	}
+}
+
+// finish processes the fetched page p and caches it.
+func (j *job) finish(p *page, err error) {
+	defer atomic.AddInt64(&j.cache.parent.fetching, -1)
+	if err == errGone {
+		j.debug("%s: %s", j.res, err)
+		j.cache.abandon(j.res.cg, j.res.n)
+		return
+	}
+	if err == nil && p.notModified {
+		// The cached body stays as it is
+		p.tenant = j.res.tenant
+		j.res.cache(j.cache, p, nil)
+		return
+	}
+	if rw := j.cache.config.rewriter; err == nil && rw != nil && isHTML(p.contentType()) {
+		p.body = rw.rewrite(p.body)
+		p.size = len(p.body)
+	}
+	if e := j.cache.config.extractor; err == nil && e != nil {
+		var nerr error
+		// Without results the page is still served as it is
+		if p.normalized, nerr = normalize(e, p.body); nerr != nil {
+			j.debug("%s: %s", j.res, nerr)
+		}
+	}
+	if t := j.cache.config.totals; err == nil && t != nil && j.cache.config.incr > 0 {
+		if n, ok := t(p.body); ok {
+			p.pages = (n + j.cache.config.incr - 1) / j.cache.config.incr
+			if p.pages < 1 {
+				// Page zero exists even without results
+				p.pages = 1
+			}
+		}
+	}
+	if tf := j.cache.config.transform; err == nil && tf != nil {
+		var body []byte
+		if body, p.ctype, err = tf(p.body, p.contentType()); err == nil {
+			p.body = body
+			p.size = len(body)
+		}
+	}
+	if err == nil {
+		p.etag = etag(p.body)
+	}
+	if dir := j.cache.config.diskDir; err == nil && !p.noStore && dir != "" && p.size > j.cache.config.diskThreshold {
+		err = p.store(dir)
+	} else if err == nil && j.cache.config.compress {
+		err = p.compress()
+	}
+	if err != nil && !refused(err) {
+		err = fmt.Errorf("cannot fetch URL %s: %w", j.res, err)
+	}
 	if err != nil {
-		err = fmt.Errorf("cannot fetch URL %s: %s", j.res, err)
+		j.debug("%s", err)
+		p = newPage(j.res.n, nil)
 	}
-	j.res.cache(j.cache, body, err)
+	p.tenant = j.res.tenant
+	j.res.cache(j.cache, p, err)
+}
+
+type fetchKey struct {
+	cache *cache
+	cg    group
 }
 
 type fetcher struct {
-	jobs chan *job
+	jobs     chan *job
+	mux      sync.Mutex
+	inflight map[fetchKey]int
+	running  map[*cache]int
+	pending  map[*cache][]*job
+	// parked is the number of pending jobs, bounded by the queue size
+	parked int
+	cond   *sync.Cond
 }
 
 func newFetcher(workers, queue int) *fetcher {
 	f := &fetcher{
-		jobs: make(chan *job, queue),
+		jobs:     make(chan *job, queue),
+		inflight: make(map[fetchKey]int),
+		running:  make(map[*cache]int),
+		pending:  make(map[*cache][]*job),
 	}
+	f.cond = sync.NewCond(&f.mux)
 	for i := 0; i < workers; i++ {
 		go f.run()
 	}
@@ -88,9 +560,84 @@ func newFetcher(workers, queue int) *fetcher {
 }
 
 func (f *fetcher) run() {
-	for job := range f.jobs {
-		job.run()
+	for j := range f.jobs {
+		f.mux.Lock()
+		ok := f.admit(j)
+		for !ok && f.parked >= cap(f.jobs) {
+			// Too many jobs parked: stop taking new ones until some finish
+			f.cond.Wait()
+			ok = f.admit(j)
+		}
+		if !ok {
+			// Parked until another fetch for the same cache finishes
+			f.pending[j.cache.parent] = append(f.pending[j.cache.parent], j)
+			f.parked++
+		}
+		f.mux.Unlock()
+		for ok {
+			j.run()
+			j, ok = f.release(j)
+		}
+	}
+}
+
+// admit marks j as in-flight unless its group or its cache already have
+// the maximum number of fetches running. Must be called with f.mux held.
+func (f *fetcher) admit(j *job) bool {
+	k := fetchKey{j.cache.parent, j.res.cg}
+	cf := j.cache.config
+	if max := cf.maxGroupFetches; max > 0 && f.inflight[k] >= max {
+		return false
+	}
+	if max := cf.fetchLimit(cf.clock()); max > 0 && f.running[j.cache.parent] >= max {
+		return false
+	}
+	f.inflight[k]++
+	f.running[j.cache.parent]++
+	return true
+}
+
+// release marks j as done and admits the first parked job of the same cache, if any.
+func (f *fetcher) release(j *job) (*job, bool) {
+	k := fetchKey{j.cache.parent, j.res.cg}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	defer f.cond.Broadcast()
+	f.inflight[k]--
+	if f.inflight[k] <= 0 {
+		delete(f.inflight, k)
+	}
+	f.running[j.cache.parent]--
+	if f.running[j.cache.parent] <= 0 {
+		delete(f.running, j.cache.parent)
+	}
+	jobs := f.pending[j.cache.parent]
+	for i, next := range jobs {
+		if !f.admit(next) {
+			continue
+		}
+		if len(jobs) == 1 {
+			delete(f.pending, j.cache.parent)
+		} else {
+			f.pending[j.cache.parent] = append(jobs[:i:i], jobs[i+1:]...)
+		}
+		f.parked--
+		return next, true
+	}
+	return nil, false
+}
+
+// groups returns the number of in-flight fetches for each group of c.
+func (f *fetcher) groups(c *cache) map[group]int {
+	m := make(map[group]int)
+	f.mux.Lock()
+	for k, n := range f.inflight {
+		if k.cache == c {
+			m[k.cg] = n
+		}
 	}
+	f.mux.Unlock()
+	return m
 }
 
 func (f *fetcher) request(j *job) {
@@ -0,0 +1,655 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupFairness(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.RawQuery, "q=greedy&") {
+			<-block
+		}
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	t.Cleanup(release)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.maxGroupFetches = 1
+		cf.npref = 8
+	})
+	c := o.cache
+	greedy := make(chan error)
+	go func() {
+		_, err := c.get(newQuery("greedy", nil, nil), 0)
+		greedy <- err
+	}()
+	eventually(t, func() bool { return u.prefixed("q=greedy&") == 1 })
+	for _, q := range []string{"a", "b", "c"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := c.get(newQuery(q, nil, nil), 0); err != nil {
+				t.Error(err)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("query %s starved by the greedy one", q)
+		}
+	}
+	st, err := c.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Fetching["greedy"]; n != 1 {
+		t.Errorf("expected one in-flight fetch for the greedy group, got %d", n)
+	}
+	if n := u.prefixed("q=greedy&"); n != 1 {
+		t.Errorf("expected one greedy upstream request, got %d", n)
+	}
+	release()
+	if err := <-greedy; err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return u.prefixed("q=greedy&") == 8 })
+}
+
+func TestResourceContext(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		deadline time.Duration
+		timeout  time.Duration
+		want     time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Second, time.Second},
+		{time.Minute, 0, time.Minute},
+		{100 * time.Millisecond, time.Second, 100 * time.Millisecond},
+		{time.Minute, time.Second, time.Second},
+	} {
+		res := &resource{}
+		if tt.deadline > 0 {
+			res.cutoff = now.Add(tt.deadline)
+		}
+		ctx, cancel := res.context(tt.timeout)
+		d, ok := ctx.Deadline()
+		cancel()
+		if ok != (tt.want > 0) {
+			t.Errorf("deadline %s, timeout %s: unexpected deadline %v", tt.deadline, tt.timeout, d)
+			continue
+		}
+		if ok && (d.Sub(now) < tt.want || d.Sub(now) > tt.want+time.Second/2) {
+			t.Errorf("deadline %s, timeout %s: got a deadline in %s, expected %s", tt.deadline, tt.timeout, d.Sub(now), tt.want)
+		}
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	elapsed := make(chan time.Duration, 1)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		elapsed <- time.Since(start)
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.fetchTimeout = time.Second
+		cf.timeoutHeader = "X-Request-Timeout-Ms"
+	})
+	serve(h, "/test/search/cranes", "X-Request-Timeout-Ms", "50")
+	if d := <-elapsed; d > 500*time.Millisecond {
+		t.Errorf("the fetch should stop with the client deadline, took %s", d)
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	for _, tmpl := range []string{intergatorTmpl, "http://staging/search?q=%s&of=%d", "http://h/%s/%d"} {
+		if err := checkTemplate(tmpl); err != nil {
+			t.Errorf("%s: %s", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{"", "http://h/?q=%s", "http://h/?of=%d&q=%s", "http://h/?q=%s&of=%d&x=%s", "http://h/?q=%s&of=%d%"} {
+		if err := checkTemplate(tmpl); err == nil {
+			t.Errorf("%q: expected an error", tmpl)
+		}
+	}
+}
+
+func TestLoadOrigins(t *testing.T) {
+	write := func(s string) string {
+		path := filepath.Join(t.TempDir(), "origins.json")
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ocs, err := loadOrigins(write(`[
+		{"name": "web", "tmpl": "http://web/?q=%s&of=%d", "incr": 25, "npref": 0, "ttl": "90s", "hits": 25},
+		{"name": "docs", "tmpl": "http://docs/%s/%d"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := newConfig(intergatorTmpl, 10)
+	web, docs := ocs[0].config(base), ocs[1].config(base)
+	if web.tmpl != "http://web/?q=%s&of=%d" || web.incr != 25 || web.npref != 0 || web.lifetime != 90*time.Second {
+		t.Errorf("unexpected config for web: %s incr %d npref %d lifetime %s", web.tmpl, web.incr, web.npref, web.lifetime)
+	}
+	if web.hits != 25 || docs.hits != 0 {
+		t.Errorf("unexpected hits %d and %d", web.hits, docs.hits)
+	}
+	if docs.incr != base.incr || docs.npref != base.npref || docs.lifetime != base.lifetime || base.tmpl != intergatorTmpl {
+		t.Errorf("expected docs to keep the defaults and base to be unchanged")
+	}
+	for _, s := range []string{
+		`[]`,
+		`[{"name": "a", "tmpl": "http://a/?q=%s"}]`,
+		`[{"name": "a", "tmpl": "http://a/%s/%d"}, {"name": "a", "tmpl": "http://b/%s/%d"}]`,
+		`[{"name": "a/b", "tmpl": "http://a/%s/%d"}]`,
+		`[{"name": "a", "tmpl": "http://a/%s/%d", "npref": -1}]`,
+		`[{"name": "a", "tmpl": "http://a/%s/%d", "hits": -1}]`,
+		`[{"name": "a", "tmpl": "http://a/%s/%d", "ttl": "soon"}]`,
+	} {
+		if _, err := loadOrigins(write(s)); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.incr = 25
+		cf.npref = 1
+	})
+	serve(h, "/test/search/cranes/2")
+	eventually(t, func() bool { return u.total() == 2 })
+	for _, of := range []string{"25", "50"} {
+		if n := u.count("q=cranes&of=" + of); n != 1 {
+			t.Errorf("offset %s: fetched %d times", of, n)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		empty = true
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if r.FormValue("q") == "truncated" {
+			w.Header().Set("Content-Length", "10")
+			io.WriteString(w, "short")
+			return
+		}
+		if !empty {
+			io.WriteString(w, "results")
+		}
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 1
+		cf.retryBase = time.Millisecond
+		cf.negativeTTL = 0
+	})
+	if w := serve(h, "/test/search/cranes"); w.Code != 502 {
+		t.Errorf("expected an empty body to fail the fetch, got %d %q", w.Code, w.Body)
+	}
+	if n := u.count("q=cranes&of=0"); n != 2 {
+		t.Errorf("expected an empty body to be fetched again, got %d fetches", n)
+	}
+	if cached(o.cache, newQuery("cranes", nil, nil), 0) {
+		t.Error("an empty body should not be cached")
+	}
+	mux.Lock()
+	empty = false
+	mux.Unlock()
+	if w := serve(h, "/test/search/cranes"); w.Code != 200 || w.Body.String() != "results" {
+		t.Errorf("expected the page once the upstream recovers, got %d %q", w.Code, w.Body)
+	}
+	if w := serve(h, "/test/search/truncated"); w.Code != 502 {
+		t.Errorf("expected a truncated body to fail the fetch, got %d", w.Code)
+	}
+	if cached(o.cache, newQuery("truncated", nil, nil), 0) {
+		t.Error("a truncated body should not be cached")
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("q") {
+		case "chunked":
+			// Without Content-Length
+			io.WriteString(w, strings.Repeat("x", 30))
+			w.(http.Flusher).Flush()
+			io.WriteString(w, strings.Repeat("x", 30))
+		case "large":
+			io.WriteString(w, strings.Repeat("x", 60))
+		default:
+			io.WriteString(w, strings.Repeat("x", 50))
+		}
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.maxBody = 50
+		cf.retries = 1
+		cf.negativeTTL = 0
+	})
+	for _, q := range []string{"large", "chunked"} {
+		if w := serve(h, "/test/search/"+q); w.Code != http.StatusBadGateway {
+			t.Errorf("%s: expected a body too large to fail the fetch, got %d", q, w.Code)
+		}
+		if cached(o.cache, newQuery(q, nil, nil), 0) {
+			t.Errorf("%s: a body too large should not be cached", q)
+		}
+		if n := u.count("q=" + q + "&of=0"); n != 1 {
+			t.Errorf("%s: expected a body too large not to be fetched again, got %d fetches", q, n)
+		}
+	}
+	if w := serve(h, "/test/search/fits"); w.Code != http.StatusOK || w.Body.Len() != 50 {
+		t.Errorf("expected a body of the largest size to be served, got %d", w.Code)
+	}
+}
+
+func TestUpstreamConnectionReuse(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		addrs = make(map[string]bool)
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		addrs[r.RemoteAddr] = true
+		mux.Unlock()
+		io.WriteString(w, "body")
+	})
+	o, _ := newTestOrigin(t, u, nil)
+	for i := 0; i < 5; i++ {
+		if _, err := o.cache.get(newQuery(fmt.Sprintf("q%d", i), nil, nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(addrs) != 1 {
+		t.Errorf("expected the fetches to share a connection, got %d connections", len(addrs))
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// Dribble the body until the fetch gives up
+		for {
+			if _, err := io.WriteString(w, "."); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.fetchTimeout = 100 * time.Millisecond
+	})
+	start := time.Now()
+	_, err := o.cache.get(newQuery("cranes", nil, nil), 0)
+	if _, ok := err.(*fetchError); !ok {
+		t.Errorf("expected a fetch error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the fetch should time out, took %s", d)
+	}
+	if st, _ := o.cache.stats(); st.Waiters != 0 {
+		t.Errorf("expected the waiters to be released, got %d", st.Waiters)
+	}
+}
+
+func TestQueuedFetchClientGone(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		io.WriteString(w, "body")
+	})
+	t.Cleanup(release)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.maxFetches = 1
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.cache.get(newQuery("a", nil, nil), 0)
+	}()
+	eventually(t, func() bool { return u.total() == 1 })
+	// Queued behind the fetch of a
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	q := newQuery("b", nil, nil)
+	q.ctx = ctx
+	if _, err := o.cache.get(q, 0); err != context.Canceled {
+		t.Errorf("expected the client to give up, got %v", err)
+	}
+	release()
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadUint64(&o.cache.metrics.fetches); n != 1 {
+		t.Errorf("the queued fetch of a client gone should be dropped, got %d fetches", n)
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	canceled := make(chan string, 2)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		of := r.URL.Query().Get("of")
+		select {
+		case <-r.Context().Done():
+			canceled <- of
+		case <-time.After(200 * time.Millisecond):
+			io.WriteString(w, of)
+		}
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.npref = 2
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newQuery("cranes", nil, nil)
+	q.ctx = ctx
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := o.cache.get(q, 0); err != context.Canceled {
+		t.Errorf("expected the request to be canceled, got %v", err)
+	}
+	select {
+	case of := <-canceled:
+		if of != "0" {
+			t.Errorf("only the requested page should be canceled, got offset %s", of)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the fetch of the requested page was not canceled")
+	}
+	// The prefetch continues
+	eventually(t, func() bool { return cached(o.cache, newQuery("cranes", nil, nil), 1) })
+	if cached(o.cache, newQuery("cranes", nil, nil), 0) {
+		t.Error("the abandoned page should not be cached")
+	}
+	// Nothing cached for the abandoned page, it is fetched again
+	if p, err := o.cache.get(newQuery("cranes", nil, nil), 0); err != nil || string(p.body) != "0" {
+		t.Errorf("expected the page to be fetched again, got %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var (
+		mux sync.Mutex
+		got []string
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		got = append(got, r.UserAgent())
+		mux.Unlock()
+		io.WriteString(w, "body")
+	})
+	o, _ := newTestOrigin(t, u, nil)
+	if _, err := o.cache.get(newQuery("cranes", nil, nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{"User-Agent": {"client/1.0"}}
+	if _, err := o.cache.get(newQuery("herons", h, []string{"User-Agent"}), 0); err != nil {
+		t.Fatal(err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"interproxy/" + version, "client/1.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected User-Agent %q, got %q", want, got)
+	}
+}
+
+// doerFunc answers the requests to the upstream without a network.
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFakeClient(t *testing.T) {
+	cf := newConfig("http://upstream.invalid/?q=%s&of=%d", 10)
+	cf.npref = 0
+	cf.retries = 0
+	cf.client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Query().Get("q") {
+		case "down":
+			return nil, errors.New("connection refused")
+		case "broken":
+			w := httptest.NewRecorder()
+			w.WriteHeader(http.StatusInternalServerError)
+			return w.Result(), nil
+		}
+		w := httptest.NewRecorder()
+		io.WriteString(w, "canned "+req.URL.RawQuery)
+		return w.Result(), nil
+	})
+	o := newOrigin("test", newFetcher(4, 20), cf, newLogbuf(100, false))
+	defer o.cache.Close()
+	p, err := o.cache.get(newQuery("cranes", nil, nil), 1)
+	if err != nil || string(p.body) != "canned q=cranes&of=10" {
+		t.Errorf("expected the canned page, got %v", err)
+	}
+	for _, q := range []string{"down", "broken"} {
+		if _, err := o.cache.get(newQuery(q, nil, nil), 0); err == nil {
+			t.Errorf("%s: expected the fetch to fail", q)
+		}
+	}
+}
+
+func TestClientGoneOthersWait(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(200 * time.Millisecond):
+			io.WriteString(w, "body")
+		}
+	})
+	o, _ := newTestOrigin(t, u, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newQuery("cranes", nil, nil)
+	q.ctx = ctx
+	gone := make(chan error)
+	go func() {
+		_, err := o.cache.get(q, 0)
+		gone <- err
+	}()
+	eventually(t, func() bool { return u.total() == 1 })
+	other := newQuery("cranes", nil, nil)
+	other.ctx = context.Background()
+	got := make(chan error)
+	go func() {
+		_, err := o.cache.get(other, 0)
+		got <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-gone; err != context.Canceled {
+		t.Errorf("expected the first client to give up, got %v", err)
+	}
+	if err := <-got; err != nil {
+		t.Errorf("expected the other client to get the page, got %v", err)
+	}
+	select {
+	case <-canceled:
+		t.Error("the fetch was canceled while another client waited for it")
+	default:
+	}
+	if n := u.total(); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	var (
+		mux      sync.Mutex
+		version  = "v1"
+		modified = time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+		conds    []string
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		tag := `"` + version + `"`
+		if r.URL.Query().Get("q") == "dated" {
+			conds = append(conds, r.Header.Get("If-Modified-Since"))
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+			if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(t) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			conds = append(conds, r.Header.Get("If-None-Match"))
+			w.Header().Set("ETag", tag)
+			if r.Header.Get("If-None-Match") == tag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		io.WriteString(w, version)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 20 * time.Millisecond
+	})
+	c := o.cache
+	get := func(s string) string {
+		t.Helper()
+		time.Sleep(30 * time.Millisecond)
+		p, err := c.get(newQuery(s, nil, nil), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(p.body)
+	}
+	for _, s := range []string{"cranes", "dated"} {
+		if body := get(s); body != "v1" {
+			t.Errorf("%s: unexpected body %q", s, body)
+		}
+		if body := get(s); body != "v1" {
+			t.Errorf("%s: expected the revalidated body, got %q", s, body)
+		}
+	}
+	if n := atomic.LoadUint64(&c.metrics.revalidated); n != 2 {
+		t.Errorf("expected 2 revalidations, got %d", n)
+	}
+	mux.Lock()
+	version = "v2"
+	mux.Unlock()
+	if body := get("cranes"); body != "v2" {
+		t.Errorf("expected the modified body, got %q", body)
+	}
+	if n := atomic.LoadUint64(&c.metrics.refetched); n != 1 {
+		t.Errorf("expected a refetch, got %d", n)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	exp := []string{"", `"v1"`, "", "Wed, 01 Mar 2017 10:00:00 GMT", `"v1"`}
+	if !reflect.DeepEqual(conds, exp) {
+		t.Errorf("unexpected conditions %q, expected %q", conds, exp)
+	}
+}
+
+func TestUpstreamClient(t *testing.T) {
+	cf := newConfig(intergatorTmpl, 10)
+	cf.maxIdlePerHost = 32
+	cf.maxConnsPerHost = 64
+	tr := newUpstreamClient(cf).Transport.(*http.Transport)
+	if tr.MaxIdleConns != 100 || tr.MaxIdleConnsPerHost != 32 || tr.MaxConnsPerHost != 64 || tr.IdleConnTimeout != 90*time.Second {
+		t.Errorf("unexpected transport settings %d %d %d %s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.IdleConnTimeout)
+	}
+}
+
+// BenchmarkUpstreamPool measures parallel requests to a single upstream host
+// with few and with enough idle connections kept for each host. The
+// connections opened for each request are reported as conns/op.
+func BenchmarkUpstreamPool(b *testing.B) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Microsecond)
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	srv.Config.ConnState = func(c net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	for _, idle := range []int{2, 64} {
+		b.Run(fmt.Sprintf("idle-%d", idle), func(b *testing.B) {
+			cf := newConfig(srv.URL+"/?q=%s&of=%d", 10)
+			cf.maxIdlePerHost = idle
+			cl := newUpstreamClient(cf)
+			defer cl.CloseIdleConnections()
+			atomic.StoreInt64(&conns, 0)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := cl.Get(srv.URL + "/?q=cranes&of=0")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "boom")
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+	})
+	_, err := o.cache.get(newQuery("cranes", nil, nil), 0)
+	var uerr *upstreamError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an upstream error, got %v", err)
+	}
+	if uerr.code != 500 || string(uerr.body) != "boom" {
+		t.Errorf("unexpected upstream error %d %q", uerr.code, uerr.body)
+	}
+	w := serve(h, "/test/search/forklifts")
+	if w.Code != 502 || w.Header().Get("X-Upstream-Status") != "500" {
+		t.Errorf("expected 502 with the upstream status, got %d %q", w.Code, w.Header().Get("X-Upstream-Status"))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// healthz answers as long as the process serves requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readiness answers whether the server takes new requests: not before the
+// origins are set up, nor once it is shutting down.
+type readiness struct {
+	ready int32
+}
+
+func (rd *readiness) set(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&rd.ready, v)
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&rd.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ready\n")
+}
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string  `json:"version"`
+	Commit    string  `json:"commit,omitempty"`
+	BuildTime string  `json:"build_time,omitempty"`
+	GoVersion string  `json:"go_version"`
+	Uptime    float64 `json:"uptime_seconds"`
+}
+
+// versionHandler serves the build of the binary and how long ago the process
+// started at start. Without commit and build time set at build, they are
+// taken from the version control information of the build, if any.
+func versionHandler(start time.Time) http.HandlerFunc {
+	info := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := info
+		info.Uptime = time.Since(start).Seconds()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	if w := serve(http.HandlerFunc(healthz), "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("healthz: unexpected status %d", w.Code)
+	}
+	rd := &readiness{}
+	for _, tt := range []struct {
+		ready bool
+		code  int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+		{false, http.StatusServiceUnavailable},
+	} {
+		rd.set(tt.ready)
+		if w := serve(rd, "/readyz"); w.Code != tt.code {
+			t.Errorf("ready %v: got %d, expected %d", tt.ready, w.Code, tt.code)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	h := versionHandler(time.Now().Add(-time.Minute))
+	w := serve(h, "/version")
+	var info buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.GoVersion != runtime.Version() {
+		t.Errorf("unexpected build %+v", info)
+	}
+	if info.Uptime < 60 || info.Uptime > 120 {
+		t.Errorf("expected an uptime of a minute, got %gs", info.Uptime)
+	}
+}
@@ -2,14 +2,25 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -30,46 +41,494 @@ func newOrigin(name string, f *fetcher, cf *config, logs *logbuf) *origin {
 }
 
 func (o *origin) handle(w http.ResponseWriter, r *http.Request) {
+	if o.cache.config.sampled(r) {
+		sp := newSpan(w, r, o.logs)
+		defer sp.end()
+		w = sp
+	}
 	vars := mux.Vars(r)
-	cg := group(vars["q"])
-	if cg == "" {
-		http.NotFound(w, r)
+	s, err := pathQuery(r)
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
 		return
 	}
 	n := 0
 	if vars["n"] != "" {
-		m, err := strconv.ParseInt(vars["n"], 10, 64)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+		var err error
+		if n, err = o.parsePage(vars["n"]); err != nil {
+			o.fail(w, r, err.Error(), 400)
+			return
+		}
+	}
+	q, err := o.query(r, s)
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if !o.cache.config.passthrough {
+			w.Header().Set("Allow", "GET, HEAD")
+			o.fail(w, r, "method not allowed", 405)
 			return
 		}
-		n = int(m)
+		o.passthrough(w, r, q, n)
+		return
+	}
+	for _, k := range o.cache.config.keyHeaders {
+		w.Header().Add("Vary", k)
+	}
+	page, err := o.cache.get(q, n)
+	if err != nil {
+		o.failGet(w, r, err)
+		return
+	}
+	if page.stream != nil {
+		o.stream(w, r, page.stream)
+		return
 	}
-	page := o.cache.get(cg, n)
 	if page.cached {
 		w.Header().Set("X-From-Cache", "1")
 	}
+	if page.status != "" {
+		w.Header().Set("X-Cache-Status", page.status)
+	}
+	now := time.Now()
 	w.Header().Set("X-Cached-Until", page.expire.Format(time.RFC3339))
-	if _, err := page.WriteTo(w); err != nil {
-		log.Printf("http: error writing response body: %s", err)
+	switch o.cache.config.expiry {
+	case "unix":
+		setExpiryUnix(w, page)
+	case "maxage":
+		setExpiryMaxAge(w, page, now)
+	case "all":
+		setExpiryUnix(w, page)
+		setExpiryMaxAge(w, page, now)
+	}
+	w.Header().Set("Age", strconv.FormatInt(int64(page.age(now)/time.Second), 10))
+	// Unlike Age, only the time spent in this cache
+	var cacheAge time.Duration
+	if !page.fetched.IsZero() && now.After(page.fetched) {
+		cacheAge = now.Sub(page.fetched)
+	}
+	w.Header().Set("X-Cache-Age", strconv.FormatInt(int64(cacheAge/time.Second), 10))
+	if o.cache.config.compress || o.cache.config.gzip {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if o.cache.config.extractor != nil {
+		w.Header().Add("Vary", "Accept")
+	}
+	var (
+		body    []byte
+		content io.ReadSeeker
+	)
+	size := page.size
+	etag := page.etag
+	if page.normalized != nil && acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		body = page.normalized
+		size = len(body)
+		etag = representationTag(etag, "json")
+	} else if page.gzipped && acceptsGzip(r) {
+		// Send the stored body without decompressing it
+		w.Header().Set("Content-Encoding", "gzip")
+		ctype := []byte(page.ctype)
+		if len(ctype) == 0 {
+			if ctype, err = o.cache.variant(q.cg, page, "type", func() ([]byte, error) {
+				return []byte(page.contentType()), nil
+			}); err != nil {
+				o.fail(w, r, err.Error(), 500)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", string(ctype))
+		body = page.body
+		size = len(body)
+		etag = representationTag(etag, "gzip")
+		// Ranges would apply to the compressed bytes
+		r.Header.Del("Range")
+	} else if page.gzipped {
+		if body, err = o.cache.variant(q.cg, page, "identity", page.uncompressed); err != nil {
+			o.fail(w, r, err.Error(), 500)
+			return
+		}
+	} else if page.file != "" {
+		// Streamed from disk without loading it in memory
+		f, err := os.Open(page.file)
+		if err != nil {
+			o.fail(w, r, fmt.Sprintf("page no longer cached: %s", err), 503)
+			return
+		}
+		defer f.Close()
+		content = f
+	} else if o.cache.config.gzip && acceptsGzip(r) && page.size >= gzipMinSize {
+		if body, err = o.cache.variant(q.cg, page, "gzip", func() ([]byte, error) {
+			return gzipBody(page.body)
+		}); err != nil {
+			o.fail(w, r, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", page.contentType())
+		size = len(body)
+		etag = representationTag(etag, "gzip")
+		r.Header.Del("Range")
+	} else {
+		body = page.body
+	}
+	if content == nil {
+		content = bytes.NewReader(body)
+	}
+	if page.ctype != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", page.ctype)
+	}
+	if !o.cache.config.ranges {
+		r.Header.Del("Range")
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if o.cache.config.http10 && r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		// HTTP/1.0 clients cannot handle chunked encoding
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Header().Set("Connection", "close")
+	}
+	if page.code != 0 && page.code != http.StatusOK {
+		// ServeContent would answer 200 or 206
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.WriteHeader(page.code)
+		if r.Method != "HEAD" {
+			io.Copy(w, content)
+		}
+		return
+	}
+	// ServeContent evaluates Range, If-Range, If-None-Match and, without
+	// If-None-Match, If-Modified-Since against the ETag and the modification
+	// time sent by the upstream, or else the fetch time. The ETag only depends
+	// on the body, so a refresh with the same contents is still answered with
+	// 304 Not Modified.
+	modified := page.fetched
+	if !page.lastModified.IsZero() {
+		modified = page.lastModified
+	}
+	http.ServeContent(w, r, "", modified, content)
+}
+
+// query returns the query s of the client request r.
+func (o *origin) query(r *http.Request, s string) (*query, error) {
+	mode := r.URL.Query().Get(o.cache.config.modeParam)
+	if _, ok := o.cache.config.modes[mode]; mode != "" && !ok {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	q := newQuery(s, r.Header, o.cache.config.keyHeaders)
+	q.normalize(o.cache.config.normalize)
+	q.setParams(r.URL.Query(), o.cache.config.keyParams)
+	q.setHits(o.cache.config.hitsParam, o.cache.config.hits)
+	q.setMode(mode)
+	q.cutoff = clientDeadline(r, o.cache.config.timeoutHeader)
+	q.deadline = q.cutoff
+	q.ctx = r.Context()
+	q.id = requestID(q.ctx)
+	q.refresh = wantsRefresh(r)
+	q.single = !wantsPrefetch(r)
+	// HEAD only tells whether a page is cached, unless configured otherwise
+	q.peek = r.Method == "HEAD" && !o.cache.config.headFetch
+	if d := o.cache.config.requestTimeout; d > 0 {
+		if t := time.Now().Add(d); q.deadline.IsZero() || t.Before(q.deadline) {
+			q.deadline = t
+		}
+	}
+	if h := o.cache.config.tenantHeader; h != "" {
+		q.setTenant(r.Header.Get(h))
+	}
+	return q, nil
+}
+
+// pathQuery returns the query in the path of r. Slashes and other reserved
+// characters in the query are escaped in the path. A blank query is invalid.
+func pathQuery(r *http.Request) (string, error) {
+	s, err := url.PathUnescape(mux.Vars(r)["q"])
+	if err != nil {
+		return "", fmt.Errorf("invalid query: %s", err)
+	}
+	if strings.TrimSpace(s) == "" {
+		return "", errors.New("missing query")
 	}
+	return s, nil
+}
+
+// parsePage returns the number of page s, which cannot be negative nor
+// past the last page that can be fetched.
+func (o *origin) parsePage(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid page number %q", s)
+	}
+	if max := o.cache.config.maxPage; max > 0 && n > max {
+		return 0, fmt.Errorf("page %d is past the last page %d", n, max)
+	}
+	if incr := o.cache.config.incr; incr > 0 && n > math.MaxInt/incr {
+		return 0, fmt.Errorf("page %d is too large", n)
+	}
+	return n, nil
+}
+
+// failGet answers r with the error err returned getting a page from the cache.
+func (o *origin) failGet(w http.ResponseWriter, r *http.Request, err error) {
+	if rerr, ok := err.(*rateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rerr.retry.Seconds()))))
+		o.fail(w, r, err.Error(), 429)
+		return
+	}
+	if _, ok := err.(*fetchError); ok {
+		var uerr *upstreamError
+		if errors.As(err, &uerr) {
+			w.Header().Set("X-Upstream-Status", strconv.Itoa(uerr.code))
+		}
+		o.fail(w, r, err.Error(), 502)
+		return
+	}
+	switch err {
+	case errUnstable:
+		o.fail(w, r, err.Error(), 502)
+	case errTimeout:
+		w.Header().Set("X-Cache-Status", "TIMEOUT")
+		o.fail(w, r, err.Error(), 504)
+	case errUncached:
+		w.Header().Set("X-Cache-Status", "MISS")
+		o.fail(w, r, err.Error(), 404)
+	default:
+		o.fail(w, r, err.Error(), 503)
+	}
+}
+
+// gzipMinSize is the least size of a body worth compressing for a client.
+const gzipMinSize = 256
+
+// representationTag returns the entity tag of a representation of the body tagged etag.
+func representationTag(etag, repr string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + repr + `"`
+}
+
+// clientDeadline returns the earliest of the deadline of the context of r and
+// the one set by the header h in milliseconds, or zero if there is none.
+func clientDeadline(r *http.Request, h string) time.Time {
+	d, _ := r.Context().Deadline()
+	if h == "" {
+		return d
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(h), 10, 64)
+	if err != nil || ms <= 0 {
+		return d
+	}
+	if t := time.Now().Add(time.Duration(ms) * time.Millisecond); d.IsZero() || t.Before(d) {
+		return t
+	}
+	return d
+}
+
+func setExpiryUnix(w http.ResponseWriter, p *page) {
+	w.Header().Set("X-Cached-Until-Unix", strconv.FormatInt(p.expire.Unix(), 10))
+}
+
+// setExpiryMaxAge sends the whole freshness lifetime of p: clients subtract
+// the Age header from it to get the remaining time.
+func setExpiryMaxAge(w http.ResponseWriter, p *page, now time.Time) {
+	secs := int64((p.expire.Sub(now) + p.age(now)) / time.Second)
+	if secs < 0 {
+		secs = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", secs))
+}
+
+// accepts reports whether the comma separated list of values in header h of r
+// includes v with a non-zero quality.
+func accepts(r *http.Request, h, v string) bool {
+	for _, item := range strings.Split(r.Header.Get(h), ",") {
+		val, params, _ := strings.Cut(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(val), v) {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			k, q, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err != nil || f <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func acceptsJSON(r *http.Request) bool {
+	return accepts(r, "Accept", "application/json")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	return accepts(r, "Accept-Encoding", "gzip")
+}
+
+// wantsRefresh reports whether the client asks to fetch the page again
+// instead of getting it from the cache.
+func wantsRefresh(r *http.Request) bool {
+	return r.Header.Get("X-Refresh") == "1" || accepts(r, "Cache-Control", "no-cache")
+}
+
+// wantsPrefetch reports whether the client of r lets the pages around the
+// requested one be fetched, which it can disable with ?prefetch=0 or X-No-Prefetch.
+func wantsPrefetch(r *http.Request) bool {
+	return r.URL.Query().Get("prefetch") != "0" && r.Header.Get("X-No-Prefetch") == ""
 }
 
 func (o *origin) stats(w http.ResponseWriter, r *http.Request) {
-	st := o.cache.stats()
+	st, err := o.cache.stats()
+	if err != nil {
+		o.fail(w, r, err.Error(), 503)
+		return
+	}
 	if err := json.NewEncoder(w).Encode(st); err != nil {
-		http.Error(w, err.Error(), 500)
+		o.fail(w, r, err.Error(), 500)
+	}
+}
+
+// problem is an error response as defined by RFC 7807.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// fail replies to r with an error in the format configured for the origin.
+// Plain text errors are sent as JSON to clients that accept it.
+func (o *origin) fail(w http.ResponseWriter, r *http.Request, detail string, code int) {
+	var ctype string
+	var body interface{}
+	format := o.cache.config.errors
+	if (format == "" || format == "plain") && acceptsJSON(r) {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		ctype = "application/json"
+		body = struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{detail, code}
+	case "problem":
+		ctype = "application/problem+json"
+		body = &problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(code),
+			Status:   code,
+			Detail:   detail,
+			Instance: r.URL.Path,
+		}
+	default:
+		http.Error(w, detail, code)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("cannot write error response", "path", r.URL.Path, "request", requestID(r.Context()), "err", err)
 	}
 }
 
+// admin only lets through requests carrying the admin token of the origin.
+// Without a token the admin endpoints of the origin do not exist.
+func admin(h originHandler) originHandler {
+	return func(o *origin, w http.ResponseWriter, r *http.Request) {
+		if o.cache.config.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(o.cache.config.adminToken)) != 1 {
+			o.fail(w, r, "invalid admin token", 403)
+			return
+		}
+		h(o, w, r)
+	}
+}
+
+func (o *origin) export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	n, err := o.cache.export(w)
+	if err == errClosed {
+		o.fail(w, r, err.Error(), 503)
+		return
+	}
+	if err != nil {
+		slog.Error("cannot export cache", "origin", o.name, "entries", n, "err", err)
+	}
+}
+
+func (o *origin) load(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if max := o.cache.config.maxImport; max > 0 {
+		body = http.MaxBytesReader(w, body, max)
+	}
+	n, err := o.cache.load(body)
+	if err == errClosed {
+		o.fail(w, r, err.Error(), 503)
+		return
+	}
+	var merr *http.MaxBytesError
+	if errors.As(err, &merr) {
+		o.fail(w, r, err.Error(), 413)
+		return
+	}
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
+		return
+	}
+	fmt.Fprintf(w, "%d entries imported\n", n)
+}
+
+// purge removes the pages of a query for all the values of the headers and
+// parameters in the cache key.
+func (o *origin) purge(w http.ResponseWriter, r *http.Request) {
+	s, err := pathQuery(r)
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
+		return
+	}
+	q := newQuery(s, nil, nil)
+	q.normalize(o.cache.config.normalize)
+	found, err := o.cache.purgeVariants(q.cg)
+	if err != nil {
+		o.fail(w, r, err.Error(), 503)
+		return
+	}
+	if found == 0 {
+		o.fail(w, r, "not found", 404)
+		return
+	}
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fmt.Fprintf(w, "%s purged\n", q.cg)
+}
+
 func (o *origin) dumplogs(w http.ResponseWriter, r *http.Request) {
 	if _, err := o.logs.WriteTo(w); err != nil {
-		http.Error(w, err.Error(), 500)
+		o.fail(w, r, err.Error(), 500)
 	}
 }
 
+// origins is the registry of origins served, which can change at any time.
 type origins struct {
-	o map[string]*origin
+	mux sync.RWMutex
+	o   map[string]*origin
 }
 
 func newOrigins() *origins {
@@ -79,15 +538,188 @@ func newOrigins() *origins {
 }
 
 func (ors *origins) add(o *origin) {
+	ors.mux.Lock()
+	defer ors.mux.Unlock()
 	ors.o[o.name] = o
 }
 
+// remove unregisters the origin called name and returns it.
+func (ors *origins) remove(name string) (*origin, bool) {
+	ors.mux.Lock()
+	defer ors.mux.Unlock()
+	o, ok := ors.o[name]
+	delete(ors.o, name)
+	return o, ok
+}
+
+func (ors *origins) get(name string) (*origin, bool) {
+	ors.mux.RLock()
+	defer ors.mux.RUnlock()
+	o, ok := ors.o[name]
+	return o, ok
+}
+
+// list returns the origins sorted by name.
+func (ors *origins) list() []*origin {
+	ors.mux.RLock()
+	list := make([]*origin, 0, len(ors.o))
+	for _, o := range ors.o {
+		list = append(list, o)
+	}
+	ors.mux.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// contentsLimit is the most groups listed by a request of the cache contents.
+const contentsLimit = 1000
+
+// contents lists the groups cached by all origins. A listing longer than
+// the limit continues with the request of the returned "next" as "after".
+func (ors *origins) contents(w http.ResponseWriter, r *http.Request) {
+	limit := contentsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	// Origin names cannot contain a slash
+	afterOrigin, afterGroup, _ := strings.Cut(r.URL.Query().Get("after"), "/")
+	resp := struct {
+		Groups []*groupContents `json:"groups"`
+		Next   string           `json:"next,omitempty"`
+	}{Groups: []*groupContents{}}
+	for _, o := range ors.list() {
+		if o.name < afterOrigin {
+			continue
+		}
+		if len(resp.Groups) == limit {
+			break
+		}
+		var after group
+		if o.name == afterOrigin {
+			after = group(afterGroup)
+		}
+		list, more, err := o.cache.contents(after, limit-len(resp.Groups))
+		if err != nil {
+			http.Error(w, err.Error(), 503)
+			return
+		}
+		for _, gc := range list {
+			gc.Origin = o.name
+		}
+		resp.Groups = append(resp.Groups, list...)
+		if more {
+			break
+		}
+	}
+	if n := len(resp.Groups); n == limit {
+		resp.Next = resp.Groups[n-1].Origin + "/" + resp.Groups[n-1].Group
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// originInfo describes the configuration of an origin.
+type originInfo struct {
+	Name      string   `json:"name"`
+	Template  string   `json:"template"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	PageSize  int      `json:"page_size"`
+	Prefetch  int      `json:"prefetch"`
+	TTL       string   `json:"ttl"`
+	Shards    int      `json:"shards"`
+	Groups    int64    `json:"groups"`
+}
+
+// redactTemplate hides the credentials in the URL template tmpl, if any.
+func redactTemplate(tmpl string) string {
+	i := strings.Index(tmpl, "://")
+	if i < 0 {
+		return tmpl
+	}
+	host := tmpl[i+3:]
+	if j := strings.IndexAny(host, "/?#"); j >= 0 {
+		host = host[:j]
+	}
+	at := strings.LastIndex(host, "@")
+	if at < 0 {
+		return tmpl
+	}
+	return tmpl[:i+3] + "xxxxx" + tmpl[i+3+at:]
+}
+
+// describe serves the configuration of the origins. The number of groups
+// is read without going through the cache goroutines.
+func (ors *origins) describe(w http.ResponseWriter, r *http.Request) {
+	infos := []originInfo{}
+	for _, o := range ors.list() {
+		cf := o.cache.config
+		info := originInfo{
+			Name:     o.name,
+			Template: redactTemplate(cf.tmpl),
+			PageSize: cf.incr,
+			Prefetch: cf.npref,
+			TTL:      cf.lifetime.String(),
+			Shards:   len(o.cache.shards),
+			Groups:   atomic.LoadInt64(&o.cache.metrics.groups),
+		}
+		for _, t := range cf.fallbacks {
+			info.Fallbacks = append(info.Fallbacks, redactTemplate(t))
+		}
+		infos = append(infos, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// close closes the caches of all origins.
+func (ors *origins) close() {
+	ors.mux.RLock()
+	defer ors.mux.RUnlock()
+	for _, o := range ors.o {
+		if err := o.cache.Close(); err != nil {
+			slog.Error("cannot close cache", "origin", o.name, "err", err)
+		}
+	}
+}
+
+type originHandler func(*origin, http.ResponseWriter, *http.Request)
+
+// dispatch serves requests with h for the origin named in the path.
+func (ors *origins) dispatch(h originHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o, ok := ors.get(mux.Vars(r)["name"])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h(o, w, r)
+	}
+}
+
 func (ors *origins) initRouter(r *mux.Router) {
 	r.UseEncodedPath()
-	for k := range ors.o {
-		r.HandleFunc(fmt.Sprintf("/%s/search/{q}", ors.o[k].name), ors.o[k].handle)
-		r.HandleFunc(fmt.Sprintf("/%s/search/{q}/{n}", ors.o[k].name), ors.o[k].handle)
-		r.HandleFunc(fmt.Sprintf("/_/%s/stats", ors.o[k].name), ors.o[k].stats)
-		r.HandleFunc(fmt.Sprintf("/_/%s/logs", ors.o[k].name), ors.o[k].dumplogs)
-	}
+	r.Use(tagRequests)
+	r.HandleFunc("/metrics", ors.metrics)
+	r.HandleFunc("/stats", ors.contents).Methods("GET")
+	r.HandleFunc("/origins", ors.describe).Methods("GET")
+	r.HandleFunc("/{name}/search/{q}", ors.dispatch((*origin).handle))
+	r.HandleFunc("/{name}/search/{q}/{n}", ors.dispatch((*origin).handle))
+	r.HandleFunc("/{name}/search/{q}/range/{from}/{to}", ors.dispatch((*origin).pages)).Methods("GET")
+	r.HandleFunc("/_/{name}/stats", ors.dispatch((*origin).stats))
+	r.HandleFunc("/_/{name}/logs", ors.dispatch((*origin).dumplogs))
+	r.HandleFunc("/_/{name}/export", ors.dispatch(admin((*origin).export))).Methods("GET")
+	r.HandleFunc("/_/{name}/import", ors.dispatch(admin((*origin).load))).Methods("POST")
+	r.HandleFunc("/_/{name}/purge/{q}", ors.dispatch(admin((*origin).purge))).Methods("POST")
+	r.HandleFunc("/{name}/cache/{q}", ors.dispatch(admin((*origin).purge))).Methods("DELETE")
 }
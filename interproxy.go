@@ -0,0 +1,145 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package interproxy caches the pages of paginated search results fetched
+// from upstream servers, prefetching the pages around the requested ones.
+//
+// The interproxy command serves it configured from flags; other programs
+// can embed it with New, adding their origins with Proxy.Add.
+package interproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fetcher runs the fetches of the origins that share it with a fixed number
+// of workers.
+type Fetcher struct {
+	f *fetcher
+}
+
+// NewFetcher starts a fetcher with workers running the fetches and up to
+// queue fetches waiting for a worker.
+func NewFetcher(workers, queue int) *Fetcher {
+	return &Fetcher{f: newFetcher(workers, queue)}
+}
+
+// Options configure a proxy.
+type Options struct {
+	// Fetcher runs the fetches of all the origins; if nil, one with the
+	// workers and queue of the interproxy command is started.
+	Fetcher *Fetcher
+	// Client sends the requests of the origins without their own client to
+	// the upstreams; if nil, each origin has its own.
+	Client *http.Client
+}
+
+// Origin is an upstream whose pages are cached. Fields left zero take the
+// defaults of the interproxy command.
+type Origin struct {
+	// Name is the first element of the paths of the pages of the origin.
+	Name string
+	// Template is the URL of a page of the upstream, with %s for the query
+	// and %d for the offset of the first result in the page.
+	Template string
+	// PageSize is the number of results in each page.
+	PageSize int
+	// Prefetch is how many pages are fetched with each requested one.
+	Prefetch int
+	// Lifetime is how long a page stays cached.
+	Lifetime time.Duration
+	// Client sends the requests to the upstream, instead of the client of
+	// the proxy.
+	Client *http.Client
+}
+
+// Proxy serves the pages of its origins under /{name}/search/{q}, and their
+// stats and admin endpoints, like the interproxy command.
+type Proxy struct {
+	origins *origins
+	fetcher *fetcher
+	client  *http.Client
+	router  *mux.Router
+}
+
+// New returns a proxy without origins.
+func New(opts Options) *Proxy {
+	f := opts.Fetcher
+	if f == nil {
+		f = NewFetcher(10, 20)
+	}
+	p := &Proxy{
+		origins: newOrigins(),
+		fetcher: f.f,
+		client:  opts.Client,
+		router:  mux.NewRouter(),
+	}
+	p.origins.initRouter(p.router)
+	return p
+}
+
+// Add starts caching the pages of origin o, replacing the origin with the
+// same name if any.
+func (p *Proxy) Add(o Origin) error {
+	if o.Name == "" {
+		return errors.New("origin without a name")
+	}
+	if err := checkTemplate(o.Template); err != nil {
+		return fmt.Errorf("origin %s: %s", o.Name, err)
+	}
+	incr := o.PageSize
+	if incr <= 0 {
+		incr = 10
+	}
+	cf := newConfig(o.Template, incr)
+	if o.Prefetch > 0 {
+		cf.npref = o.Prefetch
+	}
+	if o.Lifetime > 0 {
+		cf.lifetime = o.Lifetime
+	}
+	switch {
+	case o.Client != nil:
+		cf.client = o.Client
+	case p.client != nil:
+		cf.client = p.client
+	}
+	old, ok := p.origins.remove(o.Name)
+	p.origins.add(newOrigin(o.Name, p.fetcher, cf, newLogbuf(100, false)))
+	if ok {
+		return old.cache.Close()
+	}
+	return nil
+}
+
+// Remove stops caching the pages of the origin called name.
+func (p *Proxy) Remove(name string) error {
+	o, ok := p.origins.remove(name)
+	if !ok {
+		return fmt.Errorf("unknown origin %q", name)
+	}
+	return o.cache.Close()
+}
+
+// Register adds the routes of the proxy to r, to serve it along with other
+// handlers. Like the router of the proxy, r matches the encoded paths.
+func (p *Proxy) Register(r *mux.Router) {
+	p.origins.initRouter(r)
+}
+
+// ServeHTTP serves the pages of the origins, for example from a path of an
+// http.ServeMux.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.router.ServeHTTP(w, r)
+}
+
+// Close stops all the origins, saving their caches if configured to.
+func (p *Proxy) Close() {
+	p.origins.close()
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProxy(t *testing.T) {
+	u := newUpstream(t, nil)
+	p := New(Options{Fetcher: NewFetcher(2, 10), Client: &http.Client{}})
+	t.Cleanup(p.Close)
+	if err := p.Add(Origin{Name: "test", Template: u.tmpl()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(Origin{Name: "bad", Template: "http://h/?q=%s"}); err == nil {
+		t.Error("expected an origin with an invalid template to be refused")
+	}
+
+	// Mounted on a ServeMux under a prefix
+	sm := http.NewServeMux()
+	sm.Handle("/cache/", http.StripPrefix("/cache", p))
+	for i, cached := range []string{"", "1"} {
+		w := serve(sm, "/cache/test/search/cranes")
+		if w.Code != 200 || w.Body.String() != "q=cranes&of=0" || w.Header().Get("X-From-Cache") != cached {
+			t.Errorf("request %d: unexpected response %d %q", i, w.Code, w.Body)
+		}
+	}
+
+	// Registered on a router along with other routes
+	r := mux.NewRouter()
+	r.HandleFunc("/own", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	p.Register(r)
+	if w := serve(r, "/own"); w.Code != http.StatusTeapot {
+		t.Errorf("expected the routes of the router kept, got %d", w.Code)
+	}
+	if w := serve(r, "/test/search/cranes"); w.Header().Get("X-From-Cache") != "1" {
+		t.Errorf("expected the page cached by the proxy, got %d %q", w.Code, w.Body)
+	}
+
+	if err := p.Remove("test"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/test/search/cranes", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404 for a removed origin, got %d", w.Code)
+	}
+	if n := u.count("q=cranes&of=0"); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverTimeouts bound the phases of client connections, independently of
+// the time spent fetching pages for them. Zero means no limit.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// shutdown stops srv from accepting connections and waits up to wait for the
+// active requests to complete, then closes the caches of ors.
+func shutdown(srv *http.Server, ors *origins, wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	ors.close()
+	return err
+}
+
+// server returns a server for h that applies the timeouts.
+func (st serverTimeouts) server(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: st.readHeader,
+		ReadTimeout:       st.read,
+		WriteTimeout:      st.write,
+		IdleTimeout:       st.idle,
+	}
+}
+
+// limitListener accepts at most a fixed number of simultaneous connections.
+// Accept blocks while the limit is reached, until the listener is closed.
+type limitListener struct {
+	net.Listener
+	sem   chan struct{}
+	max   int
+	conns int64
+	peak  int64
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newLimitListener wraps l; with max zero or less connections are only counted.
+func newLimitListener(l net.Listener, max int) *limitListener {
+	ll := &limitListener{Listener: l, max: max, done: make(chan struct{})}
+	if max > 0 {
+		ll.sem = make(chan struct{}, max)
+	}
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	n := atomic.AddInt64(&l.conns, 1)
+	for {
+		peak := atomic.LoadInt64(&l.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&l.peak, peak, n) {
+			break
+		}
+	}
+	return &limitConn{Conn: c, l: l}, nil
+}
+
+// Close stops accepting connections, also unblocking a pending Accept.
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *limitListener) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func (l *limitListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := struct {
+		Current int64
+		Peak    int64
+		Limit   int
+	}{atomic.LoadInt64(&l.conns), atomic.LoadInt64(&l.peak), l.max}
+	if err := json.NewEncoder(w).Encode(&st); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	l    *limitListener
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.l.conns, -1)
+		c.l.release()
+	})
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimitListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := newLimitListener(l, 1)
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := ll.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	// The limit is reached, Accept blocks until Close
+	errs := make(chan error)
+	go func() {
+		_, err := ll.Accept()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ll.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		io.WriteString(w, "body")
+	})
+	t.Cleanup(release)
+	o, h := newTestOrigin(t, u, nil)
+	ors := newOrigins()
+	ors.add(o)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := newLimitListener(l, 2)
+	srv := &http.Server{Handler: h}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ll)
+	}()
+	// A request in flight during the shutdown is completed
+	resp := make(chan string)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String() + "/test/search/cranes")
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer r.Body.Close()
+		b, _ := io.ReadAll(r.Body)
+		resp <- string(b)
+	}()
+	eventually(t, func() bool { return u.total() == 1 })
+	stopped := make(chan error)
+	go func() {
+		stopped <- shutdown(srv, ors, time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release()
+	if b := <-resp; b != "body" {
+		t.Errorf("the active request should complete, got %q", b)
+	}
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("the listener should be closed")
+	}
+	if _, err := o.cache.get(newQuery("after", nil, nil), 0); err != errClosed {
+		t.Errorf("expected errClosed after shutdown, got %v", err)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serverTimeouts{readHeader: 50 * time.Millisecond}
+	srv := st.server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A client that never finishes sending its headers
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.Copy(io.Discard, conn)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("slow client still connected after %s", d)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	t.Cleanup(release)
+	o, h := newTestOrigin(t, u, nil)
+	ors := newOrigins()
+	ors.add(o)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	go http.Get("http://" + l.Addr().String() + "/test/search/cranes")
+	eventually(t, func() bool { return u.total() == 1 })
+	start := time.Now()
+	if err := shutdown(srv, ors, 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("expected the drain deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %s", d)
+	}
+	if _, err := o.cache.get(newQuery("after", nil, nil), 0); err != errClosed {
+		t.Errorf("expected the caches to be closed anyway, got %v", err)
+	}
+}
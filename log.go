@@ -1,10 +1,11 @@
-package main
+package interproxy
 
 import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,7 +27,7 @@ func newLogbuf(n int, verb bool) *logbuf {
 func (l *logbuf) debug(format string, args ...interface{}) {
 	line := fmt.Sprintf(format, args...)
 	if l.verbose {
-		log.Print("debug: " + line)
+		slog.Debug(line)
 	}
 	l.mux.Lock()
 	l.lines[l.pos] = fmt.Sprintf("%s: %s\n", time.Now().Format(time.RFC3339), line)
@@ -50,3 +51,16 @@ func (l *logbuf) WriteTo(w io.Writer) (int64, error) {
 	l.mux.Unlock()
 	return buf.WriteTo(w)
 }
+
+// parseLogLevel returns the level named s: debug, info, warn or error.
+// Verbose always selects debug.
+func parseLogLevel(s string, verbose bool) (slog.Level, error) {
+	var level slog.Level
+	if verbose {
+		return slog.LevelDebug, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return level, fmt.Errorf("invalid log level %q: %s", s, err)
+	}
+	return level, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		verbose bool
+		level   slog.Level
+	}{
+		{"info", false, slog.LevelInfo},
+		{"DEBUG", false, slog.LevelDebug},
+		{"error", false, slog.LevelError},
+		{"error", true, slog.LevelDebug},
+	} {
+		if level, err := parseLogLevel(tc.s, tc.verbose); err != nil || level != tc.level {
+			t.Errorf("%q verbose %v: got %s, %v, expected %s", tc.s, tc.verbose, level, err, tc.level)
+		}
+	}
+	if _, err := parseLogLevel("loud", false); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -2,62 +2,670 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
 
 import (
 	"flag"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// version, commit and buildTime are set when building a release, with
+// -ldflags "-X github.com/dullgiulio/interproxy.version=..." and the same
+// for commit and buildTime.
+var (
+	version   = "dev"
+	commit    string
+	buildTime string
+)
+
 const intergatorTmpl = "https://search.kuehne-nagel.com/web/ig-kn/?q=%s&of=%d"
 
-func main() {
+// Main runs the interproxy command: it configures the origins from the
+// command line flags and serves them until it is stopped by a signal.
+func Main() {
+	start := time.Now()
 	var (
 		verbose        bool
+		logLevel       string
 		name           string
 		tmpl           string
+		fallbacks      string
 		listen         string
 		nlogs          int
 		incr           int
 		maxmem         int
 		gcpause        int
 		gclifetime     int
+		ttl            time.Duration
 		fetcherPages   int
+		prefetchBehind int
+		prefetchAhead  int
 		fetcherQueue   int
 		fetcherWorkers int
+		fetcherGroup   int
+		maxPage        int
+		lookahead      int
+		stale          int
+		refreshProb    float64
+		sla            int
+		slaRetain      int
+		staleIfError   time.Duration
+		keyHeaders     string
+		keyParams      string
+		hits           int
+		hitsParam      string
+		normalize      string
+		http10         bool
+		compress       bool
+		signKeys       string
+		readOnly       bool
+		replicaWait    int
+		expiry         string
+		fetcherMax     int
+		schedule       string
+		maxConns       int
+		extract        string
+		extractBody    bool
+		totalRegexp    string
+		adminToken     string
+		evictURL       string
+		shutdownWait   int
+		ranges         bool
+		fetchTimeout   int
+		idleConns      int
+		idlePerHost    int
+		connsPerHost   int
+		upstreamIdle   time.Duration
+		validateOnly   bool
+		checkUpstream  bool
+		timeoutHeader  string
+		noPrefetch     string
+		retries        int
+		retryJitter    int
+		retryBase      int
+		pageLifetimes  string
+		coalesce       bool
+		reuseModified  bool
+		revalidate     bool
+		dedup          bool
+		drainWait      time.Duration
+		modes          string
+		modeParam      string
+		maxBytes       int64
+		batchURL       string
+		batchMax       int
+		batchWait      int
+		ttlHeader      string
+		ttlMin         int
+		ttlMax         int
+		cacheControl   bool
+		errorFormat    string
+		prefetchRate   float64
+		fetchRate      float64
+		fetchBurst     int
+		minBody        int
+		maxBody        int64
+		maxImport      int64
+		userAgent      string
+		gzipResponses  bool
+		waitTimeout    int
+		tenantHeader   string
+		tenantEntries  int
+		tenantMem      int
+		variants       int
+		headerTimeout  int
+		readTimeout    int
+		writeTimeout   int
+		idleTimeout    int
+		diskDir        string
+		diskThreshold  int
+		devMode        bool
+		synthetic      string
+		syntheticCache bool
+		webhookURL     string
+		webhookEvents  string
+		webhookBuffer  int
+		traceRatio     float64
+		traceHeader    string
+		passthrough    bool
+		headFetch      bool
+		maxRange       int
+		stream         bool
+		eventQueue     int
+		rewriteFrom    string
+		rewriteTo      string
+		groupExpiry    bool
+		breakerFails   int
+		breakerWindow  int
+		breakerCool    int
+		minFetch       int
+		shards         int
+		refreshEvery   int
+		requestTimeout int
+		negativeTTL    int
+		maxGroups      int
+		sliding        bool
+		slidingMax     int
+		originsFile    string
+		warmupFile     string
+		cacheFile      string
+		tlsCert        string
+		tlsKey         string
+		authFile       string
+		authExempt     string
+		corsOrigins    string
+		accessLogFile  string
+		accessFormat   string
 	)
-	// TODO: Could support multiple caches if it was possible to pass them as args.
-	flag.BoolVar(&verbose, "verbose", false, "Print detailed debug messages")
+	flag.BoolVar(&verbose, "verbose", false, "Print detailed debug messages, like loglevel debug")
+	flag.StringVar(&logLevel, "loglevel", "info", "Least level of the messages printed: debug, info, warn or error")
 	flag.StringVar(&listen, "listen", "0.0.0.0:8383", "Address and port to listen to")
 	flag.StringVar(&name, "name", "intergator", "Cache name; will be shown in URL")
-	flag.StringVar(&tmpl, "tmpl", intergatorTmpl, "URL template") // TODO: For real
-	flag.IntVar(&incr, "incr", 10, "Increment of offset counter for each page")
+	flag.StringVar(&tmpl, "tmpl", intergatorTmpl, "Upstream URL template, with %s for the query and %d for the offset")
+	flag.StringVar(&fallbacks, "fallbacks", "", "Comma separated URL templates of other upstreams, tried in order when fetching from tmpl fails")
+	flag.IntVar(&incr, "incr", 10, "Offset increment for each page, the number of results per page of the upstream")
 	flag.IntVar(&fetcherWorkers, "fworkers", 10, "Fetcher workers parallel routines")
 	flag.IntVar(&fetcherQueue, "fqueue", 20, "Fetcher workers queue size")
+	flag.IntVar(&fetcherMax, "fmax", 0, "Max parallel fetches for the origin, 0 for no limit")
+	flag.StringVar(&schedule, "schedule", "", "Comma separated time windows overriding prefetch and max fetches, like 08:00-18:00=1/2")
+	flag.IntVar(&fetcherGroup, "fgroup", 0, "Max parallel fetches for a single query, 0 for no limit")
 	flag.IntVar(&maxmem, "mem", 256, "Max memory to use for cached entries, in MB") // TODO: Parse size
-	flag.IntVar(&fetcherPages, "npref", 4, "Number of pages to prefetch")
-	flag.IntVar(&gclifetime, "lifetime", 5, "Time an entry is kept in cache, in minutes")     // TODO: Parse time
+	flag.IntVar(&fetcherPages, "npref", 4, "Number of pages to prefetch before and after the requested one, 0 to fetch only the requested page")
+	flag.IntVar(&lookahead, "lookahead", 0, "Number of pages to fetch after the furthest page requested for a query")
+	flag.IntVar(&maxPage, "maxpage", 0, "Last page that can be requested or prefetched, 0 for no limit")
+	flag.IntVar(&gclifetime, "lifetime", 5, "Time an entry is kept in cache, in minutes")
+	flag.DurationVar(&ttl, "ttl", 0, "Time an entry is kept in cache, like 90s or 2h, overriding lifetime")
 	flag.IntVar(&gcpause, "gcpause", 20, "Interval between GC runs in the cache, in seconds") // TODO: Parse time
+	flag.IntVar(&stale, "stale", 0, "Time an expired entry is still served while being refreshed, in seconds")
+	flag.Float64Var(&refreshProb, "refreshprob", 1, "Probability that serving a stale entry triggers its refresh")
+	flag.IntVar(&sla, "sla", 0, "Time to wait for a fetch before serving an expired entry, in milliseconds, 0 to always wait")
+	flag.IntVar(&slaRetain, "slaretain", 300, "Time an expired entry is kept to be served when the SLA is exceeded, in seconds")
+	flag.DurationVar(&staleIfError, "staleiferror", 0, "Time after expiry an entry is served when fetching it again fails, like 10m")
 	flag.IntVar(&nlogs, "nlogs", 100, "Max number of lines of logs to store for each origin")
+	flag.StringVar(&keyHeaders, "keyheaders", "", "Comma separated request headers forwarded upstream and hashed into the cache key")
+	flag.BoolVar(&compress, "compress", false, "Keep cached entries gzip compressed in memory")
+	flag.BoolVar(&http10, "http10", true, "Send Content-Length and close the connection for HTTP/1.0 clients")
+	flag.StringVar(&signKeys, "signkeys", "", "JSON keyset file used to sign upstream requests")
+	flag.BoolVar(&readOnly, "readonly", false, "Never fetch from upstream, only serve pages imported from another instance")
+	flag.IntVar(&replicaWait, "replicawait", 0, "Time to wait for a missing page to be imported in read-only mode, in milliseconds")
+	flag.StringVar(&expiry, "expiry", "rfc3339", "Expiry headers to send besides X-Cached-Until: rfc3339, unix, maxage or all")
+	flag.IntVar(&maxConns, "maxconns", 0, "Max simultaneous client connections, 0 for no limit")
+	flag.StringVar(&totalRegexp, "totalre", "", "Regular expression whose first group matches the total number of results in upstream pages, to prefetch only the pages that exist")
+	flag.StringVar(&extract, "extract", "", "Selectors to serve results as JSON, like item=div.result,title=h3,url=a@href,snippet=p")
+	flag.StringVar(&adminToken, "admintoken", "", "Token to send as X-Admin-Token to export and import the cache, empty to disable them")
+	flag.StringVar(&evictURL, "evicturl", "", "URL notified with a POST of the group and reason of each eviction")
+	flag.IntVar(&shutdownWait, "shutdownwait", 30, "Time to wait for active requests on shutdown, in seconds")
+	flag.BoolVar(&ranges, "ranges", true, "Serve Range and If-Range requests for cached pages")
+	flag.IntVar(&fetchTimeout, "ftimeout", 15, "Max time of an upstream request, in seconds, 0 for no limit")
+	flag.StringVar(&timeoutHeader, "timeoutheader", "", "Request header with the milliseconds a client waits, after which its fetches stop")
+	flag.StringVar(&noPrefetch, "noprefetch", "", "Regular expression matching queries for which only the requested page is fetched")
+	flag.IntVar(&retries, "retries", 2, "Times a fetch rate limited by the upstream, failed on the network or with a 5xx is retried")
+	flag.IntVar(&retryBase, "retrybase", 100, "Wait before retrying a failed fetch, doubled at each retry, in milliseconds")
+	flag.IntVar(&retryJitter, "retryjitter", 1000, "Time to spread the retries of rate limited fetches over, in milliseconds")
+	flag.StringVar(&pageLifetimes, "pagelifetimes", "", "Comma separated lifetimes of the first pages, the last one for all following pages, like 1m,10m")
+	flag.BoolVar(&coalesce, "coalesce", false, "Do not prefetch around pages already being fetched for an earlier request")
+	flag.BoolVar(&reuseModified, "reusemodified", false, "Keep the cached body of refreshed pages with an unchanged Last-Modified")
+	flag.StringVar(&batchURL, "batchurl", "", "URL to POST batches of pages to fetch to, as a JSON list of queries and offsets")
+	flag.IntVar(&batchMax, "batchmax", 10, "Max pages in a batch")
+	flag.IntVar(&batchWait, "batchwait", 10, "Max time to wait for a batch to fill up, in milliseconds")
+	flag.StringVar(&ttlHeader, "ttlheader", "", "Upstream response header with the seconds a page is cached for")
+	flag.IntVar(&ttlMin, "ttlmin", 0, "Min lifetime set by the TTL header, in seconds")
+	flag.IntVar(&ttlMax, "ttlmax", 0, "Max lifetime set by the TTL header, in seconds, 0 for no limit")
+	flag.BoolVar(&cacheControl, "cachecontrol", false, "Take the lifetime of pages from the Cache-Control and Expires headers of the upstream, bounded by ttlmin and ttlmax")
+	flag.StringVar(&errorFormat, "errors", "plain", "Format of error responses: plain (JSON if accepted by the client), json or problem (RFC 7807)")
+	flag.Float64Var(&prefetchRate, "prefetchrate", 0, "Max prefetches started each second, 0 for no limit")
+	flag.Float64Var(&fetchRate, "fetchrate", 0, "Max requests sent to the upstream each second, 0 for no limit")
+	flag.IntVar(&fetchBurst, "fetchburst", 1, "Max requests sent to the upstream at once within fetchrate")
+	flag.StringVar(&tenantHeader, "tenantheader", "", "Request header with the tenant owning the cached pages")
+	flag.IntVar(&tenantEntries, "tenantentries", 0, "Max cached pages for each tenant, 0 for no limit")
+	flag.IntVar(&tenantMem, "tenantmem", 0, "Max memory for the cached pages of each tenant, in MB, 0 for no limit")
+	flag.IntVar(&variants, "variants", 2, "Max representations computed from a page kept with it, 0 to always compute them")
+	flag.IntVar(&headerTimeout, "headertimeout", 10, "Max time to read the headers of a client request, in seconds, 0 for no limit")
+	flag.IntVar(&readTimeout, "readtimeout", 30, "Max time to read a whole client request, in seconds, 0 for no limit")
+	flag.IntVar(&writeTimeout, "writetimeout", 90, "Max time from reading a request to the end of its response, in seconds, 0 for no limit")
+	flag.IntVar(&idleTimeout, "idletimeout", 120, "Max time a keep-alive connection waits for the next request, in seconds, 0 for no limit")
+	flag.StringVar(&diskDir, "diskdir", "", "Directory to keep large page bodies in, streamed from there, empty to keep all in memory")
+	flag.IntVar(&diskThreshold, "diskthreshold", 1024, "Size above which page bodies are kept in diskdir, in KB")
+	flag.BoolVar(&devMode, "dev", false, "Development mode, required for synthetic")
+	flag.StringVar(&synthetic, "synthetic", "", "Template of the pages rendered instead of fetched, with .Query, .Page and .Offset; needs dev")
+	flag.BoolVar(&syntheticCache, "syntheticcache", false, "Cache the synthetic pages like fetched ones")
+	flag.StringVar(&webhookURL, "webhookurl", "", "URL to POST cache events to as JSON, replacing evicturl")
+	flag.StringVar(&webhookEvents, "webhookevents", "evict", "Comma separated events to POST to webhookurl: evict, fill")
+	flag.IntVar(&webhookBuffer, "webhookbuffer", 100, "Max events waiting to be posted to webhookurl, more are dropped")
+	flag.Float64Var(&traceRatio, "traceratio", 0, "Fraction of requests traced in the logs, from 0 to 1")
+	flag.StringVar(&traceHeader, "traceheader", "", "Request header that makes a request always traced")
+	flag.BoolVar(&passthrough, "passthrough", false, "Send requests with other methods than GET and HEAD to the upstream without caching them")
+	flag.IntVar(&shards, "shards", 1, "Number of parts the cache of each origin is split into, to serve unrelated queries in parallel")
+	flag.IntVar(&minFetch, "minfetch", 0, "Least time between two fetches of a query for missing pages, in milliseconds, 0 for no limit")
+	flag.IntVar(&refreshEvery, "refreshinterval", 10, "Least time between two refreshes of a query requested with Cache-Control: no-cache or X-Refresh: 1, in seconds, 0 to ignore them")
+	flag.IntVar(&requestTimeout, "rtimeout", 30, "Max time a client waits for a page before a 504, in seconds, 0 for no limit; the fetch continues to fill the cache")
+	flag.IntVar(&negativeTTL, "negativettl", 5, "Time a failed fetch is cached and its error served, in seconds, 0 to always fetch again")
+	flag.IntVar(&maxGroups, "maxgroups", 0, "Max queries cached, evicting the least recently used ones, 0 for no limit")
+	flag.BoolVar(&sliding, "sliding", false, "Extend the lifetime of an entry each time it is served, instead of a fixed expiry")
+	flag.IntVar(&slidingMax, "slidingmax", 60, "Max time an entry is kept in sliding mode after it was fetched, in minutes")
+	flag.StringVar(&warmupFile, "warmup", "", "File with queries, one per line, whose first page is fetched in the background at startup")
+	flag.StringVar(&originsFile, "config", "", "JSON file with the list of origins to serve, replacing name and tmpl")
+	flag.StringVar(&normalize, "normalize", "", "Comma separated normalizers of queries in the cache key: trim, lower and space to collapse whitespace")
+	flag.StringVar(&keyParams, "keyparams", "", "Comma separated query parameters forwarded upstream and part of the cache key")
+	flag.IntVar(&hits, "hits", 0, "Number of results per page asked to the upstream, 0 for its default")
+	flag.StringVar(&hitsParam, "hitsparam", "hits", "Query parameter of the upstream for the number of results per page")
+	flag.StringVar(&cacheFile, "cachefile", "", "File the cache is saved to on shutdown and restored from on start, with the origin name appended if there are several")
+	flag.StringVar(&tlsCert, "tlscert", "", "Certificate file to serve HTTPS with tlskey, reloaded on SIGHUP")
+	flag.StringVar(&tlsKey, "tlskey", "", "Private key file of tlscert")
+	flag.StringVar(&authFile, "authfile", "", "File with the API keys and user:password pairs allowed to use the proxy, one for each line")
+	flag.StringVar(&authExempt, "authexempt", "/healthz,/readyz,/metrics", "Comma separated paths served without credentials when authfile is set")
+	flag.StringVar(&userAgent, "useragent", "interproxy/"+version, "User-Agent of the requests to the upstream")
+	flag.IntVar(&minBody, "minbody", 1, "Least size of a page fetched with status 200, in bytes, shorter ones are retried and not cached")
+	flag.Int64Var(&maxBody, "maxbody", 10*1024*1024, "Largest size of a page fetched, in bytes, larger ones fail and are not cached; 0 for no limit")
+	flag.BoolVar(&gzipResponses, "gzip", true, "Gzip compress the responses for clients accepting it, if not kept compressed")
+	flag.IntVar(&waitTimeout, "waittimeout", 120, "Time after which the requests waiting for a fetch that did not end fail, in seconds, 0 to wait forever")
+	flag.BoolVar(&headFetch, "headfetch", false, "Fetch the pages not cached for HEAD requests, instead of answering 404 with X-Cache-Status: MISS")
+	flag.StringVar(&corsOrigins, "corsorigins", "", "Comma separated origins allowed to call the proxy from a browser, * for any without credentials; CORS is disabled if empty")
+	flag.IntVar(&maxRange, "maxrange", 10, "Most pages a client can request at once with /{origin}/search/{q}/range/{from}/{to}")
+	flag.IntVar(&breakerFails, "breakerfails", 0, "Failed fetches in a row that stop fetching from the upstream for a while, 0 to always fetch")
+	flag.IntVar(&breakerWindow, "breakerwindow", 10, "Most time between failed fetches counted in a row by the breaker, in seconds")
+	flag.IntVar(&breakerCool, "breakercooldown", 30, "Time after which a fetch probes again an upstream that was down, in seconds")
+	flag.BoolVar(&stream, "stream", false, "Send pages not cached to the clients while they are fetched, without compression, ranges or validators")
+	flag.IntVar(&eventQueue, "eventqueue", 64, "Cache operations queued for each cache goroutine before their callers block")
+	flag.StringVar(&rewriteFrom, "rewritefrom", "", "Base URL of the upstream to replace in the links of HTML pages, nothing is replaced if empty")
+	flag.StringVar(&rewriteTo, "rewriteto", "", "Base path or URL of the proxy replacing rewritefrom in the links of HTML pages")
+	flag.BoolVar(&groupExpiry, "groupexpiry", false, "Expire the pages of a query together with the first one cached, instead of each after its own lifetime")
+	flag.StringVar(&accessLogFile, "accesslog", "", "File to append a line for each request to, - for standard output; disabled if empty")
+	flag.StringVar(&accessFormat, "accessformat", "combined", "Format of the access log: combined or json")
+	flag.IntVar(&prefetchBehind, "prefetchbehind", -1, "Number of pages to prefetch before the requested one, npref if negative")
+	flag.IntVar(&prefetchAhead, "prefetchahead", -1, "Number of pages to prefetch after the requested one, npref-1 if negative")
+	flag.BoolVar(&extractBody, "extractbody", false, "Cache the results of extract as JSON instead of the fetched pages")
+	flag.BoolVar(&revalidate, "revalidate", true, "Fetch expired pages again with If-None-Match or If-Modified-Since, keeping the cached body if not modified")
+	flag.IntVar(&idleConns, "idleconns", 100, "Most idle connections kept open to the upstreams")
+	flag.IntVar(&idlePerHost, "idleperhost", 100, "Most idle connections kept open to each upstream host, set it to the usual parallel fetches to reuse them")
+	flag.IntVar(&connsPerHost, "connsperhost", 0, "Most connections to each upstream host, fetches beyond it wait; 0 for no limit")
+	flag.DurationVar(&upstreamIdle, "upstreamidle", 90*time.Second, "Time an idle connection to the upstream is kept open")
+	flag.BoolVar(&validateOnly, "validate", false, "Check the configuration and the URL templates of the origins, print a summary and exit")
+	flag.BoolVar(&checkUpstream, "checkupstream", false, "With validate, also check that the upstream hosts accept connections")
+	flag.BoolVar(&dedup, "dedup", false, "Keep a single copy of identical page bodies cached for different queries")
+	flag.DurationVar(&drainWait, "drainwait", 5*time.Second, "Time the fetches in flight have to cache their pages on shutdown before they are canceled")
+	flag.StringVar(&modes, "modes", "", "Comma separated name=template URL templates clients can pick instead of tmpl with modeparam")
+	flag.StringVar(&modeParam, "modeparam", "mode", "Query parameter with the mode of a request")
+	flag.Int64Var(&maxBytes, "maxbytes", 0, "Max memory to use for cached entries, in bytes; overrides mem if positive")
+	flag.Int64Var(&maxImport, "maximport", 1024*1024*1024, "Largest size of a dump imported over HTTP, in bytes; 0 for no limit")
 	flag.Parse()
+	level, err := parseLogLevel(logLevel, verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
 
+	if err := checkTemplate(tmpl); err != nil {
+		log.Fatal(err)
+	}
+	var fallbackTmpls []string
+	for _, t := range strings.Split(fallbacks, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if err := checkTemplate(t); err != nil {
+			log.Fatal(err)
+		}
+		fallbackTmpls = append(fallbackTmpls, t)
+	}
+	if incr <= 0 {
+		log.Fatal("incr must be positive")
+	}
 	config := newConfig(tmpl, incr)
+	if fetcherPages < 0 {
+		log.Fatal("npref cannot be negative")
+	}
 	config.npref = fetcherPages
+	config.prefetchBehind = prefetchBehind
+	config.prefetchAhead = prefetchAhead
 	config.maxMemory = 1024 * 1024 * int64(maxmem)
+	if maxBytes > 0 {
+		config.maxMemory = maxBytes
+	}
 	config.lifetime = time.Duration(gclifetime) * time.Minute
+	if ttl != 0 {
+		if ttl < 0 {
+			log.Fatal("ttl cannot be negative")
+		}
+		config.lifetime = ttl
+	}
+	if sliding && slidingMax <= 0 {
+		log.Fatal("slidingmax must be positive")
+	}
+	config.sliding = sliding
+	config.slidingMax = time.Duration(slidingMax) * time.Minute
 	config.gcpause = time.Duration(gcpause) * time.Second
+	if pageLifetimes != "" {
+		ds, err := parseLifetimes(pageLifetimes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.pageLifetimes = ds
+	}
+	config.maxGroupFetches = fetcherGroup
+	config.maxFetches = fetcherMax
+	if schedule != "" {
+		ws, err := parseSchedule(schedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.schedule = ws
+	}
+	config.maxPage = maxPage
+	if noPrefetch != "" {
+		re, err := regexp.Compile(noPrefetch)
+		if err != nil {
+			log.Fatalf("invalid noprefetch expression: %s", err)
+		}
+		config.noPrefetch = re
+	}
+	config.lookahead = lookahead
+	config.coalesce = coalesce
+	config.prefetchRate = prefetchRate
+	config.fetchRate = fetchRate
+	config.fetchBurst = fetchBurst
+	config.minBody = minBody
+	config.maxBody = maxBody
+	config.maxImport = maxImport
+	config.userAgent = userAgent
+	config.tenantHeader = tenantHeader
+	config.tenantEntries = tenantEntries
+	config.tenantMemory = 1024 * 1024 * int64(tenantMem)
+	config.variants = variants
+	config.traceRatio = traceRatio
+	config.traceHeader = traceHeader
+	config.passthrough = passthrough
+	config.minFetchInterval = time.Duration(minFetch) * time.Millisecond
+	if shards < 1 {
+		log.Fatal("shards must be positive")
+	}
+	config.shards = shards
+	config.refreshEvery = time.Duration(refreshEvery) * time.Second
+	config.diskDir = diskDir
+	config.diskThreshold = 1024 * diskThreshold
+	if diskDir != "" && !validateOnly {
+		n, err := cleanDiskDir(diskDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n > 0 {
+			slog.Info("removed page files of an earlier run", "dir", diskDir, "files", n)
+		}
+	}
+	if synthetic != "" {
+		if !devMode {
+			log.Fatal("synthetic pages are only served in dev mode")
+		}
+		t, err := parseSynthetic(synthetic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.synthetic = t
+		config.syntheticCache = syntheticCache
+	}
+	config.reuseModified = reuseModified
+	config.revalidate = revalidate
+	config.dedup = dedup
+	config.drainWait = drainWait
+	config.ttlHeader = ttlHeader
+	config.ttlMin = time.Duration(ttlMin) * time.Second
+	config.ttlMax = time.Duration(ttlMax) * time.Second
+	config.cacheControl = cacheControl
+	if batchURL != "" {
+		if batchMax <= 0 {
+			log.Fatal("batchmax must be positive")
+		}
+		config.batchURL = batchURL
+		config.batchMax = batchMax
+		config.batchWait = time.Duration(batchWait) * time.Millisecond
+	}
+	config.stale = time.Duration(stale) * time.Second
+	config.refreshProb = refreshProb
+	config.sla = time.Duration(sla) * time.Millisecond
+	config.slaRetain = time.Duration(slaRetain) * time.Second
+	config.staleIfError = staleIfError
+	config.http10 = http10
+	config.ranges = ranges
+	config.fetchTimeout = time.Duration(fetchTimeout) * time.Second
+	config.maxIdleConns = idleConns
+	config.maxIdlePerHost = idlePerHost
+	config.maxConnsPerHost = connsPerHost
+	config.idleTimeout = upstreamIdle
+	config.timeoutHeader = timeoutHeader
+	config.requestTimeout = time.Duration(requestTimeout) * time.Second
+	config.waitTimeout = time.Duration(waitTimeout) * time.Second
+	config.headFetch = headFetch
+	config.maxRange = maxRange
+	config.stream = stream
+	config.eventQueue = eventQueue
+	config.groupExpiry = groupExpiry
+	config.breakerFails = breakerFails
+	config.breakerWindow = time.Duration(breakerWindow) * time.Second
+	config.breakerRetry = time.Duration(breakerCool) * time.Second
+	config.negativeTTL = time.Duration(negativeTTL) * time.Second
+	config.maxGroups = maxGroups
+	config.retries = retries
+	config.retryJitter = time.Duration(retryJitter) * time.Millisecond
+	config.retryBase = time.Duration(retryBase) * time.Millisecond
+	config.compress = compress
+	config.gzip = gzipResponses
+	switch expiry {
+	case "rfc3339", "unix", "maxage", "all":
+		config.expiry = expiry
+	default:
+		log.Fatalf("invalid expiry format %q", expiry)
+	}
+	config.adminToken = adminToken
+	var eventTypes []string
+	if webhookURL != "" {
+		eventTypes, err = parseEventTypes(webhookEvents)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if evictURL != "" {
+		config.onEvict = evictNotifier(evictURL)
+	}
+	switch errorFormat {
+	case "plain", "json", "problem":
+		config.errors = errorFormat
+	default:
+		log.Fatalf("invalid error format %q", errorFormat)
+	}
+	config.readOnly = readOnly
+	config.replicaWait = time.Duration(replicaWait) * time.Millisecond
+	if signKeys != "" {
+		s, err := newSigner(signKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.watch(time.Minute)
+		config.signer = s
+	}
+	if extract != "" {
+		e, err := newHTMLExtractor(extract)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if extractBody {
+			config.transform = extractTransform(e)
+		} else {
+			config.extractor = e
+		}
+	} else if extractBody {
+		log.Fatal("extractbody needs extract")
+	}
+	if totalRegexp != "" {
+		t, err := newTotalRegexp(totalRegexp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.totals = t
+	}
+	for _, k := range strings.Split(keyHeaders, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			config.keyHeaders = append(config.keyHeaders, k)
+		}
+	}
+	config.hits = hits
+	config.hitsParam = hitsParam
+	if config.modes, err = parseModes(modes); err != nil {
+		log.Fatal(err)
+	}
+	config.modeParam = modeParam
+	for _, k := range strings.Split(keyParams, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			config.keyParams = append(config.keyParams, k)
+		}
+	}
+	if config.normalize, err = parseNormalize(normalize); err != nil {
+		log.Fatal(err)
+	}
+	if rewriteFrom != "" {
+		if config.rewriter, err = newURLRewriter(rewriteFrom, rewriteTo); err != nil {
+			log.Fatal(err)
+		}
+	}
 
+	ocs := []*originConfig{{Name: name, Tmpl: tmpl, Fallbacks: fallbackTmpls}}
+	if originsFile != "" {
+		if ocs, err = loadOrigins(originsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var warmupQueries []string
+	if warmupFile != "" {
+		if warmupQueries, err = loadWarmup(warmupFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if validateOnly {
+		if err := validate(os.Stdout, ocs, config, checkUpstream); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	fetcher := newFetcher(fetcherWorkers, fetcherQueue)
 	origins := newOrigins()
-	origins.add(newOrigin(name, fetcher, config, newLogbuf(nlogs, verbose)))
+	for _, oc := range ocs {
+		cf := oc.config(config)
+		if cacheFile != "" {
+			cf.cacheFile = cacheFile
+			if len(ocs) > 1 {
+				cf.cacheFile += "." + oc.Name
+			}
+		}
+		if webhookURL != "" {
+			wh := newWebhook(webhookURL, oc.Name, eventTypes, webhookBuffer)
+			cf.onEvict = wh.evicted
+			cf.onFill = wh.filled
+			cf.onClose = wh.close
+		}
+		slog.Info("fetching from upstream", "origin", oc.Name, "user-agent", cf.userAgent)
+		o := newOrigin(oc.Name, fetcher, cf, newLogbuf(nlogs, level <= slog.LevelDebug))
+		origins.add(o)
+		if len(warmupQueries) > 0 {
+			go o.warmup(warmupQueries)
+		}
+	}
 
 	r := mux.NewRouter()
+	rd := &readiness{}
+	r.HandleFunc("/healthz", healthz)
+	r.HandleFunc("/version", versionHandler(start))
+	r.Handle("/readyz", rd)
 	origins.initRouter(r)
 
-	http.Handle("/", r)
-	log.Fatal(http.ListenAndServe(listen, nil))
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("tlscert and tlskey must be set together")
+	}
+	var certs *certLoader
+	if tlsCert != "" {
+		if certs, err = newCertLoader(tlsCert, tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go certs.watch(hup)
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("listening", "addr", l.Addr().String(), "tls", certs != nil)
+	ll := newLimitListener(l, maxConns)
+	r.Handle("/_/connections", ll)
+
+	timeouts := serverTimeouts{
+		readHeader: time.Duration(headerTimeout) * time.Second,
+		read:       time.Duration(readTimeout) * time.Second,
+		write:      time.Duration(writeTimeout) * time.Second,
+		idle:       time.Duration(idleTimeout) * time.Second,
+	}
+	handler := http.Handler(r)
+	if authFile != "" {
+		a, err := loadAuth(authFile, strings.Split(authExempt, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = a.wrap(r)
+	}
+	if corsOrigins != "" {
+		// Outside of the authentication, preflight requests carry no credentials
+		handler = newCORS(strings.Split(corsOrigins, ",")).wrap(handler)
+	}
+	if accessLogFile != "" {
+		out := io.Writer(os.Stdout)
+		if accessLogFile != "-" {
+			f, err := os.OpenFile(accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatalf("cannot open access log: %s", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		al, err := newAccessLog(out, accessFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = al.wrap(handler)
+	}
+	srv := timeouts.server(handler)
+	if certs != nil {
+		srv.TLSConfig = certs.config()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if certs != nil {
+			errs <- srv.ServeTLS(ll, "", "")
+			return
+		}
+		errs <- srv.Serve(ll)
+	}()
+	rd.set(true)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-sigs:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+	// Let load balancers stop sending requests while the active ones finish
+	rd.set(false)
+	if err := shutdown(srv, origins, time.Duration(shutdownWait)*time.Second); err != nil {
+		slog.Error("shutdown", "err", err)
+	}
 }
@@ -0,0 +1,178 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// upstream is a fake search backend that counts the requests it receives.
+type upstream struct {
+	*httptest.Server
+	mux     sync.Mutex
+	hits    map[string]int
+	headers []http.Header
+}
+
+// newUpstream starts a backend answering with h; if h is nil it answers
+// with the query string of the request.
+func newUpstream(t testing.TB, h http.HandlerFunc) *upstream {
+	u := &upstream{hits: make(map[string]int)}
+	if h == nil {
+		h = func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.RawQuery)
+		}
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mux.Lock()
+		u.hits[r.URL.RawQuery]++
+		u.headers = append(u.headers, r.Header.Clone())
+		u.mux.Unlock()
+		h(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) tmpl() string {
+	return u.URL + "/?q=%s&of=%d"
+}
+
+// count returns how many times the query string qs was requested.
+func (u *upstream) count(qs string) int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.hits[qs]
+}
+
+// prefixed returns how many requests had a query string starting with prefix.
+func (u *upstream) prefixed(prefix string) int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	var n int
+	for qs, c := range u.hits {
+		if strings.HasPrefix(qs, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+func (u *upstream) total() int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	var n int
+	for _, c := range u.hits {
+		n += c
+	}
+	return n
+}
+
+// newTestOrigin returns an origin named "test" fetching from u, after
+// setup had a chance to change its configuration, and a router serving it.
+func newTestOrigin(t testing.TB, u *upstream, setup func(*config)) (*origin, http.Handler) {
+	cf := newConfig(u.tmpl(), 10)
+	cf.npref = 0
+	if setup != nil {
+		setup(cf)
+	}
+	o := newOrigin("test", newFetcher(4, 20), cf, newLogbuf(100, false))
+	t.Cleanup(func() { o.cache.Close() })
+	ors := newOrigins()
+	ors.add(o)
+	r := mux.NewRouter()
+	ors.initRouter(r)
+	return o, r
+}
+
+// serve performs a GET of path on h with the given request headers.
+func serve(h http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// eventually fails t if cond does not become true within a second.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestEndToEnd drives a client through a real server in front of the
+// router: concurrent requests share a fetch, the next pages are prefetched
+// and served from the cache, and expired pages are fetched again.
+func TestEndToEnd(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		// Pages 1 and 2 after page 0
+		cf.npref = 3
+		cf.lifetime = 300 * time.Millisecond
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	get := func(path string) (string, bool) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d (%v)", path, resp.StatusCode, err)
+		}
+		return string(body), resp.Header.Get("X-From-Cache") == "1"
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, _ := get("/test/search/cranes"); body != "q=cranes&of=0" {
+				t.Errorf("unexpected page %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := u.count("q=cranes&of=0"); n != 1 {
+		t.Errorf("expected concurrent requests to share a fetch, got %d", n)
+	}
+	eventually(t, func() bool { return u.count("q=cranes&of=20") == 1 })
+	if body, cached := get("/test/search/cranes/2"); !cached || body != "q=cranes&of=20" {
+		t.Errorf("expected the prefetched page from the cache, got %q", body)
+	}
+	if n := u.count("q=cranes&of=20"); n != 1 {
+		t.Errorf("expected a single fetch of the prefetched page, got %d", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if body, cached := get("/test/search/cranes"); cached || body != "q=cranes&of=0" {
+		t.Errorf("expected the expired page fetched again, got %q", body)
+	}
+	if n := u.count("q=cranes&of=0"); n != 2 {
+		t.Errorf("expected a second fetch of the expired page, got %d", n)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the fetch latency histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics counts the behavior of a cache. They are updated atomically, not
+// through the cache goroutine, to be read at any time.
+type metrics struct {
+	hits        uint64
+	misses      uint64
+	fetches     uint64
+	fetchErrors uint64
+	gcEvictions uint64
+	groups      int64
+	// latency counts the fetches for each bucket, plus the ones above them
+	latency   []uint64
+	latencyNs uint64
+	// breakerRejects counts the fetches not made because the breaker was open
+	breakerRejects uint64
+	// eventsBlocked counts the events that waited for a full queue
+	eventsBlocked uint64
+	// eventsPanicked counts the events that panicked
+	eventsPanicked uint64
+	// revalidated and refetched count the revalidations of cached pages
+	// answered with 304 Not Modified and with a new body
+	revalidated uint64
+	refetched   uint64
+	// memory is the memory used by the cached entries
+	memory int64
+	// tooLarge counts the pages not cached because larger than the memory limit
+	tooLarge uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{latency: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (m *metrics) hit(cached bool) {
+	if cached {
+		atomic.AddUint64(&m.hits, 1)
+	} else {
+		atomic.AddUint64(&m.misses, 1)
+	}
+}
+
+// ratio returns the hits and misses so far and the fraction of hits.
+func (m *metrics) ratio() (hits, misses uint64, ratio float64) {
+	hits, misses = atomic.LoadUint64(&m.hits), atomic.LoadUint64(&m.misses)
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	return hits, misses, ratio
+}
+
+// fetched records an upstream fetch that took d and failed with err, if not nil.
+func (m *metrics) fetched(d time.Duration, err error) {
+	atomic.AddUint64(&m.fetches, 1)
+	if err != nil {
+		atomic.AddUint64(&m.fetchErrors, 1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&m.latency[i], 1)
+	atomic.AddUint64(&m.latencyNs, uint64(d))
+}
+
+func (m *metrics) evicted(reason string) {
+	if reason == evictExpired {
+		atomic.AddUint64(&m.gcEvictions, 1)
+	}
+}
+
+// addGroups is called from the cache goroutines when the number of cached
+// groups changed by d.
+func (m *metrics) addGroups(d int) {
+	atomic.AddInt64(&m.groups, int64(d))
+}
+
+// writeMetric writes the samples of a metric in the Prometheus text format,
+// one for each origin.
+func writeMetric(w io.Writer, name, typ, help string, ors []*origin, val func(*metrics) string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, o := range ors {
+		fmt.Fprintf(w, "%s{origin=%s} %s\n", name, strconv.Quote(o.name), val(o.cache.metrics))
+	}
+}
+
+func (ors *origins) metrics(w http.ResponseWriter, r *http.Request) {
+	list := ors.list()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counters := []struct {
+		name, help string
+		val        func(*metrics) *uint64
+	}{
+		{"interproxy_cache_hits_total", "Pages served from the cache.", func(m *metrics) *uint64 { return &m.hits }},
+		{"interproxy_cache_misses_total", "Pages fetched for the request.", func(m *metrics) *uint64 { return &m.misses }},
+		{"interproxy_upstream_fetches_total", "Requests to the upstream.", func(m *metrics) *uint64 { return &m.fetches }},
+		{"interproxy_upstream_fetch_errors_total", "Failed requests to the upstream.", func(m *metrics) *uint64 { return &m.fetchErrors }},
+		{"interproxy_gc_evictions_total", "Groups removed because they expired.", func(m *metrics) *uint64 { return &m.gcEvictions }},
+		{"interproxy_upstream_breaker_rejects_total", "Fetches not made because the upstream was down.", func(m *metrics) *uint64 { return &m.breakerRejects }},
+		{"interproxy_cache_events_blocked_total", "Cache operations that waited for a full event queue.", func(m *metrics) *uint64 { return &m.eventsBlocked }},
+		{"interproxy_cache_events_panicked_total", "Cache operations that failed with a panic.", func(m *metrics) *uint64 { return &m.eventsPanicked }},
+		{"interproxy_upstream_revalidated_total", "Cached pages the upstream reported as not modified.", func(m *metrics) *uint64 { return &m.revalidated }},
+		{"interproxy_upstream_refetched_total", "Cached pages fetched again because the upstream changed them.", func(m *metrics) *uint64 { return &m.refetched }},
+		{"interproxy_cache_too_large_total", "Pages not cached because larger than the memory limit.", func(m *metrics) *uint64 { return &m.tooLarge }},
+	}
+	for _, c := range counters {
+		writeMetric(w, c.name, "counter", c.help, list, func(m *metrics) string {
+			return strconv.FormatUint(atomic.LoadUint64(c.val(m)), 10)
+		})
+	}
+	writeMetric(w, "interproxy_cache_groups", "gauge", "Groups cached.", list, func(m *metrics) string {
+		return strconv.FormatInt(atomic.LoadInt64(&m.groups), 10)
+	})
+	writeMetric(w, "interproxy_cache_memory_bytes", "gauge", "Memory used by the cached pages.", list, func(m *metrics) string {
+		return strconv.FormatInt(atomic.LoadInt64(&m.memory), 10)
+	})
+	name := "interproxy_cache_memory_limit_bytes"
+	fmt.Fprintf(w, "# HELP %s Most memory the cached pages can use.\n# TYPE %s gauge\n", name, name)
+	for _, o := range list {
+		fmt.Fprintf(w, "%s{origin=%s} %d\n", name, strconv.Quote(o.name), o.cache.config.maxMemory)
+	}
+	name = "interproxy_cache_events_queued"
+	fmt.Fprintf(w, "# HELP %s Cache operations waiting for the cache goroutines.\n# TYPE %s gauge\n", name, name)
+	for _, o := range list {
+		var n int
+		for _, s := range o.cache.shards {
+			n += len(s.events)
+		}
+		fmt.Fprintf(w, "%s{origin=%s} %d\n", name, strconv.Quote(o.name), n)
+	}
+	name = "interproxy_upstream_breaker_open"
+	fmt.Fprintf(w, "# HELP %s Whether fetches stopped because the upstream is down, 1 while open or half-open.\n# TYPE %s gauge\n", name, name)
+	now := time.Now()
+	for _, o := range list {
+		open := 0
+		if b := o.cache.breaker; b != nil && b.state(now) != breakerClosed {
+			open = 1
+		}
+		fmt.Fprintf(w, "%s{origin=%s} %d\n", name, strconv.Quote(o.name), open)
+	}
+	name = "interproxy_upstream_fetch_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of the requests to the upstream.\n# TYPE %s histogram\n", name, name)
+	for _, o := range list {
+		m := o.cache.metrics
+		label := strconv.Quote(o.name)
+		var n uint64
+		for i, le := range latencyBuckets {
+			n += atomic.LoadUint64(&m.latency[i])
+			fmt.Fprintf(w, "%s_bucket{origin=%s,le=\"%g\"} %d\n", name, label, le, n)
+		}
+		n += atomic.LoadUint64(&m.latency[len(latencyBuckets)])
+		fmt.Fprintf(w, "%s_bucket{origin=%s,le=\"+Inf\"} %d\n", name, label, n)
+		sum := time.Duration(atomic.LoadUint64(&m.latencyNs)).Seconds()
+		fmt.Fprintf(w, "%s_sum{origin=%s} %g\n%s_count{origin=%s} %d\n", name, label, sum, name, label, n)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("q") == "broken" {
+			http.Error(w, "broken", 500)
+			return
+		}
+		w.Write([]byte(r.URL.RawQuery))
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.lifetime = 20 * time.Millisecond
+		cf.gcpause = 10 * time.Millisecond
+		cf.retries = 0
+		cf.negativeTTL = 0
+	})
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/b")
+	serve(h, "/test/search/broken")
+	body := serve(h, "/metrics").Body.String()
+	for _, line := range []string{
+		`interproxy_cache_hits_total{origin="test"} 1`,
+		`interproxy_cache_misses_total{origin="test"} 2`,
+		`interproxy_upstream_fetches_total{origin="test"} 3`,
+		`interproxy_upstream_fetch_errors_total{origin="test"} 1`,
+		`interproxy_cache_groups{origin="test"} 2`,
+		`interproxy_upstream_fetch_duration_seconds_bucket{origin="test",le="+Inf"} 3`,
+		`interproxy_upstream_fetch_duration_seconds_count{origin="test"} 3`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", line, body)
+		}
+	}
+	eventually(t, func() bool {
+		body := serve(h, "/metrics").Body.String()
+		return strings.Contains(body, `interproxy_gc_evictions_total{origin="test"} 2`) &&
+			strings.Contains(body, `interproxy_cache_groups{origin="test"} 0`)
+	})
+}
+
+func TestHitRatio(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, nil)
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/a")
+	serve(h, "/test/search/b")
+	var st stats
+	if err := json.Unmarshal(serve(h, "/_/test/stats").Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Hits != 2 || st.Misses != 2 || st.HitRatio != 0.5 {
+		t.Errorf("expected 2 hits and 2 misses, got %d, %d (%v)", st.Hits, st.Misses, st.HitRatio)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// rangePage is a page in the response to a request for a range of pages.
+type rangePage struct {
+	N      int    `json:"n"`
+	Cached bool   `json:"cached"`
+	Body   string `json:"body"`
+}
+
+// pages serves the pages from "from" to "to" of a query as a JSON array. The
+// pages not cached are fetched concurrently.
+func (o *origin) pages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s, err := pathQuery(r)
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
+		return
+	}
+	from, err := o.parsePage(vars["from"])
+	if err != nil {
+		o.fail(w, r, fmt.Sprintf("invalid first page: %s", err), 400)
+		return
+	}
+	to, err := o.parsePage(vars["to"])
+	if err != nil || to < from {
+		o.fail(w, r, fmt.Sprintf("invalid last page %q", vars["to"]), 400)
+		return
+	}
+	if max := o.cache.config.maxRange; to-from+1 > max {
+		o.fail(w, r, fmt.Sprintf("at most %d pages can be requested at once", max), 400)
+		return
+	}
+	q, err := o.query(r, s)
+	if err != nil {
+		o.fail(w, r, err.Error(), 400)
+		return
+	}
+	var (
+		wg    sync.WaitGroup
+		pages = make([]*page, to-from+1)
+		errs  = make([]error, len(pages))
+	)
+	for i := range pages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pages[i], errs[i] = o.cache.get(q, from+i)
+		}(i)
+	}
+	wg.Wait()
+	res := make([]rangePage, len(pages))
+	for i, p := range pages {
+		if errs[i] != nil {
+			o.failGet(w, r, errs[i])
+			return
+		}
+		body, err := p.contents()
+		if err != nil {
+			o.fail(w, r, err.Error(), 503)
+			return
+		}
+		res[i] = rangePage{N: from + i, Cached: p.cached, Body: string(body)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		o.fail(w, r, err.Error(), 500)
+	}
+}
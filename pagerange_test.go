@@ -0,0 +1,49 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPageRange(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.maxRange = 4
+	})
+	serve(h, "/test/search/cranes/3")
+	w := serve(h, "/test/search/cranes/range/2/5")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var pages []rangePage
+	if err := json.Unmarshal(w.Body.Bytes(), &pages); err != nil {
+		t.Fatal(err)
+	}
+	want := []rangePage{
+		{2, false, "q=cranes&of=20"},
+		{3, true, "q=cranes&of=30"},
+		{4, false, "q=cranes&of=40"},
+		{5, false, "q=cranes&of=50"},
+	}
+	if len(pages) != len(want) {
+		t.Fatalf("expected %d pages, got %d", len(want), len(pages))
+	}
+	for i := range want {
+		if pages[i] != want[i] {
+			t.Errorf("expected %+v, got %+v", want[i], pages[i])
+		}
+	}
+	if n := u.total(); n != 4 {
+		t.Errorf("expected the cached page not to be fetched again, got %d fetches", n)
+	}
+	for _, path := range []string{"/test/search/cranes/range/2/6", "/test/search/cranes/range/3/2", "/test/search/cranes/range/x/2"} {
+		if w := serve(h, path); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, w.Code)
+		}
+	}
+}
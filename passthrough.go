@@ -0,0 +1,110 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// hopHeaders are the headers of a single connection, which proxies do not
+// forward.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, with the ones
+// named by its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// passthrough forwards r for page n of q to the upstream and copies back
+// the response, without looking up or storing anything in the cache. Links
+// to the upstream in HTML responses are rewritten like in cached pages, but
+// the extractor and the transform are not applied: they turn result pages
+// into JSON, and the responses to other methods are not result pages.
+func (o *origin) passthrough(w http.ResponseWriter, r *http.Request, q *query, n int) {
+	cf := o.cache.config
+	res := newResource(cf.template(q.mode), q, offset(n*cf.incr))
+	ctx, cancel := res.context(cf.fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, res.String(), r.Body)
+	if err != nil {
+		o.fail(w, r, fmt.Sprintf("cannot create request for %s: %s", res, err), 500)
+		return
+	}
+	for k, v := range res.header {
+		req.Header[k] = v
+	}
+	removeHopHeaders(req.Header)
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	req.ContentLength = r.ContentLength
+	cf.setUserAgent(req)
+	res.tag(req)
+	if s := cf.signer; s != nil {
+		if err := s.sign(req); err != nil {
+			o.fail(w, r, fmt.Sprintf("cannot sign request for %s: %s", res, err), 500)
+			return
+		}
+	}
+	resp, err := o.cache.client.Do(req)
+	if err != nil {
+		o.fail(w, r, fmt.Sprintf("cannot %s %s: %s", r.Method, res, err), 502)
+		return
+	}
+	defer resp.Body.Close()
+	tagged(o.logs.debug, res.id)("passed %s %s through: %s", r.Method, res, resp.Status)
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	var body []byte
+	if rw := cf.rewriter; rw != nil && isHTML(header.Get("Content-Type")) {
+		lr, err := limitBody(res.String(), resp, cf.maxBody)
+		if err == nil {
+			body, err = io.ReadAll(lr)
+		}
+		if err == nil {
+			err = checkBody(res.String(), resp, body, cf.maxBody)
+		}
+		if err != nil {
+			o.fail(w, r, fmt.Sprintf("cannot read response to %s %s: %s", r.Method, res, err), 502)
+			return
+		}
+		body = rw.rewrite(body)
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	if body != nil {
+		w.Write(body)
+		return
+	}
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of a request, from the client or generated,
+// in the response and in the requests to the upstream.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// newRequestID returns a random UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID reports whether id is short and made of characters safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// tagRequests gives each request the ID sent by the client or a new one, in
+// its context and in the response.
+func tagRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request of ctx, if any.
+func requestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// tagged returns debug prefixing the lines with the request ID id, if any.
+func tagged(debug func(string, ...interface{}), id string) func(string, ...interface{}) {
+	if id == "" {
+		return debug
+	}
+	return func(format string, args ...interface{}) {
+		debug("["+id+"] "+format, args...)
+	}
+}
+
+// tag sends the ID of the request for r, if any, to the upstream.
+func (r *resource) tag(req *http.Request) {
+	if r.id != "" {
+		req.Header.Set(requestIDHeader, r.id)
+	}
+}
+
+func (j *job) debug(format string, args ...interface{}) {
+	tagged(j.cache.debug, j.res.id)(format, args...)
+}
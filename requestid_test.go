@@ -0,0 +1,46 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	ids := make(chan string, 3)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(requestIDHeader)
+		io.WriteString(w, r.URL.RawQuery)
+	})
+	_, h := newTestOrigin(t, u, nil)
+
+	w := serve(h, "/test/search/a", requestIDHeader, "client-id.1")
+	if id := w.Header().Get(requestIDHeader); id != "client-id.1" {
+		t.Errorf("expected the ID of the client in the response, got %q", id)
+	}
+	if id := <-ids; id != "client-id.1" {
+		t.Errorf("expected the ID of the client sent upstream, got %q", id)
+	}
+	if logs := serve(h, "/_/test/logs").Body.String(); !strings.Contains(logs, "[client-id.1] ") {
+		t.Errorf("expected the ID of the client in the logs:\n%s", logs)
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for i, sent := range []string{"", "bad id%s"} {
+		w := serve(h, fmt.Sprintf("/test/search/b%d", i), requestIDHeader, sent)
+		id := w.Header().Get(requestIDHeader)
+		if !uuid.MatchString(id) {
+			t.Errorf("expected a generated ID for %q, got %q", sent, id)
+		}
+		if up := <-ids; up != id {
+			t.Errorf("expected the generated ID %q sent upstream, got %q", id, up)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitError is returned by fetches refused by the upstream with a 429,
+// or a 503 with a Retry-After, and by the fetches made while it asks to wait.
+type rateLimitError struct {
+	retry time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.retry)
+}
+
+// transientError is returned by fetches that failed because of the network
+// or the upstream, which can succeed if retried.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// transient marks err as transient unless ctx ended: the fetch was then
+// given up and must not be retried.
+func transient(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return &transientError{err}
+}
+
+// backoff returns the wait before retry i+1 of a failed fetch: base doubled
+// for each earlier retry, plus a random jitter of up to a half of it.
+func backoff(base time.Duration, i int) time.Duration {
+	d := base << uint(i)
+	return d + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter returns the wait requested by a Retry-After header in
+// seconds or as a date, or def if it is missing or invalid.
+func parseRetryAfter(s string, now time.Time, def time.Duration) time.Duration {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
+
+// retryGate holds back the fetches of an origin after the upstream asked to
+// retry later. Waiting fetches are let through one by one, at least half the
+// jitter apart and with a random delay of up to another half, so that they
+// do not all hit the upstream at the same time when the wait is over.
+type retryGate struct {
+	mux    sync.Mutex
+	jitter time.Duration
+	// next is when the upstream accepts requests again
+	next time.Time
+	// last is the time given to the last waiting fetch
+	last time.Time
+}
+
+func newRetryGate(jitter time.Duration) *retryGate {
+	return &retryGate{jitter: jitter}
+}
+
+// block holds back fetches for d.
+func (g *retryGate) block(d time.Duration) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if t := time.Now().Add(d); t.After(g.next) {
+		g.next = t
+	}
+}
+
+// closed returns how long the upstream asked to wait yet, if at all.
+func (g *retryGate) closed() time.Duration {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return time.Until(g.next)
+}
+
+// wait returns when a fetch can be made.
+func (g *retryGate) wait() {
+	g.mux.Lock()
+	now := time.Now()
+	if !now.Before(g.next) && !now.Before(g.last) {
+		g.mux.Unlock()
+		return
+	}
+	t := g.next
+	if min := g.last.Add(g.jitter / 2); t.Before(min) {
+		t = min
+	}
+	if g.jitter > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(g.jitter/2) + 1)))
+	}
+	g.last = t
+	g.mux.Unlock()
+	time.Sleep(time.Until(t))
+}
+
+// rateLimiter spaces events evenly at a maximum rate.
+type rateLimiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	burst    int
+	next     time.Time
+}
+
+// newRateLimiter allows rate events per second, up to burst at once after
+// a pause.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate), burst: burst}
+}
+
+// reserve books the next event and returns how long to wait for it.
+func (l *rateLimiter) reserve() time.Duration {
+	d, _ := l.reserveBefore(time.Time{})
+	return d
+}
+
+// reserveBefore books the next event unless it would happen after the
+// deadline, if not zero. It returns how long to wait for the event.
+func (l *rateLimiter) reserveBefore(deadline time.Time) (time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	t := l.next
+	// The events not taken during a pause can happen at once
+	if earliest := now.Add(-time.Duration(l.burst-1) * l.interval); t.Before(earliest) {
+		t = earliest
+	}
+	if !deadline.IsZero() && t.After(deadline) {
+		return 0, false
+	}
+	l.next = t.Add(l.interval)
+	if t.Before(now) {
+		return 0, true
+	}
+	return t.Sub(now), true
+}
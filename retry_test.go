@@ -0,0 +1,228 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", time.Minute},
+		{"x", time.Minute},
+		{"-1", time.Minute},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"Thu, 15 Oct 2026 12:00:30 GMT", 30 * time.Second},
+		{"Thu, 15 Oct 2026 11:00:00 GMT", 0},
+	} {
+		if d := parseRetryAfter(tt.in, now, time.Minute); d != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, expected %s", tt.in, d, tt.want)
+		}
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	var (
+		mux     sync.Mutex
+		limited = make(map[string]bool)
+		retries []time.Time
+		arrived sync.WaitGroup
+	)
+	// New fetches fail while the upstream asks to wait: refuse them only
+	// once all have been made
+	arrived.Add(4)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		q := r.URL.Query().Get("q")
+		first := !limited[q]
+		limited[q] = true
+		mux.Unlock()
+		if first {
+			arrived.Done()
+			arrived.Wait()
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		retries = append(retries, time.Now())
+		io.WriteString(w, q)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.retryJitter = 400 * time.Millisecond
+	})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(q string) {
+			defer wg.Done()
+			p, err := o.cache.get(newQuery(q, nil, nil), 0)
+			if err != nil || string(p.body) != q {
+				t.Errorf("%s: expected the retried page, got %v", q, err)
+			}
+		}(fmt.Sprintf("g%d", i))
+	}
+	wg.Wait()
+	mux.Lock()
+	defer mux.Unlock()
+	if len(retries) != 4 {
+		t.Fatalf("expected one retry for each group, got %d", len(retries))
+	}
+	sort.Slice(retries, func(i, j int) bool { return retries[i].Before(retries[j]) })
+	if d := retries[0].Sub(start); d < 900*time.Millisecond {
+		t.Errorf("retried after %s, before the Retry-After", d)
+	}
+	for i := 1; i < len(retries); i++ {
+		if d := retries[i].Sub(retries[i-1]); d < 190*time.Millisecond {
+			t.Errorf("retries %d and %d only %s apart", i-1, i, d)
+		}
+	}
+}
+
+func TestRetryAfterPause(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "busy" {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "body")
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+	})
+	w := serve(h, "/test/search/busy")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected the upstream Retry-After to be passed on, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	start := time.Now()
+	w = serve(h, "/test/search/other")
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected fetches to fail during the pause, got %d", w.Code)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected the fetch to fail at once, took %s", d)
+	}
+	if n := u.total(); n != 1 {
+		t.Errorf("expected no requests to the upstream during the pause, got %d", n)
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 2
+		cf.retryJitter = 0
+	})
+	o.cache.get(newQuery("cranes", nil, nil), 0)
+	if n := u.total(); n != 3 {
+		t.Errorf("expected the first request and two retries, got %d", n)
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		fails = map[string]int{"flaky": 2, "broken": 10, "missing": 10}
+	)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		q := r.URL.Query().Get("q")
+		if fails[q] > 0 {
+			fails[q]--
+			if q == "missing" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, q)
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 2
+		cf.retryBase = time.Millisecond
+	})
+	if p, err := o.cache.get(newQuery("flaky", nil, nil), 0); err != nil || string(p.body) != "flaky" {
+		t.Errorf("expected the fetch to succeed after 2 retries, got %v", err)
+	}
+	if _, err := o.cache.get(newQuery("broken", nil, nil), 0); err == nil {
+		t.Error("expected the fetch to fail after 2 retries")
+	}
+	if _, err := o.cache.get(newQuery("missing", nil, nil), 0); err != nil {
+		t.Errorf("a 404 is not a failed fetch: %v", err)
+	}
+	for q, n := range map[string]int{"flaky": 3, "broken": 3, "missing": 1} {
+		if c := u.count("q=" + q + "&of=0"); c != n {
+			t.Errorf("%s: expected %d fetches, got %d", q, n, c)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for i, min := range []time.Duration{100, 200, 400, 800} {
+		min *= time.Millisecond
+		if d := backoff(100*time.Millisecond, i); d < min || d > min+min/2 {
+			t.Errorf("retry %d: backoff %s, expected between %s and %s", i+1, d, min, min+min/2)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		if d := l.reserve(); d != 0 {
+			t.Errorf("event %d of the burst waits %s", i, d)
+		}
+	}
+	if d := l.reserve(); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("expected the event after the burst to wait 100ms, got %s", d)
+	}
+	if _, ok := l.reserveBefore(time.Now().Add(50 * time.Millisecond)); ok {
+		t.Error("expected an event after the deadline to be refused")
+	}
+	if d, ok := l.reserveBefore(time.Now().Add(time.Second)); !ok || d < 190*time.Millisecond {
+		t.Errorf("expected the refused event not to be booked, got %s", d)
+	}
+}
+
+func TestFetchRate(t *testing.T) {
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.fetchRate = 5
+		cf.timeoutHeader = "X-Timeout"
+	})
+	serve(h, "/test/search/a")
+	// The next fetch can only start in 200ms
+	if w := serve(h, "/test/search/b", "X-Timeout", "50"); w.Code != 503 {
+		t.Errorf("expected the fetch past the deadline to fail at once, got %d", w.Code)
+	}
+	start := time.Now()
+	if w := serve(h, "/test/search/b"); w.Code != 200 || w.Header().Get("X-From-Cache") != "" {
+		t.Errorf("expected the page to be fetched, got %d", w.Code)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("expected the fetch to wait for the rate limit, took %s", d)
+	}
+}
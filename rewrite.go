@@ -0,0 +1,48 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// urlRewriter replaces the links to the upstream in HTML pages with links to
+// the proxy, so that following them goes through the cache.
+type urlRewriter struct {
+	// from matches the base URL of the upstream, followed by the end of the
+	// URL or the start of its path, query or fragment
+	from *regexp.Regexp
+	// to is the replacement template, keeping the character after the base URL
+	to []byte
+}
+
+// newURLRewriter rewrites the absolute URLs starting with from to start
+// with to instead, which can be a path on the proxy or an absolute URL.
+func newURLRewriter(from, to string) (*urlRewriter, error) {
+	u, err := url.Parse(from)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream base URL %q to rewrite", from)
+	}
+	from = strings.TrimRight(from, "/")
+	return &urlRewriter{
+		from: regexp.MustCompile(regexp.QuoteMeta(from) + `([/?#"'\s<>)]|$)`),
+		to:   []byte(strings.ReplaceAll(strings.TrimRight(to, "/"), "$", "$$") + "${1}"),
+	}, nil
+}
+
+// rewrite returns body with the URLs replaced.
+func (rw *urlRewriter) rewrite(body []byte) []byte {
+	return rw.from.ReplaceAll(body, rw.to)
+}
+
+// isHTML reports whether the content type ctype is HTML.
+func isHTML(ctype string) bool {
+	t, _, err := mime.ParseMediaType(ctype)
+	return err == nil && t == "text/html"
+}
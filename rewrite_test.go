@@ -0,0 +1,57 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestURLRewriter(t *testing.T) {
+	rw, err := newURLRewriter("https://search.example.com/", "/kn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		`<a href="https://search.example.com/q/cranes">`:                       `<a href="/kn/q/cranes">`,
+		`<a href='https://search.example.com'>home</a>`:                        `<a href='/kn'>home</a>`,
+		`see https://search.example.com?q=x or https://search.example.com#top`: `see /kn?q=x or /kn#top`,
+		`https://search.example.com`:                                           `/kn`,
+		`<a href="https://search.example.com.evil.org/">`:                      `<a href="https://search.example.com.evil.org/">`,
+		`<a href="https://search.example.common/">`:                            `<a href="https://search.example.common/">`,
+		`<a href="http://search.example.com/">`:                                `<a href="http://search.example.com/">`,
+	} {
+		if got := string(rw.rewrite([]byte(in))); got != want {
+			t.Errorf("%s: expected %s, got %s", in, want, got)
+		}
+	}
+	for _, from := range []string{"", "/relative", "ftp://host", "https://"} {
+		if _, err := newURLRewriter(from, "/kn"); err == nil {
+			t.Errorf("%q: expected an error", from)
+		}
+	}
+}
+
+func TestRewriteHTML(t *testing.T) {
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("q") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"url":"https://search.example.com/x"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<a href="https://search.example.com/x">x</a>`)
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.rewriter, _ = newURLRewriter("https://search.example.com", "https://proxy.example.com/test")
+	})
+	if body := serve(h, "/test/search/html").Body.String(); body != `<a href="https://proxy.example.com/test/x">x</a>` {
+		t.Errorf("expected the link rewritten, got %s", body)
+	}
+	if body := serve(h, "/test/search/json").Body.String(); body != `{"url":"https://search.example.com/x"}` {
+		t.Errorf("expected JSON untouched, got %s", body)
+	}
+}
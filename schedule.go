@@ -0,0 +1,71 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// window overrides the prefetch depth and the fetch limit between two times of day.
+type window struct {
+	from, to   time.Duration
+	npref      int
+	maxFetches int
+}
+
+func (w *window) contains(t time.Time) bool {
+	// Wall clock time, which is not the time elapsed since midnight on DST changes
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.from <= w.to {
+		return since >= w.from && since < w.to
+	}
+	// The window spans midnight
+	return since >= w.from || since < w.to
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseSchedule parses comma separated windows like "08:00-18:00=1/2",
+// meaning a prefetch depth of 1 and at most 2 parallel fetches from 8 to 18.
+func parseSchedule(s string) ([]window, error) {
+	var ws []window
+	for _, spec := range strings.Split(s, ",") {
+		var w window
+		span, limits, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		from, to, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid schedule window %q", spec)
+		}
+		var err error
+		if w.from, err = parseTimeOfDay(from); err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %s", spec, err)
+		}
+		if w.to, err = parseTimeOfDay(to); err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %s", spec, err)
+		}
+		npref, maxFetches, ok := strings.Cut(limits, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule window %q", spec)
+		}
+		if w.npref, err = strconv.Atoi(npref); err != nil || w.npref < 0 {
+			return nil, fmt.Errorf("invalid prefetch depth in schedule window %q", spec)
+		}
+		if w.maxFetches, err = strconv.Atoi(maxFetches); err != nil || w.maxFetches < 0 {
+			return nil, fmt.Errorf("invalid fetch limit in schedule window %q", spec)
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	ws, err := parseSchedule("08:00-18:00=1/2, 22:30-06:00=0/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ws) != 2 || ws[0] != (window{8 * time.Hour, 18 * time.Hour, 1, 2}) ||
+		ws[1] != (window{22*time.Hour + 30*time.Minute, 6 * time.Hour, 0, 1}) {
+		t.Errorf("unexpected windows %v", ws)
+	}
+	for _, s := range []string{
+		"08:00-18:00", "08:00=1/2", "8-18=1/2", "08:00-18:00=1",
+		"08:00-18:00=1/2x", "08:00-18:00=1x/2", "08:00-18:00=1/2/3", "08:00-18:00=-1/2",
+	} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestScheduleClock(t *testing.T) {
+	ws, err := parseSchedule("08:00-18:00=1/2,22:00-06:00=0/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+	cf := newConfig("", 10)
+	cf.npref = 4
+	cf.maxFetches = 8
+	cf.schedule = ws
+	cf.clock = func() time.Time { return now }
+	day := func(h, m, s int) time.Time { return time.Date(2026, 10, 15, h, m, s, 0, time.UTC) }
+	for _, tt := range []struct {
+		t            time.Time
+		npref, fetch int
+	}{
+		{day(7, 59, 59), 4, 8},
+		{day(8, 0, 0), 1, 2},
+		{day(17, 59, 59), 1, 2},
+		{day(18, 0, 0), 4, 8},
+		{day(21, 59, 59), 4, 8},
+		{day(22, 0, 0), 0, 1},
+		{day(23, 59, 59), 0, 1},
+		{day(24, 0, 0), 0, 1},
+		{day(29, 59, 59), 0, 1},
+		{day(30, 0, 0), 4, 8},
+	} {
+		now = tt.t
+		if d, f := cf.prefetchDepth(cf.clock()), cf.fetchLimit(cf.clock()); d != tt.npref || f != tt.fetch {
+			t.Errorf("%s: got depth %d and limit %d, expected %d and %d", now, d, f, tt.npref, tt.fetch)
+		}
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	ws, err := parseSchedule("03:00-04:00=1/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clocks go forward from 02:00 to 03:00 this day, and back from 03:00 to 02:00 in October
+	for _, tt := range []struct {
+		t  time.Time
+		in bool
+	}{
+		{time.Date(2026, 3, 29, 3, 30, 0, 0, loc), true},
+		{time.Date(2026, 3, 29, 4, 30, 0, 0, loc), false},
+		{time.Date(2026, 10, 25, 2, 30, 0, 0, loc), false},
+		{time.Date(2026, 10, 25, 3, 30, 0, 0, loc), true},
+	} {
+		if in := ws[0].contains(tt.t); in != tt.in {
+			t.Errorf("%s: got %v, expected %v", tt.t, in, tt.in)
+		}
+	}
+}
+
+func TestSchedulePrefetch(t *testing.T) {
+	ws, err := parseSchedule("08:00-18:00=2/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 15, 7, 59, 0, 0, time.UTC)
+	u := newUpstream(t, nil)
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.schedule = ws
+		cf.clock = func() time.Time { return now }
+	})
+	if _, err := o.cache.get(newQuery("early", nil, nil), 5); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := o.cache.get(newQuery("late", nil, nil), 5); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return u.prefixed("q=late&") == 4 })
+	for i := 3; i <= 6; i++ {
+		if n := u.count(fmt.Sprintf("q=late&of=%d", i*10)); n != 1 {
+			t.Errorf("page %d fetched %d times in the window", i, n)
+		}
+	}
+	if n := u.prefixed("q=early&"); n != 1 {
+		t.Errorf("expected no prefetch before the window, got %d requests", n)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type signKey struct {
+	ID     string
+	Secret string
+	From   time.Time
+	Until  time.Time
+}
+
+func (k *signKey) valid(t time.Time) bool {
+	return !t.Before(k.From) && (k.Until.IsZero() || t.Before(k.Until))
+}
+
+// signer signs upstream requests with the primary key of a keyset that is
+// reloaded from a JSON file whenever the file changes.
+type signer struct {
+	path  string
+	mux   sync.RWMutex
+	keys  []signKey
+	mtime time.Time
+}
+
+func newSigner(path string) (*signer, error) {
+	s := &signer{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *signer) reload() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("cannot stat keyset: %s", err)
+	}
+	s.mux.RLock()
+	same := fi.ModTime().Equal(s.mtime)
+	s.mux.RUnlock()
+	if same {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("cannot open keyset: %s", err)
+	}
+	defer f.Close()
+	var keys []signKey
+	if err := json.NewDecoder(f).Decode(&keys); err != nil {
+		return fmt.Errorf("cannot decode keyset %s: %s", s.path, err)
+	}
+	s.mux.Lock()
+	s.keys = keys
+	s.mtime = fi.ModTime()
+	s.mux.Unlock()
+	return nil
+}
+
+// watch reloads the keyset every d.
+func (s *signer) watch(d time.Duration) {
+	for range time.Tick(d) {
+		if err := s.reload(); err != nil {
+			slog.Error("cannot reload signing keys", "err", err)
+		}
+	}
+}
+
+// primary returns the valid key that became valid last.
+func (s *signer) primary(t time.Time) (signKey, bool) {
+	var (
+		key signKey
+		ok  bool
+	)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, k := range s.keys {
+		if k.valid(t) && (!ok || k.From.After(key.From)) {
+			key, ok = k, true
+		}
+	}
+	return key, ok
+}
+
+// sign adds the signature of the method and URL of req to its headers.
+func (s *signer) sign(req *http.Request) error {
+	key, ok := s.primary(time.Now())
+	if !ok {
+		return errors.New("no valid signing key")
+	}
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	fmt.Fprintf(mac, "%s %s", req.Method, req.URL)
+	req.Header.Set("X-Signature-Key", key.ID)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
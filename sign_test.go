@@ -0,0 +1,106 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeyset(t *testing.T, path string, keys []signKey, mtime time.Time) {
+	t.Helper()
+	b, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is noticed even on coarse file system clocks
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verify checks the signature of r against the keys of s valid at t, like an
+// upstream sharing the keyset would.
+func verify(s *signer, r *http.Request, t time.Time) (string, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	id := r.Header.Get("X-Signature-Key")
+	for _, k := range s.keys {
+		if k.ID != id || !k.valid(t) {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(k.Secret))
+		fmt.Fprintf(mac, "%s %s", r.Method, r.URL)
+		sig, err := hex.DecodeString(r.Header.Get("X-Signature"))
+		return id, err == nil && hmac.Equal(sig, mac.Sum(nil))
+	}
+	return id, false
+}
+
+func TestSignerRotation(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	old := signKey{ID: "old", Secret: "s1", From: now.Add(-time.Hour), Until: now.Add(time.Hour)}
+	writeKeyset(t, path, []signKey{old}, now.Add(-time.Minute))
+	s, err := newSigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upstream knows the keyset, URLs are made absolute as the client sent them
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme, r.URL.Host = "http", r.Host
+		if id, ok := verify(s, r, time.Now()); ok {
+			io.WriteString(w, id)
+		} else {
+			io.WriteString(w, "invalid signature")
+		}
+	})
+	_, h := newTestOrigin(t, u, func(cf *config) { cf.signer = s })
+	if w := serve(h, "/test/search/cranes/0"); w.Body.String() != "old" {
+		t.Fatalf("expected a request signed with the old key, got %q", w.Body)
+	}
+	// A request signed right before the rotation is delivered after it
+	req, err := http.NewRequest("GET", u.URL+"/?q=late&of=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sign(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate: the new key becomes primary, the old one stays valid for the overlap
+	fresh := signKey{ID: "new", Secret: "s2", From: now}
+	writeKeyset(t, path, []signKey{old, fresh}, now)
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, "/test/search/cranes/1"); w.Body.String() != "new" {
+		t.Errorf("expected a request signed with the new key, got %q", w.Body)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "old" {
+		t.Errorf("a request signed with the rotated key should be valid in the overlap, got %q", b)
+	}
+	// After the overlap the old key is refused
+	if _, ok := verify(s, req, old.Until); ok {
+		t.Error("the old key should be refused after the overlap")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// stream is the body of a page being fetched, which the clients waiting for
+// the page read while it is written.
+type stream struct {
+	ctype string
+	code  int
+	mux   sync.Mutex
+	buf   []byte
+	// more is closed and replaced at each write
+	more chan struct{}
+	done bool
+	err  error
+}
+
+func newStream(ctype string, code int) *stream {
+	return &stream{ctype: ctype, code: code, more: make(chan struct{})}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.buf = append(s.buf, p...)
+	close(s.more)
+	s.more = make(chan struct{})
+	return len(p), nil
+}
+
+// close ends the stream, with err if the body is not complete.
+func (s *stream) close(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.done {
+		return
+	}
+	s.done, s.err = true, err
+	close(s.more)
+}
+
+// bytes returns the body written so far.
+func (s *stream) bytes() []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.buf
+}
+
+// reader returns a reader of the whole body, which waits for it to be
+// written until ctx ends.
+func (s *stream) reader(ctx context.Context) io.Reader {
+	return &streamReader{s: s, ctx: ctx}
+}
+
+type streamReader struct {
+	s   *stream
+	ctx context.Context
+	off int
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for {
+		r.s.mux.Lock()
+		if r.off < len(r.s.buf) {
+			n := copy(p, r.s.buf[r.off:])
+			r.off += n
+			r.s.mux.Unlock()
+			return n, nil
+		}
+		if r.s.done {
+			err := r.s.err
+			r.s.mux.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		more := r.s.more
+		r.s.mux.Unlock()
+		select {
+		case <-more:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// streaming hands s to the clients waiting for page n of cg.
+func (c *cache) streaming(cg group, n offset, s *stream) {
+	c.send(func() error {
+		if wt, ok := c.waits.waits[cg][n]; ok && wt.stream == nil {
+			wt.stream = s
+			close(wt.streamed)
+		}
+		return nil
+	})
+}
+
+// stream sends the body of a page to the client while it is fetched. If the
+// fetch fails, the response is aborted for the client to not take it as
+// complete.
+func (o *origin) stream(w http.ResponseWriter, r *http.Request, s *stream) {
+	if s.ctype != "" {
+		w.Header().Set("Content-Type", s.ctype)
+	}
+	w.Header().Set("X-Cache-Status", "MISS")
+	w.WriteHeader(s.code)
+	if r.Method == "HEAD" {
+		return
+	}
+	f, _ := w.(http.Flusher)
+	sr := s.reader(r.Context())
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := sr.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			o.logs.debug("%s: aborting streamed response: %s", r.URL.Path, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
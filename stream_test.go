@@ -0,0 +1,76 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	block := make(chan struct{})
+	release := sync.OnceFunc(func() { close(block) })
+	t.Cleanup(release)
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-block
+		if r.FormValue("q") == "broken" {
+			// Hijacked to cut the body short
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		io.WriteString(w, "second\n")
+	})
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.stream = true
+		cf.retries = 0
+		cf.negativeTTL = 0
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/test/search/cranes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if s := resp.Header.Get("X-Cache-Status"); s != "MISS" {
+		t.Errorf("expected a streamed miss, got %q", s)
+	}
+	br := bufio.NewReader(resp.Body)
+	if line, err := br.ReadString('\n'); err != nil || line != "first\n" {
+		t.Fatalf("expected the first line before the fetch ends, got %q (%v)", line, err)
+	}
+	release()
+	if rest, err := io.ReadAll(br); err != nil || string(rest) != "second\n" {
+		t.Errorf("expected the rest of the body, got %q (%v)", rest, err)
+	}
+	eventually(t, func() bool { return cached(o.cache, newQuery("cranes", nil, nil), 0) })
+	w := serve(h, "/test/search/cranes")
+	if w.Header().Get("X-From-Cache") != "1" || w.Body.String() != "first\nsecond\n" {
+		t.Errorf("expected the whole page cached, got %q", w.Body)
+	}
+
+	resp, err = http.Get(srv.URL + "/test/search/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("expected the response cut short when the fetch fails")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cached(o.cache, newQuery("broken", nil, nil), 0) {
+		t.Errorf("expected the partial page not cached")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// syntheticData is passed to the template of a synthetic origin.
+type syntheticData struct {
+	Query  string
+	Page   int
+	Offset int
+}
+
+// parseSynthetic parses the body template of a synthetic origin.
+func parseSynthetic(s string) (*template.Template, error) {
+	t, err := template.New("synthetic").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid synthetic template: %s", err)
+	}
+	return t, nil
+}
+
+// synthesize renders the page at offset n for query q instead of fetching it.
+func (cf *config) synthesize(q string, n offset) (*page, error) {
+	var buf bytes.Buffer
+	data := syntheticData{Query: q, Page: int(n) / cf.incr, Offset: int(n)}
+	if err := cf.synthetic.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("cannot render synthetic page: %s", err)
+	}
+	p := newPage(n, buf.Bytes())
+	p.fetched = time.Now()
+	p.etag = etag(p.body)
+	return p, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSynthetic(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		u := newUpstream(t, nil)
+		_, h := newTestOrigin(t, u, func(cf *config) {
+			tmpl, err := parseSynthetic(`{"q":{{printf "%q" .Query}},"page":{{.Page}},"of":{{.Offset}}}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cf.synthetic = tmpl
+			cf.syntheticCache = cache
+		})
+		for i := 0; i < 2; i++ {
+			w := serve(h, "/test/search/cranes/3")
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", w.Code)
+			}
+			if b := w.Body.String(); b != `{"q":"cranes","page":3,"of":30}` {
+				t.Errorf("unexpected synthetic body %s", b)
+			}
+			if cached := w.Header().Get("X-From-Cache") != ""; cached != (cache && i > 0) {
+				t.Errorf("cache %v, request %d: unexpected X-From-Cache %v", cache, i, cached)
+			}
+		}
+		if n := u.total(); n != 0 {
+			t.Errorf("expected no fetches, got %d", n)
+		}
+	}
+	if _, err := parseSynthetic("{{.Query"); err == nil {
+		t.Error("expected an invalid template to fail")
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+// tenant returns the tenant owning the pages of group cg.
+func (e *entries) tenant(cg group) string {
+	for _, ce := range e.ents[cg] {
+		return ce.tenant
+	}
+	return ""
+}
+
+// tenantOOM evicts the groups of tenant t with the oldest pages until the
+// tenant is within its limits again. The group keep is evicted last.
+func (c *cache) tenantOOM(t string, keep group) {
+	c.debug("tenant %s above its limits", t)
+	tg := makeTimeGroups(c.entries, func(cg group) bool {
+		return cg != keep && c.entries.tenant(cg) == t
+	})
+	for !tg.empty() && c.stat.tenantAbove(t, c.config.tenantEntries, c.config.tenantMemory) {
+		tg.purgeOldest(c)
+	}
+	// The pages of keep alone are above the limits
+	if c.stat.tenantAbove(t, c.config.tenantEntries, c.config.tenantMemory) {
+		c.entries.purge(keep, c.stat)
+		c.evicted(keep, evictCapacity)
+	}
+}
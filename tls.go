@@ -0,0 +1,63 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// certLoader serves the certificate in a pair of files, which can be
+// reloaded to rotate it without a restart.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	mux      sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	cl := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := cl.reload(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// reload reads the certificate again. On error the previous one is kept.
+func (cl *certLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate %s: %s", cl.certFile, err)
+	}
+	cl.mux.Lock()
+	cl.cert = &cert
+	cl.mux.Unlock()
+	return nil
+}
+
+func (cl *certLoader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mux.RLock()
+	defer cl.mux.RUnlock()
+	return cl.cert, nil
+}
+
+// watch reloads the certificate each time a signal arrives on sigs.
+func (cl *certLoader) watch(sigs <-chan os.Signal) {
+	for range sigs {
+		if err := cl.reload(); err != nil {
+			slog.Error("cannot reload certificate", "err", err)
+			continue
+		}
+		slog.Info("reloaded certificate", "file", cl.certFile)
+	}
+}
+
+func (cl *certLoader) config() *tls.Config {
+	return &tls.Config{GetCertificate: cl.get}
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// sampled reports whether r is traced: always if it carries the trace
+// header, otherwise with probability traceRatio.
+func (cf *config) sampled(r *http.Request) bool {
+	if cf.traceHeader != "" && r.Header.Get(cf.traceHeader) != "" {
+		return true
+	}
+	return cf.traceRatio > 0 && rand.Float64() < cf.traceRatio
+}
+
+// span traces the handling of a request in the logs of the origin.
+type span struct {
+	http.ResponseWriter
+	logs  *logbuf
+	r     *http.Request
+	start time.Time
+	code  int
+}
+
+func newSpan(w http.ResponseWriter, r *http.Request, logs *logbuf) *span {
+	return &span{ResponseWriter: w, logs: logs, r: r, start: time.Now(), code: http.StatusOK}
+}
+
+func (s *span) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *span) end() {
+	tagged(s.logs.debug, requestID(s.r.Context()))("trace: %s %s: %d %s in %s", s.r.Method, s.r.URL.Path, s.code,
+		s.Header().Get("X-Cache-Status"), time.Since(s.start))
+}
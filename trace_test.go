@@ -0,0 +1,52 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSampled(t *testing.T) {
+	cf := newConfig("", 10)
+	cf.traceRatio = 0.1
+	cf.traceHeader = "X-Trace"
+	r := httptest.NewRequest("GET", "/test/search/cranes", nil)
+	var n int
+	for i := 0; i < 10000; i++ {
+		if cf.sampled(r) {
+			n++
+		}
+	}
+	if n < 800 || n > 1200 {
+		t.Errorf("expected about 1000 sampled requests, got %d", n)
+	}
+	r.Header.Set("X-Trace", "1")
+	for i := 0; i < 100; i++ {
+		if !cf.sampled(r) {
+			t.Fatal("a request with the trace header should always be sampled")
+		}
+	}
+	cf.traceRatio = 0
+	if cf.sampled(httptest.NewRequest("GET", "/", nil)) {
+		t.Error("no request should be sampled with a zero ratio")
+	}
+}
+
+func TestTraceLogs(t *testing.T) {
+	u := newUpstream(t, nil)
+	o, h := newTestOrigin(t, u, func(cf *config) {
+		cf.traceHeader = "X-Trace"
+	})
+	serve(h, "/test/search/herons")
+	serve(h, "/test/search/cranes", "X-Trace", "1")
+	var buf bytes.Buffer
+	o.logs.WriteTo(&buf)
+	if logs := buf.String(); !strings.Contains(logs, "trace: GET /test/search/cranes: 200") || strings.Contains(logs, "trace: GET /test/search/herons") {
+		t.Errorf("expected only the flagged request to be traced, got:\n%s", logs)
+	}
+}
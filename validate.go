@@ -0,0 +1,79 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// upstreamAddr returns the host and port the URLs of template tmpl connect to.
+func upstreamAddr(tmpl string) (string, error) {
+	u, err := url.Parse(fmt.Sprintf(tmpl, "q", 0))
+	if err != nil {
+		return "", fmt.Errorf("invalid URL template %q: %s", tmpl, err)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid URL template %q: no host", tmpl)
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return "", fmt.Errorf("invalid URL template %q: unknown scheme %q", tmpl, u.Scheme)
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// validate writes a summary of the origins configured by ocs over base to w.
+// If dial is set, it also connects to the host of each of their templates.
+func validate(w io.Writer, ocs []*originConfig, base *config, dial bool) error {
+	timeout := base.fetchTimeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	var failed int
+	for _, oc := range ocs {
+		cf := oc.config(base)
+		fmt.Fprintf(w, "origin %s: incr %d, npref %d, lifetime %s\n", oc.Name, cf.incr, cf.npref, cf.lifetime)
+		tmpls := append([]string{cf.tmpl}, cf.fallbacks...)
+		names := make([]string, 0, len(cf.modes))
+		for m := range cf.modes {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		for _, m := range names {
+			tmpls = append(tmpls, cf.modes[m])
+		}
+		for _, t := range tmpls {
+			addr, err := upstreamAddr(t)
+			if err == nil && dial {
+				var conn net.Conn
+				if conn, err = net.DialTimeout("tcp", addr, timeout); err == nil {
+					conn.Close()
+				}
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "  %s: %s\n", redactTemplate(t), err)
+				continue
+			}
+			fmt.Fprintf(w, "  %s: ok\n", redactTemplate(t))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d invalid or unreachable upstreams", failed)
+	}
+	return nil
+}
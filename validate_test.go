@@ -0,0 +1,46 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	u := newUpstream(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String() + "/?q=%s&of=%d"
+	l.Close()
+	ocs := []*originConfig{
+		{Name: "up", Tmpl: u.tmpl(), Incr: 20},
+		{Name: "down", Tmpl: down, Fallbacks: []string{"ftp://example.com/%s/%d"}},
+	}
+	cf := newConfig("", 10)
+	var out bytes.Buffer
+	if err := validate(&out, ocs[:1], cf, true); err != nil {
+		t.Errorf("expected a reachable upstream to validate, got %s", err)
+	}
+	if !strings.Contains(out.String(), "origin up: incr 20, npref 4") {
+		t.Errorf("expected a summary of the origin, got %q", out.String())
+	}
+	// Without dialing, only the scheme of the fallback is wrong
+	out.Reset()
+	if err := validate(&out, ocs, cf, false); err == nil || !strings.HasPrefix(err.Error(), "1 ") {
+		t.Errorf("expected one invalid template, got %v", err)
+	}
+	if !strings.Contains(out.String(), `unknown scheme "ftp"`) {
+		t.Errorf("expected the invalid template reported, got %q", out.String())
+	}
+	out.Reset()
+	if err := validate(&out, ocs, cf, true); err == nil || !strings.HasPrefix(err.Error(), "2 ") {
+		t.Errorf("expected the closed upstream to fail too, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+// variant is a representation computed from the body of an entry.
+type variant struct {
+	data []byte
+	uses int
+}
+
+func (ce *entry) variantsSize() int {
+	var n int
+	for _, v := range ce.variants {
+		n += len(v.data)
+	}
+	return n
+}
+
+// addVariant keeps data as the variant name of ce, evicting the least used
+// variant if there are already max. It returns the change in memory.
+func (ce *entry) addVariant(name string, data []byte, max int) int {
+	if ce.variants == nil {
+		ce.variants = make(map[string]*variant)
+	}
+	var n int
+	if old, ok := ce.variants[name]; ok {
+		n -= len(old.data)
+		delete(ce.variants, name)
+	}
+	for len(ce.variants) >= max {
+		var lu string
+		for k, v := range ce.variants {
+			if lu == "" || v.uses < ce.variants[lu].uses {
+				lu = k
+			}
+		}
+		n -= len(ce.variants[lu].data)
+		delete(ce.variants, lu)
+	}
+	ce.variants[name] = &variant{data: data, uses: 1}
+	return n + len(data)
+}
+
+// variant returns the representation name of page p of group cg, computing
+// it with compute only if it is not kept with the cached entry of p.
+func (c *cache) variant(cg group, p *page, name string, compute func() ([]byte, error)) ([]byte, error) {
+	if s := c.shard(cg); s != c {
+		return s.variant(cg, p, name, compute)
+	}
+	max := c.config.variants
+	if max <= 0 || p.etag == "" {
+		return compute()
+	}
+	// same reports whether ce still holds the body of p
+	same := func(ce *entry, ok bool) bool {
+		return ok && ce.etag == p.etag && ce.gzipped == p.gzipped
+	}
+	res := make(chan []byte)
+	if err := c.send(func() error {
+		var data []byte
+		if ce, ok := c.entries.get(cg, p.n); same(ce, ok) {
+			if v, ok := ce.variants[name]; ok {
+				v.uses++
+				data = v.data
+			}
+		}
+		res <- data
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if data := <-res; data != nil {
+		return data, nil
+	}
+	data, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	c.send(func() error {
+		if ce, ok := c.entries.get(cg, p.n); same(ce, ok) {
+			c.stat.resize(ce, ce.addVariant(name, data, max))
+			c.debug("added variant %s of page %s/%d", name, cg, p.n)
+		}
+		return nil
+	})
+	return data, nil
+}
@@ -2,15 +2,34 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package interproxy
+
+import "context"
+
+// waiter is closed when the fetch of a page ends. After that, err is
+// the error of the fetch, if it failed, and page is the fetched page if
+// it could not be cached.
+type waiter struct {
+	ch   chan struct{}
+	err  error
+	page *page
+	// clients is how many clients wait for the page
+	clients int
+	// cancel stops the fetch, if it was started for a client
+	cancel context.CancelFunc
+	// streamed is closed when stream is set, if the page is streamed to
+	// the clients while it is fetched
+	streamed chan struct{}
+	stream   *stream
+}
 
 type waiters struct {
-	waits map[group]map[offset]chan struct{}
+	waits map[group]map[offset]*waiter
 }
 
 func newWaiters() *waiters {
 	return &waiters{
-		waits: make(map[group]map[offset]chan struct{}),
+		waits: make(map[group]map[offset]*waiter),
 	}
 }
 
@@ -22,17 +41,17 @@ func (w *waiters) count() int {
 	return tot
 }
 
-func (w *waiters) wait(cg group, n offset) chan struct{} {
+func (w *waiters) wait(cg group, n offset) *waiter {
 	if _, ok := w.waits[cg]; !ok {
-		w.waits[cg] = make(map[offset]chan struct{})
+		w.waits[cg] = make(map[offset]*waiter)
 	} else {
-		if ch, ok := w.waits[cg][n]; ok {
-			return ch
+		if wt, ok := w.waits[cg][n]; ok {
+			return wt
 		}
 	}
-	ch := make(chan struct{})
-	w.waits[cg][n] = ch
-	return ch
+	wt := &waiter{ch: make(chan struct{}), streamed: make(chan struct{})}
+	w.waits[cg][n] = wt
+	return wt
 }
 
 func (w *waiters) has(cg group, n offset) bool {
@@ -44,19 +63,58 @@ func (w *waiters) has(cg group, n offset) bool {
 	return ok
 }
 
-func (w *waiters) done(cg group, n offset) {
+// done wakes up the waiters of page n of cg with the error of its fetch, if any.
+func (w *waiters) done(cg group, n offset, err error) {
 	_, ok := w.waits[cg]
 	if !ok {
 		return
 	}
-	ch, ok := w.waits[cg][n]
+	wt, ok := w.waits[cg][n]
 	if !ok {
 		return
 	}
-	close(ch)
+	wt.err = err
+	if wt.cancel != nil {
+		wt.cancel()
+	}
+	close(wt.ch)
 	delete(w.waits[cg], n)
 	// Cleanup
 	if len(w.waits[cg]) == 0 {
 		delete(w.waits, cg)
 	}
 }
+
+// clear wakes up all the waiters of cg without an error.
+func (w *waiters) clear(cg group) {
+	for n := range w.waits[cg] {
+		w.done(cg, n, nil)
+	}
+}
+
+// pass wakes up the waiters of page n of cg handing them p, which is not cached.
+func (w *waiters) pass(cg group, n offset, p *page) {
+	if wt, ok := w.waits[cg][n]; ok {
+		wt.page = p
+	}
+	w.done(cg, n, nil)
+}
+
+// expire wakes up the waiters of page n of cg with err if wt is still
+// waiting for it. It reports whether it did.
+func (w *waiters) expire(cg group, n offset, wt *waiter, err error) bool {
+	if cur, ok := w.waits[cg][n]; !ok || cur != wt {
+		return false
+	}
+	w.done(cg, n, err)
+	return true
+}
+
+// leave tells that a client stopped waiting for page n of cg with wt. The
+// fetch is canceled if no other client waits for it.
+func (w *waiters) leave(cg group, n offset, wt *waiter) {
+	wt.clients--
+	if cur, ok := w.waits[cg][n]; ok && cur == wt && wt.clients <= 0 && wt.cancel != nil {
+		wt.cancel()
+	}
+}
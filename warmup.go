@@ -0,0 +1,57 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// loadWarmup reads the queries in file path, one for each line. Empty lines
+// and lines starting with # are skipped.
+func loadWarmup(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read warmup queries: %s", err)
+	}
+	var qs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		qs = append(qs, line)
+	}
+	return qs, nil
+}
+
+// warmup requests the first page of each query, one after the other, so
+// that they are cached before clients ask for them. The fetches go through
+// the same limits as the ones of the clients.
+func (o *origin) warmup(qs []string) (fetched, failed int) {
+	slog.Info("warming up cache", "origin", o.name, "queries", len(qs))
+	for i, s := range qs {
+		q := newQuery(s, nil, nil)
+		q.normalize(o.cache.config.normalize)
+		q.setHits(o.cache.config.hitsParam, o.cache.config.hits)
+		_, err := o.cache.get(q, 0)
+		if err == errClosed {
+			break
+		}
+		if err != nil {
+			slog.Warn("cannot warm up query", "origin", o.name, "q", s, "err", err)
+			failed++
+			continue
+		}
+		fetched++
+		if (i+1)%100 == 0 {
+			slog.Info("warming up cache", "origin", o.name, "done", i+1, "queries", len(qs))
+		}
+	}
+	slog.Info("cache warmed up", "origin", o.name, "fetched", fetched, "failed", failed)
+	return fetched, failed
+}
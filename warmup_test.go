@@ -0,0 +1,45 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warmup")
+	if err := os.WriteFile(path, []byte("# popular\ncranes\n\nherons\nbroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	qs, err := loadWarmup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cranes", "herons", "broken"}; !reflect.DeepEqual(qs, want) {
+		t.Fatalf("expected queries %q, got %q", want, qs)
+	}
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(r.URL.RawQuery))
+	})
+	o, _ := newTestOrigin(t, u, func(cf *config) {
+		cf.retries = 0
+	})
+	if fetched, failed := o.warmup(qs); fetched != 2 || failed != 1 {
+		t.Errorf("expected 2 pages fetched and 1 failed, got %d and %d", fetched, failed)
+	}
+	for _, s := range []string{"cranes", "herons"} {
+		if !cached(o.cache, newQuery(s, nil, nil), 0) {
+			t.Errorf("%s: expected the first page to be cached", s)
+		}
+	}
+}
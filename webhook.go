@@ -0,0 +1,164 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events sent to a webhook.
+const (
+	eventEvict = "evict"
+	eventFill  = "fill"
+)
+
+// cacheEvent is posted as JSON to a webhook.
+type cacheEvent struct {
+	Type   string    `json:"type"`
+	Origin string    `json:"origin"`
+	Group  string    `json:"group"`
+	Offset int       `json:"offset,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// webhookTimeout bounds each post of an event to a webhook.
+const webhookTimeout = 10 * time.Second
+
+// webhook posts cache events to a URL from its own goroutine. Events that
+// do not fit in its buffer are dropped, so senders never wait for it.
+type webhook struct {
+	url     string
+	origin  string
+	types   map[string]bool
+	events  chan *cacheEvent
+	retries int
+	backoff time.Duration
+	dropped int64
+	client  *http.Client
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newWebhook starts posting the events of origin with one of types to url.
+func newWebhook(url, origin string, types []string, size int) *webhook {
+	wh := &webhook{
+		url:     url,
+		origin:  origin,
+		types:   make(map[string]bool),
+		events:  make(chan *cacheEvent, size),
+		retries: 3,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: webhookTimeout},
+		done:    make(chan struct{}),
+	}
+	for _, t := range types {
+		wh.types[t] = true
+	}
+	go wh.run()
+	return wh
+}
+
+// parseEventTypes parses a comma separated list of event types.
+func parseEventTypes(s string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case eventEvict, eventFill:
+			types = append(types, t)
+		default:
+			return nil, fmt.Errorf("invalid event type %q", t)
+		}
+	}
+	return types, nil
+}
+
+func (wh *webhook) send(ev *cacheEvent) {
+	if !wh.types[ev.Type] {
+		return
+	}
+	ev.Origin = wh.origin
+	ev.Time = time.Now()
+	select {
+	case wh.events <- ev:
+	default:
+		atomic.AddInt64(&wh.dropped, 1)
+	}
+}
+
+// evicted is an eviction hook.
+func (wh *webhook) evicted(cg group, reason string) {
+	wh.send(&cacheEvent{Type: eventEvict, Group: string(cg), Reason: reason})
+}
+
+// filled is a fill hook.
+func (wh *webhook) filled(cg group, n offset) {
+	wh.send(&cacheEvent{Type: eventFill, Group: string(cg), Offset: int(n)})
+}
+
+// close stops posting events, dropping the ones not posted yet.
+func (wh *webhook) close() {
+	wh.once.Do(func() { close(wh.done) })
+}
+
+func (wh *webhook) run() {
+	for {
+		select {
+		case <-wh.done:
+			return
+		case ev := <-wh.events:
+			select {
+			case <-wh.done:
+				// Both were ready, closing wins
+				return
+			default:
+			}
+			wh.deliver(ev)
+		}
+	}
+}
+
+// deliver posts ev, retrying with a backoff until the webhook is closed.
+func (wh *webhook) deliver(ev *cacheEvent) {
+	var err error
+	for i := 0; i <= wh.retries; i++ {
+		if i > 0 {
+			select {
+			case <-wh.done:
+				return
+			case <-time.After(time.Duration(i) * wh.backoff):
+			}
+		}
+		if err = wh.post(ev); err == nil {
+			return
+		}
+	}
+	slog.Warn("webhook event dropped", "type", ev.Type, "group", ev.Group, "err", err)
+}
+
+func (wh *webhook) post(ev *cacheEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("refused: %s", resp.Status)
+	}
+	return nil
+}
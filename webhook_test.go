@@ -0,0 +1,106 @@
+// Copyright 2017 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var (
+		mux    sync.Mutex
+		events []cacheEvent
+		fails  int32 = 1
+	)
+	hook := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var ev cacheEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		mux.Lock()
+		events = append(events, ev)
+		mux.Unlock()
+	})
+	wh := newWebhook(hook.URL, "test", []string{eventEvict, eventFill}, 10)
+	wh.backoff = time.Millisecond
+	u := newUpstream(t, nil)
+	_, h := newTestOrigin(t, u, func(cf *config) {
+		cf.adminToken = "secret"
+		cf.onEvict = wh.evicted
+		cf.onFill = wh.filled
+	})
+	serve(h, "/test/search/a/1")
+	post(h, "/_/test/purge/a", nil, "X-Admin-Token", "secret")
+	eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(events) == 2
+	})
+	mux.Lock()
+	defer mux.Unlock()
+	if ev := events[0]; ev.Type != eventFill || ev.Group != "a" || ev.Offset != 10 || ev.Origin != "test" {
+		t.Errorf("unexpected fill event %+v", ev)
+	}
+	if ev := events[1]; ev.Type != eventEvict || ev.Group != "a" || ev.Reason != evictManual {
+		t.Errorf("unexpected evict event %+v", ev)
+	}
+}
+
+func TestWebhookClose(t *testing.T) {
+	block := make(chan struct{})
+	hook := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	t.Cleanup(func() { close(block) })
+	wh := newWebhook(hook.URL, "test", []string{eventEvict}, 10)
+	wh.client.Timeout = 20 * time.Millisecond
+	wh.backoff = time.Hour
+	o, _ := newTestOrigin(t, newUpstream(t, nil), func(cf *config) {
+		cf.onClose = wh.close
+	})
+	wh.evicted("a", evictManual)
+	eventually(t, func() bool { return hook.total() == 1 })
+	// The post times out, the webhook waits to retry until closed
+	o.cache.Close()
+	wh.evicted("b", evictManual)
+	time.Sleep(50 * time.Millisecond)
+	if n := hook.total(); n != 1 {
+		t.Errorf("expected no posts after closing, got %d", n)
+	}
+}
+
+func TestWebhookOverflow(t *testing.T) {
+	block := make(chan struct{})
+	hook := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	t.Cleanup(func() { close(block) })
+	wh := newWebhook(hook.URL, "test", []string{eventEvict}, 2)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wh.evicted("a", evictManual)
+		// Not sent at all
+		wh.filled("a", 0)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("sending to a stuck webhook took %s", d)
+	}
+	// One event is being posted, two are buffered
+	if n := atomic.LoadInt64(&wh.dropped); n < 7 {
+		t.Errorf("expected at least 7 dropped events, got %d", n)
+	}
+	if _, err := parseEventTypes("evict,expire"); err == nil {
+		t.Error("expected an unknown event type to fail")
+	}
+}